@@ -2,11 +2,15 @@ package config
 
 import (
 	"context"
-	"log"
+	"log/slog"
 	"os"
+	"strconv"
+	"time"
 
 	"github.com/go-redis/redis/v8"
 	"github.com/joho/godotenv"
+	"github.com/tthogho1/redisconnect/go/metrics"
+	"github.com/tthogho1/redisconnect/go/tracing"
 )
 
 // Ctx is the shared context for Redis operations
@@ -18,7 +22,7 @@ var Rdb *redis.Client
 // InitEnv loads environment variables from .env file
 func InitEnv() {
 	if err := godotenv.Load(); err != nil {
-		log.Println("No .env file found, using environment variables")
+		slog.Info("No .env file found, using environment variables")
 	}
 }
 
@@ -42,9 +46,63 @@ func InitRedis() {
 		DB:       0,
 	})
 
+	Rdb.AddHook(metrics.RedisHook{})
+	Rdb.AddHook(tracing.RedisHook{})
+
 	_, err := Rdb.Ping(Ctx).Result()
 	if err != nil {
-		log.Fatalf("Could not connect to Redis: %v", err)
+		slog.Error("Could not connect to Redis", "addr", host+":"+port, "error", err)
+		os.Exit(1)
+	}
+	slog.Info("Successfully connected to Redis", "addr", host+":"+port)
+}
+
+// GetEnv returns the value of an environment variable or a default
+func GetEnv(key, fallback string) string {
+	if value := os.Getenv(key); value != "" {
+		return value
+	}
+	return fallback
+}
+
+// GetEnvInt returns an integer environment variable or a default
+func GetEnvInt(key string, fallback int) int {
+	value := os.Getenv(key)
+	if value == "" {
+		return fallback
+	}
+	n, err := strconv.Atoi(value)
+	if err != nil {
+		slog.Warn("Invalid integer environment variable, using default", "key", key, "value", value, "default", fallback)
+		return fallback
+	}
+	return n
+}
+
+// GetEnvFloat returns a decimal environment variable or a default
+func GetEnvFloat(key string, fallback float64) float64 {
+	value := os.Getenv(key)
+	if value == "" {
+		return fallback
+	}
+	f, err := strconv.ParseFloat(value, 64)
+	if err != nil {
+		slog.Warn("Invalid decimal environment variable, using default", "key", key, "value", value, "default", fallback)
+		return fallback
+	}
+	return f
+}
+
+// GetEnvDuration returns a duration environment variable (e.g. "30s") or a default
+func GetEnvDuration(key string, fallback time.Duration) time.Duration {
+	value := os.Getenv(key)
+	if value == "" {
+		return fallback
+	}
+	d, err := time.ParseDuration(value)
+	if err != nil {
+		slog.Warn("Invalid duration environment variable, using default", "key", key, "value", value, "default", fallback)
+		return fallback
 	}
-	log.Println("Successfully connected to Redis")
+	return d
 }
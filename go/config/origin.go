@@ -0,0 +1,113 @@
+package config
+
+import (
+	"log/slog"
+	"net/url"
+	"os"
+	"strings"
+)
+
+// defaultOrigins are the allowlists used when CORS_ALLOWED_ORIGINS is not set,
+// keyed by APP_ENV. Production allows only same-origin requests by default.
+var defaultOrigins = map[string][]string{
+	"development": {"http://localhost:*", "http://127.0.0.1:*"},
+	"production":  {},
+}
+
+// OriginPolicy decides which browser origins may call the API and open
+// Socket.IO connections.
+type OriginPolicy struct {
+	AllowAll         bool
+	AllowCredentials bool
+	patterns         []originPattern
+}
+
+type originPattern struct {
+	scheme string
+	host   string // "*.example.com" matches any subdomain
+	port   string // "" for the scheme default, "*" for any port
+}
+
+// LoadOriginPolicy builds the policy from APP_ENV (default development),
+// CORS_ALLOWED_ORIGINS (comma-separated, e.g. "https://app.example.com,
+// https://*.example.com,http://localhost:*" or "*") and
+// CORS_ALLOW_CREDENTIALS (default true; never sent when all origins are allowed).
+func LoadOriginPolicy() *OriginPolicy {
+	env := strings.ToLower(GetEnv("APP_ENV", "development"))
+
+	origins := defaultOrigins[env]
+	if value := os.Getenv("CORS_ALLOWED_ORIGINS"); value != "" {
+		origins = strings.Split(value, ",")
+	}
+
+	policy := &OriginPolicy{AllowCredentials: GetEnv("CORS_ALLOW_CREDENTIALS", "true") == "true"}
+	for _, origin := range origins {
+		origin = strings.TrimSpace(origin)
+		if origin == "" {
+			continue
+		}
+		if origin == "*" {
+			policy.AllowAll = true
+			continue
+		}
+		pattern, ok := parseOriginPattern(origin)
+		if !ok {
+			slog.Warn("Ignoring invalid allowed origin", "origin", origin)
+			continue
+		}
+		policy.patterns = append(policy.patterns, pattern)
+	}
+	if policy.AllowAll {
+		policy.AllowCredentials = false
+	}
+
+	slog.Info("Origin policy loaded", "env", env, "allow_all", policy.AllowAll, "patterns", len(policy.patterns))
+	return policy
+}
+
+func parseOriginPattern(origin string) (originPattern, bool) {
+	scheme, rest, ok := strings.Cut(strings.ToLower(origin), "://")
+	if !ok || scheme == "" || rest == "" || strings.Contains(rest, "/") {
+		return originPattern{}, false
+	}
+	host, port, _ := strings.Cut(rest, ":")
+	if host == "" || (strings.Contains(host, "*") && !strings.HasPrefix(host, "*.")) {
+		return originPattern{}, false
+	}
+	return originPattern{scheme: scheme, host: host, port: port}, true
+}
+
+// Allowed reports whether origin may access the server. requestHost is the
+// Host the request was sent to; same-origin requests are always allowed.
+func (p *OriginPolicy) Allowed(origin, requestHost string) bool {
+	if p.AllowAll {
+		return true
+	}
+	u, err := url.Parse(strings.ToLower(origin))
+	if err != nil || u.Scheme == "" || u.Host == "" {
+		return false
+	}
+	if strings.EqualFold(u.Host, requestHost) {
+		return true
+	}
+
+	host, port := u.Hostname(), u.Port()
+	for _, pattern := range p.patterns {
+		if pattern.scheme != u.Scheme {
+			continue
+		}
+		if pattern.port != "*" && pattern.port != port {
+			continue
+		}
+		if strings.HasPrefix(pattern.host, "*.") {
+			if strings.HasSuffix(host, pattern.host[1:]) {
+				return true
+			}
+			continue
+		}
+		if pattern.host == host {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,58 @@
+package handlers
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"github.com/tthogho1/redisconnect/go/services"
+)
+
+// NearestAirports handles GET /airports/nearest?lat=&lon=&n=&types=.
+// It returns up to n airports (default 5, max 50) sorted by great-circle
+// distance, each with distance_meters and bearing_deg.
+func NearestAirports(c *gin.Context) {
+	lat, latErr := strconv.ParseFloat(c.Query("lat"), 64)
+	lon, lonErr := strconv.ParseFloat(c.Query("lon"), 64)
+	if latErr != nil || lonErr != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "lat and lon are required numbers"})
+		return
+	}
+	n := 0
+	if value := c.Query("n"); value != "" {
+		var err error
+		if n, err = strconv.Atoi(value); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "n must be an integer"})
+			return
+		}
+	}
+	var types []string
+	if value := c.Query("types"); value != "" {
+		types = strings.Split(value, ",")
+	}
+
+	page, err := services.NearestAirports(c.Request.Context(), lat, lon, n, types)
+	if err != nil {
+		writeAirportError(c, err)
+		return
+	}
+
+	c.Header("X-Airport-Source", page.Source)
+	c.JSON(http.StatusOK, page.Airports)
+}
+
+// AirportByCode handles GET /airports/:code, resolving an IATA or ICAO code
+// to the full airport record.
+func AirportByCode(c *gin.Context) {
+	airport, err := services.AirportByCode(c.Request.Context(), c.Param("code"))
+	if err != nil {
+		writeAirportError(c, err)
+		return
+	}
+	if airport == nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "airport not found"})
+		return
+	}
+	c.JSON(http.StatusOK, airport)
+}
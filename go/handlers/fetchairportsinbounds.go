@@ -1,6 +1,7 @@
 package handlers
 
 import (
+	"errors"
 	"net/http"
 
 	"github.com/gin-gonic/gin"
@@ -10,7 +11,8 @@ import (
 
 // FetchAirportsInBounds handles POST /fetchairportsinbounds.
 // It binds the JSON body to AirportsQueryVariables and delegates to
-// services.FetchAirportsInBounds.
+// services.FetchAirportsInBounds. The cursor for the next page (if any) is
+// sent in X-Next-Cursor and the provider that served it in X-Airport-Source.
 func FetchAirportsInBounds(c *gin.Context) {
 	var vars models.AirportsQueryVariables
 	if err := c.ShouldBindJSON(&vars); err != nil {
@@ -18,11 +20,37 @@ func FetchAirportsInBounds(c *gin.Context) {
 		return
 	}
 
-	airports, err := services.FetchAirportsInBounds(c.Request.Context(), vars)
+	page, err := services.FetchAirportsInBounds(c.Request.Context(), vars)
 	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		writeAirportError(c, err)
 		return
 	}
 
-	c.JSON(http.StatusOK, airports)
+	c.Header("X-Airport-Source", page.Source)
+	if page.NextCursor != "" {
+		c.Header("X-Next-Cursor", page.NextCursor)
+	}
+	c.JSON(http.StatusOK, page.Airports)
+}
+
+// writeAirportError maps an airport service error to a response. Hasura
+// failures are reported as 502 with the upstream status and messages.
+func writeAirportError(c *gin.Context, err error) {
+	var upstreamErr *services.UpstreamError
+	switch {
+	case errors.Is(err, services.ErrInvalidBounds) || errors.Is(err, services.ErrInvalidCursor) ||
+		errors.Is(err, services.ErrInvalidAirportQuery) || errors.Is(err, services.ErrTooManyAirports):
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+	case errors.Is(err, services.ErrCircuitOpen):
+		c.JSON(http.StatusServiceUnavailable, gin.H{"error": "upstream temporarily unavailable: " + err.Error()})
+	case errors.As(err, &upstreamErr):
+		c.JSON(http.StatusBadGateway, gin.H{
+			"error":          err.Error(),
+			"upstream":       upstreamErr.Upstream,
+			"upstreamStatus": upstreamErr.StatusCode,
+			"messages":       upstreamErr.Messages,
+		})
+	default:
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+	}
 }
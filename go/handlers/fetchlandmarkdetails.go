@@ -4,27 +4,32 @@ import (
 	"net/http"
 
 	"github.com/gin-gonic/gin"
+	"github.com/tthogho1/redisconnect/go/models"
 	"github.com/tthogho1/redisconnect/go/services"
 )
 
 // FetchLandmarkDetails handles POST /fetchlandmarkdetails.
-// It binds the JSON body to a pageId field and delegates to
-// services.FetchLandmarkDetails.
+// It binds the JSON body to LandmarkDetailsParams (pageId or title, optional
+// lang and fields) and delegates to services.CachedFetchLandmarkDetails, reporting the
+// cache status in X-Cache.
 func FetchLandmarkDetails(c *gin.Context) {
-	var body struct {
-		PageID int64 `json:"pageId" binding:"required"`
-	}
-	if err := c.ShouldBindJSON(&body); err != nil {
+	var params models.LandmarkDetailsParams
+	if err := c.ShouldBindJSON(&params); err != nil {
 		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
 		return
 	}
+	if params.PageID <= 0 && params.Title == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "pageId or title is required"})
+		return
+	}
 
-	landmark, err := services.FetchLandmarkDetails(c.Request.Context(), body.PageID)
+	landmark, status, err := services.CachedFetchLandmarkDetails(c.Request.Context(), params)
 	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		c.JSON(landmarkErrorStatus(err), gin.H{"error": err.Error()})
 		return
 	}
 
+	c.Header("X-Cache", string(status))
 	if landmark == nil {
 		c.JSON(http.StatusNotFound, gin.H{"error": "landmark not found"})
 		return
@@ -0,0 +1,113 @@
+package handlers
+
+import (
+	"context"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/tthogho1/redisconnect/go/config"
+	"github.com/tthogho1/redisconnect/go/services"
+)
+
+var startedAt = time.Now()
+
+// healthCheck is the per-dependency result included in /readyz responses
+type healthCheck struct {
+	Status    string      `json:"status"` // "ok", "degraded" or "fail"
+	LatencyMs float64     `json:"latency_ms,omitempty"`
+	Error     string      `json:"error,omitempty"`
+	Detail    interface{} `json:"detail,omitempty"`
+}
+
+// Livez handles GET /livez.
+// It only reports that the process is up and serving HTTP.
+func Livez(c *gin.Context) {
+	c.JSON(http.StatusOK, gin.H{
+		"status":         "ok",
+		"uptime_seconds": int(time.Since(startedAt).Seconds()),
+	})
+}
+
+// Readyz handles GET /readyz.
+// It checks Redis ping latency, the Pub/Sub subscription and upstream circuit
+// breakers, and returns 503 when the instance should not receive traffic.
+func Readyz(c *gin.Context) {
+	checks := map[string]healthCheck{
+		"shutdown":     checkShutdown(),
+		"redis":        checkRedis(c.Request.Context()),
+		"subscription": checkSubscription(),
+		"upstreams":    checkUpstreams(),
+	}
+
+	status := "ok"
+	code := http.StatusOK
+	for _, check := range checks {
+		switch check.Status {
+		case "fail":
+			status = "fail"
+			code = http.StatusServiceUnavailable
+		case "degraded":
+			if status == "ok" {
+				status = "degraded"
+			}
+		}
+	}
+
+	c.JSON(code, gin.H{"status": status, "checks": checks})
+}
+
+// checkShutdown fails once the instance has started draining
+func checkShutdown() healthCheck {
+	if services.ShuttingDown() {
+		return healthCheck{Status: "fail", Error: "instance is shutting down"}
+	}
+	return healthCheck{Status: "ok"}
+}
+
+// checkRedis pings Redis and fails when it errors or exceeds READYZ_REDIS_MAX_LATENCY
+func checkRedis(ctx context.Context) healthCheck {
+	maxLatency := config.GetEnvDuration("READYZ_REDIS_MAX_LATENCY", 500*time.Millisecond)
+
+	ctx, cancel := context.WithTimeout(ctx, 2*time.Second)
+	defer cancel()
+
+	start := time.Now()
+	err := config.Rdb.Ping(ctx).Err()
+	latency := time.Since(start)
+
+	check := healthCheck{Status: "ok", LatencyMs: float64(latency.Microseconds()) / 1000.0}
+	if err != nil {
+		check.Status = "fail"
+		check.Error = err.Error()
+	} else if latency > maxLatency {
+		check.Status = "fail"
+		check.Error = "ping latency above " + maxLatency.String()
+	}
+	return check
+}
+
+// checkSubscription fails while the Pub/Sub subscriber is reconnecting,
+// since this instance would miss cross-instance chat and location events.
+func checkSubscription() healthCheck {
+	sub := services.SubscriptionHealth()
+	check := healthCheck{Status: "ok", Detail: sub}
+	if !sub.Connected {
+		check.Status = "fail"
+		check.Error = "redis subscription not connected"
+	}
+	return check
+}
+
+// checkUpstreams reports open circuit breakers as degraded. Upstream outages
+// affect every instance alike, so they do not take this one out of rotation.
+func checkUpstreams() healthCheck {
+	states := services.UpstreamBreakerStates()
+	check := healthCheck{Status: "ok", Detail: states}
+	for _, state := range states {
+		if state.State != services.CircuitClosed {
+			check.Status = "degraded"
+		}
+	}
+	return check
+}
@@ -1,6 +1,7 @@
 package handlers
 
 import (
+	"errors"
 	"net/http"
 
 	"github.com/gin-gonic/gin"
@@ -18,11 +19,30 @@ func FetchLandmarks(c *gin.Context) {
 		return
 	}
 
-	landmarks, err := services.FetchLandmarksInBounds(c.Request.Context(), vars)
+	page, err := services.FetchLandmarksInBounds(c.Request.Context(), vars)
 	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		c.JSON(landmarkErrorStatus(err), gin.H{"error": err.Error()})
 		return
 	}
 
-	c.JSON(http.StatusOK, landmarks)
+	writeLandmarkPage(c, page)
+}
+
+// writeLandmarkPage sends the landmarks, with the cache status in X-Cache and
+// the cursor for the next page (if any) in X-Next-Cursor
+func writeLandmarkPage(c *gin.Context, page services.LandmarkPage) {
+	c.Header("X-Cache", string(page.Cache))
+	if page.NextCursor != "" {
+		c.Header("X-Next-Cursor", page.NextCursor)
+	}
+	c.JSON(http.StatusOK, page.Landmarks)
+}
+
+// landmarkErrorStatus maps a landmark service error to an HTTP status
+func landmarkErrorStatus(err error) int {
+	if errors.Is(err, services.ErrInvalidBounds) || errors.Is(err, services.ErrInvalidCursor) ||
+		errors.Is(err, services.ErrInvalidFields) || errors.Is(err, services.ErrUnknownProvider) {
+		return http.StatusBadRequest
+	}
+	return http.StatusInternalServerError
 }
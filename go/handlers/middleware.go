@@ -0,0 +1,89 @@
+package handlers
+
+import (
+	"log/slog"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/tthogho1/redisconnect/go/config"
+	"github.com/tthogho1/redisconnect/go/logging"
+)
+
+// RequestLogger assigns each HTTP request a correlation ID (reusing a valid
+// incoming X-Request-ID), stores it in the request context, echoes it in the
+// response and writes a structured access log line.
+func RequestLogger() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		start := time.Now()
+
+		id := c.GetHeader(logging.CorrelationHeader)
+		if id == "" || len(id) > 128 {
+			id = logging.NewCorrelationID()
+		}
+		c.Request = c.Request.WithContext(logging.WithCorrelationID(c.Request.Context(), id))
+		c.Writer.Header().Set(logging.CorrelationHeader, id)
+
+		c.Next()
+
+		level := slog.LevelInfo
+		switch {
+		case c.Writer.Status() >= 500:
+			level = slog.LevelError
+		case c.Request.URL.Path == "/health" || c.Request.URL.Path == "/livez" ||
+			c.Request.URL.Path == "/readyz" || c.Request.URL.Path == "/metrics":
+			level = slog.LevelDebug
+		}
+		logging.FromContext(c.Request.Context()).Log(c.Request.Context(), level, "HTTP request",
+			"method", c.Request.Method,
+			"path", c.Request.URL.Path,
+			"status", c.Writer.Status(),
+			"elapsed", time.Since(start),
+			"client_ip", c.ClientIP(),
+		)
+	}
+}
+
+// CORS applies the origin policy to Gin routes. Allowed origins are echoed
+// back (never combined with "*" when credentials are enabled); preflight
+// requests from other origins are rejected with 403.
+func CORS(policy *config.OriginPolicy) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		origin := c.GetHeader("Origin")
+		if origin == "" {
+			// Not a browser cross-origin request
+			c.Next()
+			return
+		}
+
+		c.Writer.Header().Add("Vary", "Origin")
+		if !policy.Allowed(origin, c.Request.Host) {
+			if c.Request.Method == http.MethodOptions {
+				c.AbortWithStatus(http.StatusForbidden)
+				return
+			}
+			// Without CORS headers the browser blocks the response
+			c.Next()
+			return
+		}
+
+		if policy.AllowAll {
+			c.Writer.Header().Set("Access-Control-Allow-Origin", "*")
+		} else {
+			c.Writer.Header().Set("Access-Control-Allow-Origin", origin)
+			if policy.AllowCredentials {
+				c.Writer.Header().Set("Access-Control-Allow-Credentials", "true")
+			}
+		}
+		c.Writer.Header().Set("Access-Control-Expose-Headers", "X-Request-ID, RateLimit-Limit, RateLimit-Remaining, RateLimit-Reset, RateLimit-Policy, Retry-After, X-Cache, X-Next-Cursor, X-Airport-Source")
+
+		if c.Request.Method == http.MethodOptions {
+			c.Writer.Header().Set("Access-Control-Allow-Methods", "GET, POST, PUT, DELETE, OPTIONS")
+			c.Writer.Header().Set("Access-Control-Allow-Headers", "Content-Type, Authorization, X-Requested-With, X-Request-ID, Origin")
+			c.Writer.Header().Set("Access-Control-Max-Age", "600")
+			c.AbortWithStatus(http.StatusNoContent)
+			return
+		}
+		c.Next()
+	}
+}
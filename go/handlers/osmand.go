@@ -0,0 +1,62 @@
+package handlers
+
+import (
+	"errors"
+	"net/http"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"github.com/tthogho1/redisconnect/go/logging"
+	"github.com/tthogho1/redisconnect/go/services"
+)
+
+// OsmAnd handles GET or POST /osmand?id=&lat=&lon=&speed=&bearing=&batt=,
+// the OsmAnd protocol spoken by Traccar Client and other trackers. The
+// device's API key goes in the key parameter or an Authorization: Bearer
+// header. Fixes go through the same pipeline as Socket.IO location events.
+func OsmAnd(c *gin.Context) {
+	if err := c.Request.ParseForm(); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	params := c.Request.Form
+
+	id := params.Get("id")
+	if id == "" {
+		id = params.Get("deviceid")
+	}
+	key := params.Get("key")
+	if bearer, ok := strings.CutPrefix(c.GetHeader("Authorization"), "Bearer "); ok {
+		key = bearer
+	}
+	device, err := services.AuthenticateOsmAndDevice(id, key)
+	if err != nil {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": err.Error()})
+		return
+	}
+
+	location, err := services.ParseOsmAndFix(params, device)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	ctx := c.Request.Context()
+	_, err = services.ProcessLocation(ctx, location)
+	var rejection *services.LocationRejection
+	if errors.As(err, &rejection) {
+		// Trackers resend fixes that fail, so filtered ones are acknowledged
+		c.JSON(http.StatusOK, gin.H{"status": "rejected", "reason": rejection.Reason, "held": rejection.Held})
+		return
+	}
+	if err != nil {
+		logging.FromContext(ctx).Warn("OsmAnd location failed", "device_id", id, "user_id", location.ID, "error", err)
+		status := http.StatusInternalServerError
+		if errors.Is(err, services.ErrInvalidLocation) {
+			status = http.StatusBadRequest
+		}
+		c.JSON(status, gin.H{"error": err.Error()})
+		return
+	}
+	c.Status(http.StatusOK)
+}
@@ -0,0 +1,175 @@
+package handlers
+
+import (
+	"fmt"
+	"math"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+
+	socketio "github.com/doquangtan/socketio/v4"
+	"github.com/gin-gonic/gin"
+	"github.com/tthogho1/redisconnect/go/logging"
+	"github.com/tthogho1/redisconnect/go/metrics"
+	"github.com/tthogho1/redisconnect/go/services"
+)
+
+// RateLimit applies the per-route policy (keyed by the Gin route path) to the
+// client IP and, for requests with a session, to the session's user. Limited
+// routes get RateLimit-* headers; rejected requests get 429.
+func RateLimit() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		route := c.FullPath()
+		if route == "" || c.Request.Method == http.MethodOptions {
+			c.Next()
+			return
+		}
+
+		subjects := []string{"ip:" + c.ClientIP()}
+		if userID := bearerSessionUser(c); userID != "" {
+			subjects = append(subjects, "user:"+userID)
+		}
+		result, limited := services.CheckRateLimits(c.Request.Context(), route, subjects...)
+		if !limited {
+			c.Next()
+			return
+		}
+
+		resetSeconds := int(math.Ceil(result.Reset.Seconds()))
+		c.Header("RateLimit-Limit", strconv.Itoa(result.Limit))
+		c.Header("RateLimit-Remaining", strconv.Itoa(result.Remaining))
+		c.Header("RateLimit-Reset", strconv.Itoa(resetSeconds))
+		c.Header("RateLimit-Policy", fmt.Sprintf("%d;w=%d", result.Policy.Limit, int(result.Policy.Window.Seconds())))
+
+		if !result.Allowed {
+			metrics.RateLimited(route)
+			logging.FromContext(c.Request.Context()).Warn("Rate limited", "route", route, "client_ip", c.ClientIP())
+			c.Header("Retry-After", strconv.Itoa(resetSeconds))
+			c.AbortWithStatusJSON(http.StatusTooManyRequests, gin.H{"error": "rate limit exceeded"})
+			return
+		}
+		c.Next()
+	}
+}
+
+// AllowSocketEvent applies the per-event policy to a Socket.IO event, keyed
+// by the user the socket registered as, so a user's sockets share one bucket,
+// or by socket ID before it registers. Payload user IDs are chosen by the
+// client and never used. An unregistered client can only get a fresh bucket
+// by reconnecting, which AllowSocketHandshake limits per IP. Rejected events
+// get a rate_limited event and should be dropped.
+func AllowSocketEvent(socket *socketio.Socket, eventName string) bool {
+	subject := "socket:" + socket.Id
+	if userID, ok := socketUser(socket.Id); ok {
+		subject = "user:" + userID
+	}
+
+	ctx := logging.NewContext()
+	result, limited := services.CheckRateLimit(ctx, eventName, subject)
+	if !limited || result.Allowed {
+		return true
+	}
+
+	metrics.RateLimited(eventName)
+	logging.FromContext(ctx).Warn("Rate limited", "event", eventName, "subject", subject, "socket_id", socket.Id)
+	socket.Emit("rate_limited", map[string]interface{}{
+		"event":          eventName,
+		"limit":          result.Limit,
+		"window_ms":      result.Policy.Window.Milliseconds(),
+		"retry_after_ms": result.Reset.Milliseconds(),
+	})
+	return false
+}
+
+// socketHandshakePolicy is the policy name for Socket.IO connections per IP
+const socketHandshakePolicy = "/socket.io"
+
+// AllowSocketHandshake applies the Socket.IO connection policy to the client
+// IP of a handshake request, answering 429 when it is exceeded
+func AllowSocketHandshake(w http.ResponseWriter, r *http.Request) bool {
+	ip := requestClientIP(r)
+	result, limited := services.CheckRateLimit(r.Context(), socketHandshakePolicy, "ip:"+ip)
+	if !limited || result.Allowed {
+		return true
+	}
+
+	metrics.RateLimited(socketHandshakePolicy)
+	logging.FromContext(r.Context()).Warn("Rate limited", "route", socketHandshakePolicy, "client_ip", ip)
+	w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(result.Reset.Seconds()))))
+	http.Error(w, "rate limit exceeded", http.StatusTooManyRequests)
+	return false
+}
+
+var (
+	trustedProxyNets   []*net.IPNet
+	trustedProxiesOnce sync.Once
+)
+
+// TrustedProxies returns TRUSTED_PROXIES, comma-separated IPs or CIDRs of the
+// load balancers in front of the server, for gin's SetTrustedProxies.
+// X-Forwarded-For and X-Real-IP are only honored from these addresses; by
+// default none are trusted and the client IP is the remote address.
+func TrustedProxies() []string {
+	var proxies []string
+	for _, entry := range strings.Split(os.Getenv("TRUSTED_PROXIES"), ",") {
+		if entry = strings.TrimSpace(entry); entry != "" {
+			proxies = append(proxies, entry)
+		}
+	}
+	return proxies
+}
+
+// isTrustedProxy reports whether ip is in TRUSTED_PROXIES
+func isTrustedProxy(ip net.IP) bool {
+	trustedProxiesOnce.Do(func() {
+		for _, proxy := range TrustedProxies() {
+			if !strings.Contains(proxy, "/") {
+				if strings.Contains(proxy, ":") {
+					proxy += "/128"
+				} else {
+					proxy += "/32"
+				}
+			}
+			if _, network, err := net.ParseCIDR(proxy); err == nil {
+				trustedProxyNets = append(trustedProxyNets, network)
+			}
+		}
+	})
+	for _, network := range trustedProxyNets {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// requestClientIP mirrors Gin's ClientIP with TrustedProxies for requests
+// that bypass the router: when the remote address is a trusted proxy, the
+// last X-Forwarded-For (then X-Real-IP) entry not added by a trusted proxy;
+// otherwise the remote address
+func requestClientIP(r *http.Request) string {
+	remote, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		remote = r.RemoteAddr
+	}
+	if ip := net.ParseIP(remote); ip == nil || !isTrustedProxy(ip) {
+		return remote
+	}
+	for _, header := range []string{"X-Forwarded-For", "X-Real-IP"} {
+		entries := strings.Split(r.Header.Get(header), ",")
+		// Walk back from the proxy nearest to us
+		for i := len(entries) - 1; i >= 0; i-- {
+			ip := net.ParseIP(strings.TrimSpace(entries[i]))
+			if ip == nil {
+				break
+			}
+			if i == 0 || !isTrustedProxy(ip) {
+				return ip.String()
+			}
+		}
+	}
+	return remote
+}
@@ -1,37 +1,60 @@
 package handlers
 
 import (
-	"encoding/json"
+	"errors"
 	"net/http"
+	"strconv"
+	"sync"
 
 	socketio "github.com/doquangtan/socketio/v4"
 	"github.com/gin-gonic/gin"
-	"github.com/tthogho1/redisconnect/go/config"
 	"github.com/tthogho1/redisconnect/go/models"
 	"github.com/tthogho1/redisconnect/go/services"
 )
 
-// GetAllUsers returns all users from Redis
+// GetAllUsers returns the users visible to the session's user, with
+// coordinates fuzzed as their privacy settings require. Without a session
+// only users visible to everyone are listed.
 func GetAllUsers(c *gin.Context) {
-	users := services.GetAllUsersFromRedis()
+	viewerID, ok := sessionUser(c)
+	if !ok {
+		return
+	}
+	users, err := services.VisibleUsers(c.Request.Context(), viewerID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
 	c.JSON(http.StatusOK, users)
 }
 
-// CreateUser creates a new user
-func CreateUser(c *gin.Context, io *socketio.Io) {
+// CreateUser creates a new user. The position goes through the same
+// pipeline as location events, so every instance emits it as user_updated;
+// this instance also emits user_added to the sockets allowed to see the user.
+func CreateUser(c *gin.Context, io *socketio.Io, userSIDMap map[string]*socketio.Socket, userSIDLock *sync.RWMutex) {
 	var user models.User
 	if err := c.ShouldBindJSON(&user); err != nil {
 		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
 		return
 	}
 
-	if err := services.SaveUserToRedis(user.ID, user.Name, user.Latitude, user.Longitude); err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+	locationData, err := services.ProcessLocation(c.Request.Context(), models.LocationData{
+		ID:        user.ID,
+		Name:      user.Name,
+		Latitude:  user.Latitude,
+		Longitude: user.Longitude,
+		Telemetry: user.Telemetry,
+	})
+	if err != nil {
+		writeLocationError(c, err)
 		return
 	}
 
-	io.Emit("user_added", user)
+	services.EmitToViewers(c.Request.Context(), io, userSIDMap, userSIDLock, user.ID, "user_added", locationData)
 
+	// The filter may have smoothed the position, so answer with what was saved
+	user.Latitude, _ = locationData["latitude"].(float64)
+	user.Longitude, _ = locationData["longitude"].(float64)
 	c.JSON(http.StatusCreated, user)
 }
 
@@ -39,14 +62,13 @@ func CreateUser(c *gin.Context, io *socketio.Io) {
 func DeleteUser(c *gin.Context, io *socketio.Io) {
 	userID := c.Param("user_id")
 
-	if err := services.DeleteUserFromRedis(userID); err != nil {
+	if err := services.DeleteUserFromRedis(c.Request.Context(), userID); err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
 		return
 	}
 
 	deleteData := map[string]string{"id": userID}
-	deleteJSON, _ := json.Marshal(deleteData)
-	config.Rdb.Publish(config.Ctx, services.UserDeletedChannel, string(deleteJSON))
+	services.PublishEvent(c.Request.Context(), services.UserDeletedChannel, deleteData)
 
 	io.Emit("user_deleted", deleteData)
 
@@ -54,7 +76,7 @@ func DeleteUser(c *gin.Context, io *socketio.Io) {
 }
 
 // UpdateUser updates an existing user's info (name and/or location)
-func UpdateUser(c *gin.Context, io *socketio.Io) {
+func UpdateUser(c *gin.Context) {
 	userID := c.Param("user_id")
 
 	var user models.User
@@ -75,22 +97,146 @@ func UpdateUser(c *gin.Context, io *socketio.Io) {
 		name = userID
 	}
 
-	if err := services.SaveUserToRedis(userID, name, user.Latitude, user.Longitude); err != nil {
+	// Every instance, this one included, emits the update to the clients the
+	// user's privacy settings allow
+	locationData, err := services.ProcessLocation(c.Request.Context(), models.LocationData{
+		ID:        userID,
+		Name:      name,
+		Latitude:  user.Latitude,
+		Longitude: user.Longitude,
+		Telemetry: user.Telemetry,
+	})
+	if err != nil {
+		writeLocationError(c, err)
+		return
+	}
+
+	c.JSON(http.StatusOK, locationData)
+}
+
+// writeLocationError answers a location write that ProcessLocation refused:
+// 422 with the reason for filtered fixes, 400 for invalid ones
+func writeLocationError(c *gin.Context, err error) {
+	var rejection *services.LocationRejection
+	switch {
+	case errors.As(err, &rejection):
+		c.JSON(http.StatusUnprocessableEntity, gin.H{"error": err.Error(), "reason": rejection.Reason, "held": rejection.Held})
+	case errors.Is(err, services.ErrInvalidLocation):
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+	default:
 		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+	}
+}
+
+// GetUserTrips handles GET /users/:user_id/trips?limit=&before=, returning
+// stored trip summaries newest first. before is a Unix millisecond start
+// time to page back from. The user's privacy settings apply to the session's
+// user: hidden trips get 404, fuzzed ones snapped end points.
+func GetUserTrips(c *gin.Context) {
+	viewerID, ok := sessionUser(c)
+	if !ok {
+		return
+	}
+	limit, err := strconv.Atoi(c.DefaultQuery("limit", "0"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "limit must be an integer"})
+		return
+	}
+	before, err := strconv.ParseInt(c.DefaultQuery("before", "0"), 10, 64)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "before must be a Unix time in milliseconds"})
 		return
 	}
 
-	// Publish update to other instances and notify connected clients
-	locationData := map[string]interface{}{
-		"id":        userID,
-		"name":      name,
-		"latitude":  user.Latitude,
-		"longitude": user.Longitude,
+	trips, err := services.VisibleTrips(c.Request.Context(), viewerID, c.Param("user_id"), limit, before)
+	if errors.Is(err, services.ErrInvalidTripQuery) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if errors.Is(err, services.ErrTripsHidden) {
+		c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
 	}
-	locationJSON, _ := json.Marshal(locationData)
-	config.Rdb.Publish(config.Ctx, services.UserLocationChannel, string(locationJSON))
+	c.JSON(http.StatusOK, trips)
+}
 
-	io.Emit("user_updated", locationData)
+// GetPrivacy handles GET /users/:user_id/privacy. Like the other privacy
+// and contacts routes, it needs the user's own session token.
+func GetPrivacy(c *gin.Context) {
+	if !requireSessionOwner(c) {
+		return
+	}
+	settings, err := services.GetPrivacySettings(c.Request.Context(), c.Param("user_id"))
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, settings)
+}
 
-	c.JSON(http.StatusOK, locationData)
+// UpdatePrivacy handles PUT /users/:user_id/privacy with {"visibility",
+// "allowed", "precision", "ghost"}, replacing the user's privacy settings
+func UpdatePrivacy(c *gin.Context) {
+	if !requireSessionOwner(c) {
+		return
+	}
+	var settings models.PrivacySettings
+	if err := c.ShouldBindJSON(&settings); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	settings, err := services.SetPrivacySettings(c.Request.Context(), c.Param("user_id"), settings)
+	if errors.Is(err, services.ErrInvalidPrivacy) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, settings)
+}
+
+// GetContacts handles GET /users/:user_id/contacts
+func GetContacts(c *gin.Context) {
+	if !requireSessionOwner(c) {
+		return
+	}
+	contacts, err := services.GetContacts(c.Request.Context(), c.Param("user_id"))
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"contacts": contacts})
+}
+
+// UpdateContacts handles PUT /users/:user_id/contacts with {"contacts": [...]},
+// replacing the users who can see this one under contacts visibility
+func UpdateContacts(c *gin.Context) {
+	if !requireSessionOwner(c) {
+		return
+	}
+	var body struct {
+		Contacts []string `json:"contacts"`
+	}
+	if err := c.ShouldBindJSON(&body); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	contacts, err := services.SetContacts(c.Request.Context(), c.Param("user_id"), body.Contacts)
+	if errors.Is(err, services.ErrInvalidPrivacy) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"contacts": contacts})
 }
@@ -10,7 +10,7 @@ import (
 
 // SearchLandmarksNearby handles POST /searchlandmarksnearby.
 // It binds the JSON body to LandmarkQueryParams and delegates to
-// services.SearchLandmarksNearby.
+// services.CachedSearchLandmarksNearby.
 func SearchLandmarksNearby(c *gin.Context) {
 	var params models.LandmarkQueryParams
 	if err := c.ShouldBindJSON(&params); err != nil {
@@ -18,11 +18,11 @@ func SearchLandmarksNearby(c *gin.Context) {
 		return
 	}
 
-	landmarks, err := services.SearchLandmarksNearby(c.Request.Context(), params)
+	page, err := services.CachedSearchLandmarksNearby(c.Request.Context(), params)
 	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		c.JSON(landmarkErrorStatus(err), gin.H{"error": err.Error()})
 		return
 	}
 
-	c.JSON(http.StatusOK, landmarks)
+	writeLandmarkPage(c, page)
 }
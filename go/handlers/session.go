@@ -0,0 +1,100 @@
+package handlers
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"strings"
+	"sync"
+
+	"github.com/gin-gonic/gin"
+	"github.com/tthogho1/redisconnect/go/services"
+)
+
+// socketSession is the user a socket registered as and the session token it
+// was issued
+type socketSession struct {
+	UserID string
+	Token  string
+}
+
+// socketSessions maps socket IDs to their socketSession, so events act as the
+// registered user and the token is revoked with the socket
+var socketSessions sync.Map
+
+// startSocketSession issues a session for a socket whose user has been
+// authenticated, revoking any the socket held for a previous registration
+func startSocketSession(ctx context.Context, socketID, userID string) (string, error) {
+	endSocketSession(ctx, socketID)
+	token, err := services.IssueSession(ctx, userID)
+	if err != nil {
+		return "", err
+	}
+	socketSessions.Store(socketID, socketSession{UserID: userID, Token: token})
+	return token, nil
+}
+
+// endSocketSession revokes the session issued to a socket, if any
+func endSocketSession(ctx context.Context, socketID string) {
+	if session, ok := socketSessions.LoadAndDelete(socketID); ok {
+		services.RevokeSession(ctx, session.(socketSession).Token)
+	}
+}
+
+// socketUser returns the user a socket registered as
+func socketUser(socketID string) (string, bool) {
+	session, ok := socketSessions.Load(socketID)
+	if !ok {
+		return "", false
+	}
+	return session.(socketSession).UserID, true
+}
+
+// sessionUser returns the user a REST request's "Authorization: Bearer"
+// session token belongs to, or "" for requests without one. Unknown tokens
+// are answered with 401 and ok is false.
+func sessionUser(c *gin.Context) (userID string, ok bool) {
+	token, found := strings.CutPrefix(c.GetHeader("Authorization"), "Bearer ")
+	if !found || token == "" {
+		return "", true
+	}
+	userID, err := services.SessionUser(c.Request.Context(), token)
+	if errors.Is(err, services.ErrInvalidSession) {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": err.Error()})
+		return "", false
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return "", false
+	}
+	return userID, true
+}
+
+// bearerSessionUser returns the user of a valid "Authorization: Bearer"
+// session token, or "" without writing a response
+func bearerSessionUser(c *gin.Context) string {
+	token, found := strings.CutPrefix(c.GetHeader("Authorization"), "Bearer ")
+	if !found || token == "" {
+		return ""
+	}
+	userID, _ := services.SessionUser(c.Request.Context(), token)
+	return userID
+}
+
+// requireSessionOwner answers 401 or 403 unless the request carries a session
+// for the :user_id in the path
+func requireSessionOwner(c *gin.Context) bool {
+	userID, ok := sessionUser(c)
+	if !ok {
+		return false
+	}
+	if userID == "" {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "session token required"})
+		return false
+	}
+	if userID != c.Param("user_id") {
+		c.JSON(http.StatusForbidden, gin.H{"error": "settings belong to another user"})
+		return false
+	}
+	return true
+}
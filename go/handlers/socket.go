@@ -1,96 +1,204 @@
 package handlers
 
 import (
-	"encoding/json"
-	"log"
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
 	"sync"
 
 	socketio "github.com/doquangtan/socketio/v4"
-	"github.com/tthogho1/redisconnect/go/config"
+	"github.com/tthogho1/redisconnect/go/logging"
+	"github.com/tthogho1/redisconnect/go/metrics"
+	"github.com/tthogho1/redisconnect/go/models"
 	"github.com/tthogho1/redisconnect/go/services"
+	"github.com/tthogho1/redisconnect/go/tracing"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
 )
 
+// newEventContext starts a correlation context and a server span for a
+// Socket.IO event. Callers must end the returned span.
+func newEventContext(socketID string, event string) (context.Context, *slog.Logger, trace.Span) {
+	ctx, span := tracing.Start(logging.NewContext(), "socketio "+event,
+		trace.WithSpanKind(trace.SpanKindServer),
+		trace.WithAttributes(
+			attribute.String("socketio.event", event),
+			attribute.String("socketio.socket_id", socketID),
+		))
+	return ctx, logging.FromContext(ctx).With("event", event, "socket_id", socketID), span
+}
+
 // HandleRegister handles user registration events
 func HandleRegister(socket *socketio.Socket, event *socketio.EventPayload, userSIDMap map[string]*socketio.Socket, userSIDLock *sync.RWMutex) {
-	log.Printf("📥 Register event received, data length: %d", len(event.Data))
+	ctx, logger, span := newEventContext(socket.Id, "register")
+	defer span.End()
+	logger.Debug("Register event received", "data_length", len(event.Data))
 	var data map[string]interface{}
 
 	if len(event.Data) > 0 {
 		var ok bool
 		data, ok = event.Data[0].(map[string]interface{})
 		if !ok {
-			log.Printf("❌ Invalid register data format, received type: %T", event.Data[0])
+			logger.Warn("Invalid register data format", "type", fmt.Sprintf("%T", event.Data[0]))
 			return
 		}
 	}
 
 	userID, ok := data["user_id"].(string)
 	if !ok {
-		log.Printf("❌ user_id not found in register data: %+v", data)
+		logger.Warn("user_id not found in register data")
+		return
+	}
+
+	// The client's user_id is only taken with a credential signed for it,
+	// since the registered user decides what the socket may see and move
+	credential, _ := data["credential"].(string)
+	if err := services.VerifyUserCredential(userID, credential); err != nil {
+		logger.Warn("Register rejected", "user_id", userID, "error", err)
+		socket.Emit("register_ack", map[string]interface{}{
+			"status": "error",
+			"error":  err.Error(),
+		})
+		return
+	}
+
+	// The token identifies the user to the REST API while the socket is
+	// connected, e.g. for privacy settings
+	previous, reregistered := socketUser(socket.Id)
+	token, err := startSocketSession(ctx, socket.Id, userID)
+	if err != nil {
+		logger.Warn("Could not issue session", "user_id", userID, "error", err)
+		socket.Emit("register_ack", map[string]interface{}{
+			"status": "error",
+			"error":  "could not start session",
+		})
 		return
 	}
 
 	userSIDLock.Lock()
+	if reregistered && previous != userID && userSIDMap[previous] == socket {
+		delete(userSIDMap, previous)
+	}
 	userSIDMap[userID] = socket
+	metrics.RegisteredUsers.Set(float64(len(userSIDMap)))
 	userSIDLock.Unlock()
 
-	log.Printf("✅ User registered: %s (socket: %s)", userID, socket.Id)
+	logger.Info("User registered", "user_id", userID)
 
 	socket.Emit("register_ack", map[string]interface{}{
 		"status":  "ok",
 		"user_id": userID,
+		"token":   token,
 	})
+
+	// The user may see more than an anonymous socket, e.g. contacts' positions
+	users, err := services.VisibleUsers(ctx, userID)
+	if err != nil {
+		logger.Warn("Could not load visible users", "user_id", userID, "error", err)
+		return
+	}
+	socket.Emit("all_users", users)
 }
 
-// HandleLocation handles user location updates
-func HandleLocation(socket *socketio.Socket, event *socketio.EventPayload, io *socketio.Io) {
-	log.Printf("📍 Location event received, data length: %d", len(event.Data))
+// HandleLocation handles location updates of the user the socket registered
+// as. Besides name, latitude and longitude, it takes the Geolocation API's
+// accuracy, altitude, heading and speed, and the fix timestamp in Unix
+// milliseconds; an id other than the registered user is rejected. Every
+// instance, this one included, emits the update to the clients the user's
+// privacy allows.
+func HandleLocation(socket *socketio.Socket, event *socketio.EventPayload) {
+	ctx, logger, span := newEventContext(socket.Id, "location")
+	defer span.End()
+	logger.Debug("Location event received", "data_length", len(event.Data))
 	var data map[string]interface{}
 
 	if len(event.Data) > 0 {
 		var ok bool
 		data, ok = event.Data[0].(map[string]interface{})
 		if !ok {
-			log.Printf("❌ Invalid location data format, received type: %T", event.Data[0])
+			logger.Warn("Invalid location data format")
 			return
 		}
 	}
 
-	userID, _ := data["id"].(string)
-	name, _ := data["name"].(string)
-	latitude, _ := data["latitude"].(float64)
-	longitude, _ := data["longitude"].(float64)
-
-	if err := services.SaveUserToRedis(userID, name, latitude, longitude); err != nil {
+	userID, registered := socketUser(socket.Id)
+	id, _ := data["id"].(string)
+	if !registered || (id != "" && id != userID) {
+		logger.Warn("Location update rejected", "user_id", id, "registered", registered, "registered_as", userID)
+		socket.Emit("location_ack", map[string]interface{}{
+			"status": "rejected",
+			"reason": "forbidden",
+		})
 		return
 	}
 
-	locationData := map[string]interface{}{
-		"id":        userID,
-		"name":      name,
-		"latitude":  latitude,
-		"longitude": longitude,
+	location := models.LocationData{}
+	location.ID = userID
+	location.Name, _ = data["name"].(string)
+	location.Latitude, _ = data["latitude"].(float64)
+	location.Longitude, _ = data["longitude"].(float64)
+	location.Accuracy = optionalNumber(data, "accuracy")
+	location.Altitude = optionalNumber(data, "altitude")
+	location.Heading = optionalNumber(data, "heading")
+	location.Speed = optionalNumber(data, "speed")
+	if timestamp := optionalNumber(data, "timestamp"); timestamp != nil {
+		ms := int64(*timestamp)
+		location.Timestamp = &ms
 	}
-	locationJSON, _ := json.Marshal(locationData)
-	config.Rdb.Publish(config.Ctx, services.UserLocationChannel, string(locationJSON))
 
-	io.Emit("user_updated", locationData)
+	locationData, err := services.ProcessLocation(ctx, location)
+	var rejection *services.LocationRejection
+	switch {
+	case errors.As(err, &rejection):
+		logger.Info("Location update not applied", "user_id", location.ID, "reason", rejection.Reason, "held", rejection.Held)
+		socket.Emit("location_ack", map[string]interface{}{
+			"status": "rejected",
+			"reason": rejection.Reason,
+			"held":   rejection.Held,
+		})
+		return
+	case errors.Is(err, services.ErrInvalidLocation):
+		socket.Emit("location_ack", map[string]interface{}{
+			"status": "rejected",
+			"reason": "invalid",
+		})
+		return
+	case err != nil:
+		logger.Warn("Location update failed", "user_id", location.ID, "error", err)
+		return
+	}
 
-	socket.Emit("location_ack", map[string]interface{}{
+	ack := map[string]interface{}{
 		"status": "ok",
-	})
+	}
+	if flag, ok := locationData["flag"]; ok {
+		ack["flag"] = flag
+	}
+	socket.Emit("location_ack", ack)
+}
+
+// optionalNumber returns a numeric field of an event payload, or nil when it
+// is missing or null
+func optionalNumber(data map[string]interface{}, key string) *float64 {
+	if value, ok := data[key].(float64); ok {
+		return &value
+	}
+	return nil
 }
 
 // HandleChatBroadcast handles broadcast chat messages
 func HandleChatBroadcast(socket *socketio.Socket, event *socketio.EventPayload) {
-	log.Printf("💬 Chat broadcast event received, data length: %d", len(event.Data))
+	ctx, logger, span := newEventContext(socket.Id, "chat_broadcast")
+	defer span.End()
+	logger.Debug("Chat broadcast event received", "data_length", len(event.Data))
 	var data map[string]interface{}
 
 	if len(event.Data) > 0 {
 		var ok bool
 		data, ok = event.Data[0].(map[string]interface{})
 		if !ok {
-			log.Printf("❌ Invalid chat broadcast data format, received type: %T", event.Data[0])
+			logger.Warn("Invalid chat broadcast data format")
 			return
 		}
 	}
@@ -100,7 +208,7 @@ func HandleChatBroadcast(socket *socketio.Socket, event *socketio.EventPayload)
 	message, _ := data["message"].(string)
 	timestamp, _ := data["timestamp"].(string)
 
-	log.Printf("Chat broadcast from %s (%s): %s", fromName, fromUser, message)
+	logger.Info("Chat broadcast", "from", fromUser, "from_name", fromName, "message", message)
 
 	chatData := map[string]interface{}{
 		"type":      "broadcast",
@@ -109,20 +217,21 @@ func HandleChatBroadcast(socket *socketio.Socket, event *socketio.EventPayload)
 		"message":   message,
 		"timestamp": timestamp,
 	}
-	chatJSON, _ := json.Marshal(chatData)
-	config.Rdb.Publish(config.Ctx, services.ChatBroadcastChannel, string(chatJSON))
+	services.PublishEvent(ctx, services.ChatBroadcastChannel, chatData)
 }
 
 // HandleChatPrivate handles private chat messages
 func HandleChatPrivate(socket *socketio.Socket, event *socketio.EventPayload, userSIDMap map[string]*socketio.Socket, userSIDLock *sync.RWMutex) {
-	log.Printf("💬 Chat private event received, data length: %d", len(event.Data))
+	ctx, logger, span := newEventContext(socket.Id, "chat_private")
+	defer span.End()
+	logger.Debug("Chat private event received", "data_length", len(event.Data))
 	var data map[string]interface{}
 
 	if len(event.Data) > 0 {
 		var ok bool
 		data, ok = event.Data[0].(map[string]interface{})
 		if !ok {
-			log.Printf("❌ Invalid chat private data format, received type: %T", event.Data[0])
+			logger.Warn("Invalid chat private data format")
 			return
 		}
 	}
@@ -133,11 +242,13 @@ func HandleChatPrivate(socket *socketio.Socket, event *socketio.EventPayload, us
 	message, _ := data["message"].(string)
 	timestamp, _ := data["timestamp"].(string)
 
-	log.Printf("Chat private from %s (%s) to %s: %s", fromName, fromUser, toUser, message)
+	logger.Info("Chat private", "from", fromUser, "from_name", fromName, "to", toUser, "message", message)
 
 	if toUser == "HIGMA" {
-		go services.SendMessageToHIGMA(socket, fromUser, message, timestamp)
-		log.Printf("Message sent to HIGMA API from %s", fromUser)
+		services.RunBackground(func() {
+			services.SendMessageToHIGMA(ctx, socket, fromUser, message, timestamp)
+		})
+		logger.Info("Message sent to HIGMA API", "from", fromUser)
 		return
 	}
 
@@ -154,7 +265,7 @@ func HandleChatPrivate(socket *socketio.Socket, event *socketio.EventPayload, us
 			"message":   message,
 			"timestamp": timestamp,
 		})
-		log.Printf("Private message delivered to %s (local)", toUser)
+		logger.Info("Private message delivered locally", "to", toUser)
 	} else {
 		chatData := map[string]interface{}{
 			"type":      "private",
@@ -164,33 +275,148 @@ func HandleChatPrivate(socket *socketio.Socket, event *socketio.EventPayload, us
 			"message":   message,
 			"timestamp": timestamp,
 		}
-		chatJSON, _ := json.Marshal(chatData)
-		config.Rdb.Publish(config.Ctx, services.ChatPrivateChannel, string(chatJSON))
-		log.Printf("Private message published to Redis for %s (may be on another instance)", toUser)
+		services.PublishEvent(ctx, services.ChatPrivateChannel, chatData)
+		logger.Info("Private message published to Redis (may be on another instance)", "to", toUser)
 	}
 }
 
 // HandleDisconnect handles client disconnection
 func HandleDisconnect(socketID string, io *socketio.Io, userSIDMap map[string]*socketio.Socket, userSIDLock *sync.RWMutex) {
+	ctx, logger, span := newEventContext(socketID, "disconnect")
+	defer span.End()
+
+	services.UnsubscribeAircraft(socketID)
+	endSocketSession(ctx, socketID)
+
 	userSIDLock.Lock()
 	for userID, socket := range userSIDMap {
 		if socket.Id == socketID {
 			delete(userSIDMap, userID)
-			log.Printf("Removed user %s from map", userID)
+			metrics.RegisteredUsers.Set(float64(len(userSIDMap)))
+			logger.Debug("Removed user from map", "user_id", userID)
+
+			// While draining, the user has been handed off to other instances
+			if services.ShuttingDown() {
+				break
+			}
 
 			// Delete user data from Redis
-			if err := services.DeleteUserFromRedis(userID); err != nil {
-				log.Printf("⚠️ Error deleting user %s from Redis: %v", userID, err)
+			if err := services.DeleteUserFromRedis(ctx, userID); err != nil {
+				logger.Warn("Error deleting user from Redis", "user_id", userID, "error", err)
 			} else {
-				log.Printf("✅ Deleted user %s from Redis (user_info and user_locations)", userID)
+				logger.Info("Deleted user from Redis (user_info and user_locations)", "user_id", userID)
 			}
 
 			// Notify all clients that the user has been deleted
 			io.Emit("user_deleted", map[string]string{"id": userID})
-			log.Printf("📤 Emitted user_deleted event for user %s", userID)
+			logger.Debug("Emitted user_deleted event", "user_id", userID)
 
 			break
 		}
 	}
 	userSIDLock.Unlock()
 }
+
+// HandleNearestAirports answers a nearest_airports event ({"lat", "lon",
+// "n", "types"}) with a nearest_airports event to the sender
+func HandleNearestAirports(socket *socketio.Socket, event *socketio.EventPayload) {
+	ctx, logger, span := newEventContext(socket.Id, "nearest_airports")
+	defer span.End()
+	var data map[string]interface{}
+
+	if len(event.Data) > 0 {
+		var ok bool
+		data, ok = event.Data[0].(map[string]interface{})
+		if !ok {
+			logger.Warn("Invalid nearest_airports data format")
+			return
+		}
+	}
+
+	lat, latOK := data["lat"].(float64)
+	lon, lonOK := data["lon"].(float64)
+	n, _ := data["n"].(float64)
+	var types []string
+	if values, ok := data["types"].([]interface{}); ok {
+		for _, value := range values {
+			if airportType, ok := value.(string); ok {
+				types = append(types, airportType)
+			}
+		}
+	}
+	if !latOK || !lonOK {
+		socket.Emit("nearest_airports", map[string]interface{}{
+			"status": "error",
+			"error":  "lat and lon are required numbers",
+		})
+		return
+	}
+
+	page, err := services.NearestAirports(ctx, lat, lon, int(n), types)
+	if err != nil {
+		logger.Warn("Nearest airports failed", "error", err)
+		socket.Emit("nearest_airports", map[string]interface{}{
+			"status": "error",
+			"error":  err.Error(),
+			"lat":    lat,
+			"lon":    lon,
+		})
+		return
+	}
+
+	socket.Emit("nearest_airports", map[string]interface{}{
+		"status":   "ok",
+		"lat":      lat,
+		"lon":      lon,
+		"source":   page.Source,
+		"airports": page.Airports,
+	})
+}
+
+// HandleAircraftSubscribe sets the sender's aircraft viewport ({"south",
+// "west", "north", "east"}) and answers with the aircraft inside it as an
+// aircraft_updated event. Updates and removals in the viewport follow.
+func HandleAircraftSubscribe(socket *socketio.Socket, event *socketio.EventPayload) {
+	ctx, logger, span := newEventContext(socket.Id, "aircraft_subscribe")
+	defer span.End()
+
+	if len(event.Data) == 0 {
+		logger.Warn("No aircraft_subscribe data received")
+		return
+	}
+	data, ok := event.Data[0].(map[string]interface{})
+	if !ok {
+		logger.Warn("Invalid aircraft_subscribe data format")
+		return
+	}
+
+	var viewport models.Viewport
+	var valid bool
+	if viewport.South, valid = data["south"].(float64); valid {
+		if viewport.West, valid = data["west"].(float64); valid {
+			if viewport.North, valid = data["north"].(float64); valid {
+				viewport.East, valid = data["east"].(float64)
+			}
+		}
+	}
+	if !valid {
+		socket.Emit("aircraft_error", map[string]interface{}{
+			"error": "south, west, north and east are required numbers",
+		})
+		return
+	}
+
+	aircraft, err := services.SubscribeAircraft(ctx, socket, viewport)
+	if err != nil {
+		logger.Warn("Aircraft subscribe failed", "error", err)
+		socket.Emit("aircraft_error", map[string]interface{}{"error": err.Error()})
+		return
+	}
+	socket.Emit("aircraft_updated", map[string]interface{}{"aircraft": aircraft})
+	logger.Debug("Aircraft viewport set", "viewport", viewport, "aircraft", len(aircraft))
+}
+
+// HandleAircraftUnsubscribe stops aircraft updates to the sender
+func HandleAircraftUnsubscribe(socket *socketio.Socket) {
+	services.UnsubscribeAircraft(socket.Id)
+}
@@ -3,13 +3,15 @@ package handlers
 import (
 	"bytes"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
-	"log"
 	"net/http"
 	"time"
 
 	"github.com/gin-gonic/gin"
+	"github.com/tthogho1/redisconnect/go/logging"
+	"github.com/tthogho1/redisconnect/go/services"
 )
 
 const (
@@ -26,7 +28,8 @@ type SummarizeRequest struct {
 // Summarize forwards a JSON array to the HuggingFace summarize endpoint
 func Summarize(c *gin.Context) {
 	start := time.Now()
-	log.Printf("📥 [/summarize] Request received from %s", c.ClientIP())
+	logger := logging.FromContext(c.Request.Context())
+	logger.Info("[/summarize] Request received", "client_ip", c.ClientIP())
 
 	// Parse the JSON array from the request body
 	var requests []SummarizeRequest
@@ -49,7 +52,7 @@ func Summarize(c *gin.Context) {
 
 	// Log request details
 	for i, r := range requests {
-		log.Printf("📝 [/summarize] Item[%d]: url=%s, target_tokens=%d", i, r.URL, r.TargetTokens)
+		logger.Debug("[/summarize] Item", "index", i, "url", r.URL, "target_tokens", r.TargetTokens)
 	}
 
 	// Marshal the request to forward upstream
@@ -69,11 +72,15 @@ func Summarize(c *gin.Context) {
 	req.Header.Set("Content-Type", "application/json")
 
 	// Execute the upstream request
-	log.Printf("🔄 [/summarize] Forwarding %d items to upstream", len(requests))
-	resp, err := httpClient.Do(req)
+	logger.Info("[/summarize] Forwarding items to upstream", "items", len(requests))
+	resp, err := services.DoUpstream(services.UpstreamSummarize, httpClient, req)
 	if err != nil {
 		elapsed := time.Since(start)
-		log.Printf("❌ [/summarize] Upstream request failed after %s: %s", elapsed, err.Error())
+		logger.Error("[/summarize] Upstream request failed", "elapsed", elapsed, "error", err)
+		if errors.Is(err, services.ErrCircuitOpen) {
+			c.JSON(http.StatusServiceUnavailable, gin.H{"error": "upstream temporarily unavailable: " + err.Error()})
+			return
+		}
 		c.JSON(http.StatusBadGateway, gin.H{"error": "upstream request failed: " + err.Error()})
 		return
 	}
@@ -90,12 +97,12 @@ func Summarize(c *gin.Context) {
 
 	// If upstream returned an error status, forward it
 	if resp.StatusCode != http.StatusOK {
-		log.Printf("⚠️ [/summarize] Upstream returned status %d after %s", resp.StatusCode, elapsed)
+		logger.Warn("[/summarize] Upstream returned error status", "status", resp.StatusCode, "elapsed", elapsed)
 		c.Data(resp.StatusCode, "application/json", respBody)
 		return
 	}
 
 	// Return the upstream JSON array response as-is
-	log.Printf("✅ [/summarize] Response completed: %d items, status=%d, elapsed=%s", len(requests), resp.StatusCode, elapsed)
+	logger.Info("[/summarize] Response completed", "items", len(requests), "status", resp.StatusCode, "elapsed", elapsed)
 	c.Data(http.StatusOK, "application/json", respBody)
 }
@@ -0,0 +1,112 @@
+package logging
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"log/slog"
+	"os"
+	"strings"
+
+	"go.opentelemetry.io/otel/trace"
+)
+
+// CorrelationHeader is the HTTP header carrying the correlation ID
+const CorrelationHeader = "X-Request-ID"
+
+// MetaKey is the field added to Pub/Sub payloads for cross-instance metadata
+const MetaKey = "_meta"
+
+// RedactedValue replaces sensitive attribute values when not logging at DEBUG
+const RedactedValue = "[redacted]"
+
+// sensitiveKeys are attribute keys whose values are only logged at DEBUG
+var sensitiveKeys = map[string]bool{
+	"message":   true,
+	"text":      true,
+	"reply":     true,
+	"latitude":  true,
+	"longitude": true,
+	"lat":       true,
+	"lon":       true,
+	"bounds":    true,
+}
+
+type correlationKey struct{}
+
+// Init configures the default slog logger.
+// LOG_LEVEL is one of debug, info, warn, error (default info) and
+// LOG_FORMAT is json or text (default json).
+func Init() {
+	level := parseLevel(os.Getenv("LOG_LEVEL"))
+	redact := level > slog.LevelDebug
+
+	opts := &slog.HandlerOptions{
+		Level: level,
+		ReplaceAttr: func(groups []string, a slog.Attr) slog.Attr {
+			if redact && sensitiveKeys[a.Key] {
+				return slog.String(a.Key, RedactedValue)
+			}
+			return a
+		},
+	}
+
+	var handler slog.Handler
+	if strings.EqualFold(os.Getenv("LOG_FORMAT"), "text") {
+		handler = slog.NewTextHandler(os.Stdout, opts)
+	} else {
+		handler = slog.NewJSONHandler(os.Stdout, opts)
+	}
+	slog.SetDefault(slog.New(handler))
+}
+
+func parseLevel(value string) slog.Level {
+	switch strings.ToLower(value) {
+	case "debug":
+		return slog.LevelDebug
+	case "warn", "warning":
+		return slog.LevelWarn
+	case "error":
+		return slog.LevelError
+	default:
+		return slog.LevelInfo
+	}
+}
+
+// NewCorrelationID returns a random 16-byte hex identifier
+func NewCorrelationID() string {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "unknown"
+	}
+	return hex.EncodeToString(b)
+}
+
+// WithCorrelationID returns a context carrying the correlation ID
+func WithCorrelationID(ctx context.Context, id string) context.Context {
+	return context.WithValue(ctx, correlationKey{}, id)
+}
+
+// CorrelationID returns the correlation ID stored in ctx, or ""
+func CorrelationID(ctx context.Context) string {
+	id, _ := ctx.Value(correlationKey{}).(string)
+	return id
+}
+
+// NewContext returns a background context with a fresh correlation ID
+func NewContext() context.Context {
+	return WithCorrelationID(context.Background(), NewCorrelationID())
+}
+
+// FromContext returns the default logger annotated with the context's
+// correlation ID and, when ctx carries a valid span, its trace and span IDs.
+func FromContext(ctx context.Context) *slog.Logger {
+	logger := slog.Default()
+	if id := CorrelationID(ctx); id != "" {
+		logger = logger.With("correlation_id", id)
+	}
+	if sc := trace.SpanContextFromContext(ctx); sc.IsValid() {
+		logger = logger.With("trace_id", sc.TraceID().String(), "span_id", sc.SpanID().String())
+	}
+	return logger
+}
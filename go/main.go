@@ -1,17 +1,25 @@
 package main
 
 import (
-	"log"
+	"context"
+	"log/slog"
 	"net/http"
 	"os"
+	"os/signal"
 	"strings"
 	"sync"
+	"syscall"
 
 	socketio "github.com/doquangtan/socketio/v4"
 	"github.com/gin-gonic/gin"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
 	"github.com/tthogho1/redisconnect/go/config"
 	"github.com/tthogho1/redisconnect/go/handlers"
+	"github.com/tthogho1/redisconnect/go/logging"
+	"github.com/tthogho1/redisconnect/go/metrics"
 	"github.com/tthogho1/redisconnect/go/services"
+	"github.com/tthogho1/redisconnect/go/tracing"
+	"go.opentelemetry.io/contrib/instrumentation/github.com/gin-gonic/gin/otelgin"
 )
 
 var (
@@ -24,6 +32,16 @@ func main() {
 	// Initialize environment
 	config.InitEnv()
 
+	// Initialize structured logging (LOG_LEVEL, LOG_FORMAT)
+	logging.Init()
+
+	// Initialize OpenTelemetry tracing (OTEL_TRACES_EXPORTER)
+	shutdownTracing, err := tracing.Init(config.Ctx)
+	if err != nil {
+		slog.Error("Could not initialize tracing", "error", err)
+		os.Exit(1)
+	}
+
 	// Initialize Redis
 	config.InitRedis()
 
@@ -36,40 +54,94 @@ func main() {
 	})
 
 	// Initialize Redis Pub/Sub for clustering
-	go services.InitializeRedisSubscriptions(io, userSIDMap, &userSIDLock)
+	// Background goroutines stop when backgroundCtx is cancelled during shutdown
+	backgroundCtx, stopBackground := context.WithCancel(config.Ctx)
+
+	go services.InitializeRedisSubscriptions(backgroundCtx, io, userSIDMap, &userSIDLock)
+
+	// Load the offline OurAirports dataset (AIRPORTS_CSV), reloading on change
+	services.InitAirportData(backgroundCtx)
+
+	// Start the optional device and aircraft feeds
+	services.StartADSBIngestion(backgroundCtx)
+	services.StartOwnTracksIngestion(backgroundCtx)
+	services.StartNMEAListener(backgroundCtx)
 
 	// Socket.IO connection handler
 	io.OnConnection(func(socket *socketio.Socket) {
-		log.Printf("✅ Client connected: %s", socket.Id)
+		slog.Info("Client connected", "socket_id", socket.Id)
+		metrics.ConnectedSockets.Inc()
 
 		// Send all existing users to newly connected client
-		allUsers := services.GetAllUsersFromRedis()
-		socket.Emit("all_users", allUsers)
-		log.Printf("📤 Sent %d users to client %s", len(allUsers), socket.Id)
+		// The socket is anonymous until it registers
+		allUsers, err := services.VisibleUsers(config.Ctx, "")
+		if err != nil {
+			slog.Warn("Could not load users for client", "socket_id", socket.Id, "error", err)
+		} else {
+			socket.Emit("all_users", allUsers)
+			slog.Debug("Sent users to client", "socket_id", socket.Id, "users", len(allUsers))
+		}
 
 		// Register event
 		socket.On("register", func(event *socketio.EventPayload) {
+			metrics.SocketEvent("register")
 			handlers.HandleRegister(socket, event, userSIDMap, &userSIDLock)
 		})
 
 		// Location event
 		socket.On("location", func(event *socketio.EventPayload) {
-			handlers.HandleLocation(socket, event, io)
+			metrics.SocketEvent("location")
+			if !handlers.AllowSocketEvent(socket, "location") {
+				return
+			}
+			handlers.HandleLocation(socket, event)
 		})
 
 		// Chat broadcast event
 		socket.On("chat_broadcast", func(event *socketio.EventPayload) {
+			metrics.SocketEvent("chat_broadcast")
+			if !handlers.AllowSocketEvent(socket, "chat_broadcast") {
+				return
+			}
 			handlers.HandleChatBroadcast(socket, event)
 		})
 
 		// Chat private event
 		socket.On("chat_private", func(event *socketio.EventPayload) {
+			metrics.SocketEvent("chat_private")
+			if !handlers.AllowSocketEvent(socket, "chat_private") {
+				return
+			}
 			handlers.HandleChatPrivate(socket, event, userSIDMap, &userSIDLock)
 		})
 
+		// Nearest airports lookup, answered to the sender
+		socket.On("nearest_airports", func(event *socketio.EventPayload) {
+			metrics.SocketEvent("nearest_airports")
+			if !handlers.AllowSocketEvent(socket, "nearest_airports") {
+				return
+			}
+			handlers.HandleNearestAirports(socket, event)
+		})
+
+		socket.On("aircraft_subscribe", func(event *socketio.EventPayload) {
+			metrics.SocketEvent("aircraft_subscribe")
+			if !handlers.AllowSocketEvent(socket, "aircraft_subscribe") {
+				return
+			}
+			handlers.HandleAircraftSubscribe(socket, event)
+		})
+
+		socket.On("aircraft_unsubscribe", func(event *socketio.EventPayload) {
+			metrics.SocketEvent("aircraft_unsubscribe")
+			handlers.HandleAircraftUnsubscribe(socket)
+		})
+
 		// Disconnect event
 		socket.On("disconnect", func(event *socketio.EventPayload) {
-			log.Printf("Client disconnected: %s", socket.Id)
+			slog.Info("Client disconnected", "socket_id", socket.Id)
+			metrics.SocketEvent("disconnect")
+			metrics.ConnectedSockets.Dec()
 			handlers.HandleDisconnect(socket.Id, io, userSIDMap, &userSIDLock)
 		})
 	})
@@ -80,41 +152,36 @@ func main() {
 	// Register initial HIGMA user
 	services.RegisterInitialUser(io)
 
+	// Close trips of users whose fixes stopped arriving
+	go services.RunTripSweeper(backgroundCtx)
+
 	// Start expired user cleanup goroutine
-	go services.CleanupExpiredUsers(func(userID string) {
+	go services.CleanupExpiredUsers(backgroundCtx, func(userID string) {
 		io.Emit("user_deleted", map[string]string{"id": userID})
 	}, make(map[string]interface{}), &userSIDLock)
 
 	// Setup Gin router
-	router := gin.Default()
+	router := gin.New()
+	// Forwarding headers are only believed from TRUSTED_PROXIES, since any
+	// client can send them and would get a fresh rate limit bucket each time
+	if err := router.SetTrustedProxies(handlers.TrustedProxies()); err != nil {
+		slog.Error("Invalid TRUSTED_PROXIES", "error", err)
+		os.Exit(1)
+	}
+	router.Use(gin.Recovery())
+	router.Use(otelgin.Middleware(tracing.ServiceName))
+	router.Use(handlers.RequestLogger())
+
+	// Origin policy shared by Gin routes and the Socket.IO handshake
+	originPolicy := config.LoadOriginPolicy()
+	router.Use(handlers.CORS(originPolicy))
 
 	// Serve static folder
 	router.Static("/static", "./static/static")
 	router.Static("/map", "./static")
 
-	// CORS middleware
-	router.Use(func(c *gin.Context) {
-		c.Writer.Header().Set("Access-Control-Allow-Origin", "*")
-		c.Writer.Header().Set("Access-Control-Allow-Methods", "GET, POST, DELETE, OPTIONS")
-		c.Writer.Header().Set("Access-Control-Allow-Headers", "Content-Type, Authorization, X-Requested-With, Origin")
-		c.Writer.Header().Set("Access-Control-Allow-Credentials", "true")
-		if c.Request.Method == "OPTIONS" {
-			c.AbortWithStatus(204)
-			return
-		}
-		c.Next()
-	})
-	router.Use(func(c *gin.Context) {
-		c.Writer.Header().Set("Access-Control-Allow-Origin", "*")
-		c.Writer.Header().Set("Access-Control-Allow-Methods", "GET, POST, DELETE, OPTIONS")
-		c.Writer.Header().Set("Access-Control-Allow-Headers", "Content-Type, Authorization, X-Requested-With, Origin")
-		c.Writer.Header().Set("Access-Control-Allow-Credentials", "true")
-		if c.Request.Method == "OPTIONS" {
-			c.AbortWithStatus(204)
-			return
-		}
-		c.Next()
-	})
+	// Redis-backed rate limiting (RATE_LIMITS)
+	router.Use(handlers.RateLimit())
 
 	//router.Any("/socket.io/*any", gin.WrapH(io.HttpHandler()))
 	// Serve static folder (after socket route)
@@ -126,17 +193,29 @@ func main() {
 		c.JSON(200, gin.H{"status": "ok"})
 	})
 
+	// Kubernetes probes: liveness of the process and readiness of its dependencies
+	router.GET("/livez", handlers.Livez)
+	router.GET("/readyz", handlers.Readyz)
+
+	// Prometheus metrics
+	router.GET("/metrics", gin.WrapH(promhttp.Handler()))
+
 	// REST API endpoints
 	router.GET("/users", handlers.GetAllUsers)
 	router.POST("/users", func(c *gin.Context) {
-		handlers.CreateUser(c, io)
-	})
-	router.PUT("/users/:user_id", func(c *gin.Context) {
-		handlers.UpdateUser(c, io)
+		handlers.CreateUser(c, io, userSIDMap, &userSIDLock)
 	})
+	router.PUT("/users/:user_id", handlers.UpdateUser)
 	router.DELETE("/users/:user_id", func(c *gin.Context) {
 		handlers.DeleteUser(c, io)
 	})
+	router.GET("/users/:user_id/trips", handlers.GetUserTrips)
+
+	// Location privacy: visibility, fuzzing, ghost mode and contacts
+	router.GET("/users/:user_id/privacy", handlers.GetPrivacy)
+	router.PUT("/users/:user_id/privacy", handlers.UpdatePrivacy)
+	router.GET("/users/:user_id/contacts", handlers.GetContacts)
+	router.PUT("/users/:user_id/contacts", handlers.UpdateContacts)
 
 	// Fetch landmarks in bounds (Wikimedia)
 	router.POST("/fetchlandmarks", handlers.FetchLandmarks)
@@ -147,9 +226,17 @@ func main() {
 	// Fetch details for a single landmark by pageId (Wikimedia)
 	router.POST("/fetchlandmarkdetails", handlers.FetchLandmarkDetails)
 
-	// Fetch airports within a bounding box (Hasura GraphQL)
+	// Fetch airports within a bounding box (Hasura GraphQL, or the OurAirports dataset)
 	router.POST("/fetchairportsinbounds", handlers.FetchAirportsInBounds)
 
+	// Nearest airports to a point, and lookup by IATA/ICAO code
+	router.GET("/airports/nearest", handlers.NearestAirports)
+	router.GET("/airports/:code", handlers.AirportByCode)
+
+	// OsmAnd/Traccar tracking protocol for GPS devices
+	router.GET("/osmand", handlers.OsmAnd)
+	router.POST("/osmand", handlers.OsmAnd)
+
 	// Summarize endpoint (proxy to HuggingFace)
 	router.POST("/summarize", handlers.Summarize)
 
@@ -160,23 +247,47 @@ func main() {
 		port = "5000"
 	}
 
-	log.Printf("\n==== Go WebSocket Server starting on port %s ====", port)
-	log.Printf("WebSocket endpoint: ws://0.0.0.0:%s/socket.io/", port)
-	log.Printf("HTTP endpoints: GET/POST /users, DELETE /users/<id>")
-	log.Printf("Redis host: %s, port: %s", os.Getenv("REDIS_HOST"), os.Getenv("REDIS_PORT"))
+	slog.Info("Go WebSocket Server starting",
+		"port", port,
+		"websocket_endpoint", "ws://0.0.0.0:"+port+"/socket.io/",
+		"redis_host", os.Getenv("REDIS_HOST"),
+		"redis_port", os.Getenv("REDIS_PORT"))
 
 	combinedHandler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		// ✅ 修正: 末尾スラッシュ有無両対応
+		// Match the Socket.IO path with or without a trailing slash
 		if strings.HasPrefix(r.URL.Path, "/socket.io") {
-			log.Printf("🔍 Socket.IO match: %s", r.URL.Path) // デバッグ用
+			slog.Debug("Socket.IO request", "path", r.URL.Path)
+			if origin := r.Header.Get("Origin"); origin != "" && !originPolicy.Allowed(origin, r.Host) {
+				slog.Warn("Rejected Socket.IO handshake from disallowed origin", "origin", origin)
+				http.Error(w, "origin not allowed", http.StatusForbidden)
+				return
+			}
+			if !handlers.AllowSocketHandshake(w, r) {
+				return
+			}
 			io.HttpHandler().ServeHTTP(w, r)
 			return
 		}
 		router.ServeHTTP(w, r)
 	})
 
-	if err := http.ListenAndServe("0.0.0.0:"+port, combinedHandler); err != nil {
-		log.Fatal(err)
+	server := &http.Server{Addr: "0.0.0.0:" + port, Handler: combinedHandler}
+
+	signalCtx, stopSignals := signal.NotifyContext(context.Background(), syscall.SIGTERM, os.Interrupt)
+	defer stopSignals()
+
+	serverErr := make(chan error, 1)
+	go func() {
+		serverErr <- server.ListenAndServe()
+	}()
+
+	select {
+	case err := <-serverErr:
+		slog.Error("Server stopped", "error", err)
+		shutdownTracing(config.Ctx)
+		os.Exit(1)
+	case <-signalCtx.Done():
+		gracefulShutdown(server, stopBackground, shutdownTracing)
 	}
 
 }
@@ -0,0 +1,189 @@
+package metrics
+
+import (
+	"context"
+	"strings"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// Label values are restricted to fixed sets so series cardinality stays bounded.
+
+// ConnectedSockets is the number of Socket.IO connections on this instance
+var ConnectedSockets = promauto.NewGauge(prometheus.GaugeOpts{
+	Name: "redisconnect_connected_sockets",
+	Help: "Number of Socket.IO connections on this instance.",
+})
+
+// RegisteredUsers is the number of users registered to a local socket
+var RegisteredUsers = promauto.NewGauge(prometheus.GaugeOpts{
+	Name: "redisconnect_registered_users",
+	Help: "Number of users registered to a socket on this instance.",
+})
+
+// socketEvents counts Socket.IO events received, by event name
+var socketEvents = promauto.NewCounterVec(prometheus.CounterOpts{
+	Name: "redisconnect_socket_events_total",
+	Help: "Socket.IO events received, by event.",
+}, []string{"event"})
+
+// pubSubMessages counts Redis Pub/Sub messages, by channel and direction
+var pubSubMessages = promauto.NewCounterVec(prometheus.CounterOpts{
+	Name: "redisconnect_pubsub_messages_total",
+	Help: "Redis Pub/Sub messages published (out) and received (in), by channel.",
+}, []string{"channel", "direction"})
+
+// redisCommandDuration observes Redis command latency, by command
+var redisCommandDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+	Name:    "redisconnect_redis_command_duration_seconds",
+	Help:    "Redis command latency, by command.",
+	Buckets: []float64{0.0005, 0.001, 0.0025, 0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1},
+}, []string{"command", "result"})
+
+// upstreamRequestDuration observes upstream HTTP latency, by upstream and status class
+var upstreamRequestDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+	Name:    "redisconnect_upstream_request_duration_seconds",
+	Help:    "Upstream HTTP request latency, by upstream and status class.",
+	Buckets: []float64{0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30, 60, 120},
+}, []string{"upstream", "status"})
+
+// rateLimited counts requests rejected by the rate limiter, by policy name
+var rateLimited = promauto.NewCounterVec(prometheus.CounterOpts{
+	Name: "redisconnect_rate_limited_total",
+	Help: "Requests and events rejected by the rate limiter, by policy.",
+}, []string{"policy"})
+
+// locationUpdates counts location updates through the filter stage, by
+// result and reason
+var locationUpdates = promauto.NewCounterVec(prometheus.CounterOpts{
+	Name: "redisconnect_location_updates_total",
+	Help: "Location updates accepted, flagged, held or rejected, by reason.",
+}, []string{"result", "reason"})
+
+var knownEvents = map[string]bool{
+	"register":             true,
+	"location":             true,
+	"chat_broadcast":       true,
+	"chat_private":         true,
+	"disconnect":           true,
+	"nearest_airports":     true,
+	"aircraft_subscribe":   true,
+	"aircraft_unsubscribe": true,
+}
+
+// knownChannels is filled by RegisterChannels to avoid an import cycle with services
+var knownChannels = map[string]bool{}
+
+// RegisterChannels declares the Pub/Sub channels that may appear as label values
+func RegisterChannels(channels ...string) {
+	for _, channel := range channels {
+		knownChannels[channel] = true
+	}
+}
+
+// SocketEvent counts a received Socket.IO event
+func SocketEvent(event string) {
+	if !knownEvents[event] {
+		event = "other"
+	}
+	socketEvents.WithLabelValues(event).Inc()
+}
+
+// RateLimited counts a rejected request. Policy names come from configuration,
+// so they are bounded.
+func RateLimited(policy string) {
+	rateLimited.WithLabelValues(policy).Inc()
+}
+
+// LocationUpdate counts a location update's filter result. Reasons are a
+// fixed set, empty for accepted updates.
+func LocationUpdate(result, reason string) {
+	locationUpdates.WithLabelValues(result, reason).Inc()
+}
+
+// PubSubPublished counts a message published to a channel
+func PubSubPublished(channel string) {
+	pubSubMessages.WithLabelValues(channelLabel(channel), "out").Inc()
+}
+
+// PubSubReceived counts a message received from a channel
+func PubSubReceived(channel string) {
+	pubSubMessages.WithLabelValues(channelLabel(channel), "in").Inc()
+}
+
+func channelLabel(channel string) string {
+	if knownChannels[channel] {
+		return channel
+	}
+	return "other"
+}
+
+// ObserveUpstream records the latency of an upstream call. statusCode is 0
+// when the request failed before a response was received.
+func ObserveUpstream(upstream string, statusCode int, err error, elapsed time.Duration) {
+	upstreamRequestDuration.WithLabelValues(upstream, statusClass(statusCode, err)).Observe(elapsed.Seconds())
+}
+
+func statusClass(statusCode int, err error) string {
+	switch {
+	case err != nil || statusCode == 0:
+		return "error"
+	case statusCode < 300:
+		return "2xx"
+	case statusCode < 400:
+		return "3xx"
+	case statusCode < 500:
+		return "4xx"
+	default:
+		return "5xx"
+	}
+}
+
+type redisStartKey struct{}
+
+// RedisHook is a go-redis hook that records command latency
+type RedisHook struct{}
+
+// BeforeProcess stores the command start time in the context
+func (RedisHook) BeforeProcess(ctx context.Context, cmd redis.Cmder) (context.Context, error) {
+	return context.WithValue(ctx, redisStartKey{}, time.Now()), nil
+}
+
+// AfterProcess observes the command latency
+func (RedisHook) AfterProcess(ctx context.Context, cmd redis.Cmder) error {
+	observeRedis(ctx, cmd.Name(), cmd.Err())
+	return nil
+}
+
+// BeforeProcessPipeline stores the pipeline start time in the context
+func (RedisHook) BeforeProcessPipeline(ctx context.Context, cmds []redis.Cmder) (context.Context, error) {
+	return context.WithValue(ctx, redisStartKey{}, time.Now()), nil
+}
+
+// AfterProcessPipeline observes the pipeline latency as a single "pipeline" command
+func (RedisHook) AfterProcessPipeline(ctx context.Context, cmds []redis.Cmder) error {
+	var err error
+	for _, cmd := range cmds {
+		if cmd.Err() != nil {
+			err = cmd.Err()
+			break
+		}
+	}
+	observeRedis(ctx, "pipeline", err)
+	return nil
+}
+
+func observeRedis(ctx context.Context, command string, err error) {
+	start, ok := ctx.Value(redisStartKey{}).(time.Time)
+	if !ok {
+		return
+	}
+	result := "ok"
+	if err != nil && err != redis.Nil {
+		result = "error"
+	}
+	redisCommandDuration.WithLabelValues(strings.ToLower(command), result).Observe(time.Since(start).Seconds())
+}
@@ -0,0 +1,28 @@
+package models
+
+import "time"
+
+// Aircraft is the latest known state of an aircraft from an ADS-B feed.
+// Fields a feed has not reported yet are omitted.
+type Aircraft struct {
+	ICAO            string    `json:"icao"` // 24-bit address, lower-case hex
+	Callsign        string    `json:"callsign,omitempty"`
+	Latitude        float64   `json:"latitude"`
+	Longitude       float64   `json:"longitude"`
+	AltitudeFt      *int      `json:"altitude_ft,omitempty"`
+	GroundSpeedKt   *float64  `json:"ground_speed_kt,omitempty"`
+	TrackDeg        *float64  `json:"track_deg,omitempty"`
+	VerticalRateFpm *int      `json:"vertical_rate_fpm,omitempty"`
+	Squawk          string    `json:"squawk,omitempty"`
+	OnGround        bool      `json:"on_ground"`
+	UpdatedAt       time.Time `json:"updated_at"`
+}
+
+// Viewport is a map area a client wants aircraft for. West > East crosses
+// the antimeridian.
+type Viewport struct {
+	South float64 `json:"south"`
+	West  float64 `json:"west"`
+	North float64 `json:"north"`
+	East  float64 `json:"east"`
+}
@@ -2,19 +2,63 @@ package models
 
 // Airport represents one airport result from the Hasura GraphQL endpoint.
 type Airport struct {
-	Name         string  `json:"name"`
-	Type         string  `json:"type"`
-	IataCode     *string `json:"iata_code,omitempty"`
-	IcaoCode     *string `json:"icao_code,omitempty"`
-	LatitudeDeg  float64 `json:"latitude_deg"`
-	LongitudeDeg float64 `json:"longitude_deg"`
-	HomeLink     *string `json:"home_link,omitempty"`
+	ID             int64    `json:"id"`
+	Name           string   `json:"name"`
+	Type           string   `json:"type"`
+	IataCode       *string  `json:"iata_code,omitempty"`
+	IcaoCode       *string  `json:"icao_code,omitempty"`
+	LatitudeDeg    float64  `json:"latitude_deg"`
+	LongitudeDeg   float64  `json:"longitude_deg"`
+	HomeLink       *string  `json:"home_link,omitempty"`
+	DistanceMeters *float64 `json:"distance_meters,omitempty"` // from the bounds center or search point, when ordered by distance
+	BearingDeg     *float64 `json:"bearing_deg,omitempty"`     // initial bearing from that point, clockwise from north
+
+	// Full record fields, set by code lookups (and by the local provider)
+	Ident            string  `json:"ident,omitempty"`
+	ElevationFt      *int    `json:"elevation_ft,omitempty"`
+	Municipality     string  `json:"municipality,omitempty"`
+	IsoCountry       string  `json:"iso_country,omitempty"`
+	IsoRegion        string  `json:"iso_region,omitempty"`
+	ScheduledService string  `json:"scheduled_service,omitempty"` // "yes" or "no"
+	WikipediaLink    *string `json:"wikipedia_link,omitempty"`
+
+	// Set by the local OurAirports provider when runways.csv and
+	// frequencies.csv are loaded
+	Runways     []Runway           `json:"runways,omitempty"`
+	Frequencies []AirportFrequency `json:"frequencies,omitempty"`
+}
+
+// Runway is one runway of an airport, from OurAirports runways.csv.
+type Runway struct {
+	LengthFt *int   `json:"length_ft,omitempty"`
+	WidthFt  *int   `json:"width_ft,omitempty"`
+	Surface  string `json:"surface,omitempty"`
+	Lighted  bool   `json:"lighted"`
+	Closed   bool   `json:"closed"`
+	LeIdent  string `json:"le_ident,omitempty"` // low-numbered end, e.g. "16L"
+	HeIdent  string `json:"he_ident,omitempty"` // high-numbered end, e.g. "34R"
+}
+
+// AirportFrequency is one radio frequency of an airport, from OurAirports
+// frequencies.csv.
+type AirportFrequency struct {
+	Type         string  `json:"type"` // e.g. "TWR", "ATIS"
+	Description  string  `json:"description,omitempty"`
+	FrequencyMHz float64 `json:"frequency_mhz"`
 }
 
 // AirportsQueryVariables holds the bounding-box parameters for FetchAirportsInBounds.
+// MinLon > MaxLon crosses the antimeridian.
 type AirportsQueryVariables struct {
 	MinLat float64 `json:"minLat"`
 	MaxLat float64 `json:"maxLat"`
 	MinLon float64 `json:"minLon"`
 	MaxLon float64 `json:"maxLon"`
+
+	Types         []string `json:"types,omitempty"`         // OurAirports types, default all but heliport and closed
+	ScheduledOnly bool     `json:"scheduledOnly,omitempty"` // only airports with scheduled airline service
+	HasIata       *bool    `json:"hasIata,omitempty"`       // true: only with an IATA code, false: only without
+	Limit         int      `json:"limit,omitempty"`         // default 500, max 2000
+	OrderBy       string   `json:"orderBy,omitempty"`       // "size" (default) or "distance" from the bounds center
+	Cursor        string   `json:"cursor,omitempty"`        // X-Next-Cursor of the previous page
 }
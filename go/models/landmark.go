@@ -1,15 +1,53 @@
 package models
 
-// Landmark represents one Wikipedia landmark result.
+import "time"
+
+// Landmark represents one landmark result. PageID is 0 for landmarks without
+// a Wikipedia page (e.g. from OpenStreetMap only).
 type Landmark struct {
-	PageID          int64   `json:"pageId"`
-	Title           string  `json:"title"`
-	Lat             float64 `json:"lat"`
-	Lon             float64 `json:"lon"`
-	ThumbnailURL    *string `json:"thumbnailUrl"`    // nil if not present
-	ThumbnailWidth  *int    `json:"thumbnailWidth"`  // nil if not present
-	ThumbnailHeight *int    `json:"thumbnailHeight"` // nil if not present
-	Description     *string `json:"description"`     // nil if not present
+	PageID          int64      `json:"pageId"`
+	Title           string     `json:"title"`
+	Lat             float64    `json:"lat"`
+	Lon             float64    `json:"lon"`
+	ThumbnailURL    *string    `json:"thumbnailUrl"`        // nil if not present
+	ThumbnailWidth  *int       `json:"thumbnailWidth"`      // nil if not present
+	ThumbnailHeight *int       `json:"thumbnailHeight"`     // nil if not present
+	Description     *string    `json:"description"`         // nil if not present
+	Lang            string     `json:"lang"`                // wiki language the result came from
+	LangLinks       []LangLink `json:"langLinks,omitempty"` // the same page on other-language wikis
+	Class           string     `json:"class"`               // normalized category for map icons, e.g. "temple"
+	Sources         []string   `json:"sources,omitempty"`   // providers that returned this landmark
+	OSMID           *string    `json:"osmId,omitempty"`     // e.g. "node/123"
+
+	// Optional details, present only when requested via LandmarkDetailsParams.Fields
+	Extract      *string         `json:"extract,omitempty"`      // plain-text intro
+	Images       []LandmarkImage `json:"images,omitempty"`       // images used on the page
+	Categories   []string        `json:"categories,omitempty"`   // visible categories, without namespace
+	URL          *string         `json:"url,omitempty"`          // canonical page URL
+	WikidataID   *string         `json:"wikidataId,omitempty"`   // e.g. "Q1234"
+	LastModified *time.Time      `json:"lastModified,omitempty"` // time of the latest revision
+}
+
+// LandmarkImage is one image shown on a landmark's page.
+type LandmarkImage struct {
+	Title      string           `json:"title"`
+	URL        string           `json:"url"` // original file
+	Width      int              `json:"width"`
+	Height     int              `json:"height"`
+	Thumbnails []ImageThumbnail `json:"thumbnails"` // one per requested size
+}
+
+// ImageThumbnail is a scaled copy of an image.
+type ImageThumbnail struct {
+	Width int    `json:"width"`
+	URL   string `json:"url"`
+}
+
+// LangLink points to the same landmark on another language wiki.
+type LangLink struct {
+	Lang  string `json:"lang"`
+	Title string `json:"title"`
+	URL   string `json:"url"`
 }
 
 // BoundingBox corresponds to { north, south, east, west }.
@@ -27,16 +65,39 @@ type LandmarkQueryParams struct {
 	BoundingBox *BoundingBox `json:"boundingBox,omitempty"` // optional
 	Radius      int          `json:"radius,omitempty"`      // meters, default 10000
 	Limit       int          `json:"limit,omitempty"`       // default 10, max 500
+	Lang        string       `json:"lang,omitempty"`        // wiki language, default WIKIPEDIA_DEFAULT_LANG
+	Cursor      string       `json:"cursor,omitempty"`      // X-Next-Cursor of the previous page
+	Providers   []string     `json:"providers,omitempty"`   // landmark sources, default LANDMARK_PROVIDERS
+	Categories  []string     `json:"categories,omitempty"`  // classes or wiki category names, any of
+	Keywords    []string     `json:"keywords,omitempty"`    // any of
+	Exclude     []string     `json:"exclude,omitempty"`     // classes, wiki categories or words to leave out
+}
+
+// LandmarkDetailsParams is the input to FetchLandmarkDetails. Either PageID or
+// Title identifies the page; Title allows following a LangLink.
+type LandmarkDetailsParams struct {
+	PageID     int64    `json:"pageId,omitempty"`
+	Title      string   `json:"title,omitempty"`
+	Lang       string   `json:"lang,omitempty"`       // wiki language, default WIKIPEDIA_DEFAULT_LANG
+	Fields     []string `json:"fields,omitempty"`     // extract, images, categories, url, wikidata, modified or all
+	ImageSizes []int    `json:"imageSizes,omitempty"` // thumbnail widths in pixels, default [200, 800]
+	ImageLimit int      `json:"imageLimit,omitempty"` // default 10, max 50
 }
 
 // FetchLandmarksInBoundsVars is the input to FetchLandmarksInBounds.
 type FetchLandmarksInBoundsVars struct {
-	MinLat   float64 `json:"minLat"` // south
-	MaxLat   float64 `json:"maxLat"` // north
-	MinLon   float64 `json:"minLon"` // west
-	MaxLon   float64 `json:"maxLon"` // east
-	Settings struct {
-		Radius int `json:"radius,omitempty"` // meters, default 50000
-		Limit  int `json:"limit,omitempty"`  // default 10, max 50
+	MinLat     float64  `json:"minLat"`               // south
+	MaxLat     float64  `json:"maxLat"`               // north
+	MinLon     float64  `json:"minLon"`               // west
+	MaxLon     float64  `json:"maxLon"`               // east
+	Lang       string   `json:"lang,omitempty"`       // wiki language, default WIKIPEDIA_DEFAULT_LANG
+	Cursor     string   `json:"cursor,omitempty"`     // X-Next-Cursor of the previous page
+	Providers  []string `json:"providers,omitempty"`  // landmark sources, default LANDMARK_PROVIDERS
+	Categories []string `json:"categories,omitempty"` // classes or wiki category names, any of
+	Keywords   []string `json:"keywords,omitempty"`   // any of
+	Exclude    []string `json:"exclude,omitempty"`    // classes, wiki categories or words to leave out
+	Settings   struct {
+		Radius int `json:"radius,omitempty"` // ignored; the search covers the bounds
+		Limit  int `json:"limit,omitempty"`  // per page, default 10, max 50
 	} `json:"settings,omitempty"`
 }
@@ -0,0 +1,9 @@
+package models
+
+// PrivacySettings control who sees a user's location and how precisely
+type PrivacySettings struct {
+	Visibility string   `json:"visibility"`        // everyone, contacts or list
+	Allowed    []string `json:"allowed,omitempty"` // viewers for the list visibility
+	Precision  int      `json:"precision"`         // geohash length to fuzz coordinates to; 0 is exact
+	Ghost      bool     `json:"ghost"`             // hidden from everyone, while still seeing others
+}
@@ -0,0 +1,22 @@
+package models
+
+import "time"
+
+// Trip is a user's movement between two stays
+type Trip struct {
+	ID              string     `json:"id"`
+	UserID          string     `json:"user_id"`
+	StartedAt       time.Time  `json:"started_at"`
+	EndedAt         *time.Time `json:"ended_at,omitempty"` // nil while the trip is under way
+	StartLatitude   float64    `json:"start_latitude"`
+	StartLongitude  float64    `json:"start_longitude"`
+	EndLatitude     float64    `json:"end_latitude,omitempty"`
+	EndLongitude    float64    `json:"end_longitude,omitempty"`
+	DistanceMeters  float64    `json:"distance_meters"`
+	DurationSeconds float64    `json:"duration_seconds"`
+	AverageSpeed    float64    `json:"average_speed"`        // meters per second
+	EndReason       string     `json:"end_reason,omitempty"` // stay or timeout
+
+	// Precision is the geohash length the end points were fuzzed to, if any
+	Precision int `json:"precision,omitempty"`
+}
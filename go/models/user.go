@@ -6,6 +6,10 @@ type User struct {
 	Name      string  `json:"name"`
 	Latitude  float64 `json:"latitude"`
 	Longitude float64 `json:"longitude"`
+	Telemetry
+
+	// Precision is the geohash length the coordinates were fuzzed to, if any
+	Precision int `json:"precision,omitempty"`
 }
 
 // LocationData represents location update data
@@ -14,4 +18,17 @@ type LocationData struct {
 	Latitude  float64 `json:"latitude"`
 	Longitude float64 `json:"longitude"`
 	ID        string  `json:"id,omitempty"`
+	Telemetry
+}
+
+// Telemetry is optional device data reported with a position
+type Telemetry struct {
+	Speed    *float64 `json:"speed,omitempty"`    // meters per second
+	Heading  *float64 `json:"heading,omitempty"`  // degrees clockwise from north
+	Accuracy *float64 `json:"accuracy,omitempty"` // meters
+	Battery  *float64 `json:"battery,omitempty"`  // percent
+	Altitude *float64 `json:"altitude,omitempty"` // meters
+
+	// Timestamp is when the fix was taken, in Unix milliseconds
+	Timestamp *int64 `json:"timestamp,omitempty"`
 }
@@ -0,0 +1,374 @@
+package services
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"math"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/tthogho1/redisconnect/go/config"
+	"github.com/tthogho1/redisconnect/go/models"
+)
+
+// ADS-B feed reconnect backoff
+const (
+	adsbMinBackoff = 500 * time.Millisecond
+	adsbMaxBackoff = 30 * time.Second
+)
+
+// sbsTimeLayout is the generated date and time of an SBS message
+const sbsTimeLayout = "2006/01/02 15:04:05"
+
+// aircraftUpdate is one report from a feed; nil fields were not reported
+type aircraftUpdate struct {
+	ICAO            string
+	Callsign        *string
+	Latitude        *float64
+	Longitude       *float64
+	AltitudeFt      *int
+	GroundSpeedKt   *float64
+	TrackDeg        *float64
+	VerticalRateFpm *int
+	Squawk          *string
+	OnGround        *bool
+	Time            time.Time // feed timestamp, zero if unknown
+}
+
+// aircraftTracker merges partial reports into aircraft states and remembers
+// which positioned aircraft changed since the last flush
+type aircraftTracker struct {
+	mu     sync.Mutex
+	states map[string]*models.Aircraft
+	dirty  map[string]bool
+}
+
+func newAircraftTracker() *aircraftTracker {
+	return &aircraftTracker{states: make(map[string]*models.Aircraft), dirty: make(map[string]bool)}
+}
+
+func (t *aircraftTracker) apply(update aircraftUpdate) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	state, ok := t.states[update.ICAO]
+	if !ok {
+		state = &models.Aircraft{ICAO: update.ICAO}
+		t.states[update.ICAO] = state
+	}
+	if update.Callsign != nil {
+		state.Callsign = *update.Callsign
+	}
+	if update.Latitude != nil && update.Longitude != nil {
+		state.Latitude, state.Longitude = *update.Latitude, *update.Longitude
+	}
+	if update.AltitudeFt != nil {
+		state.AltitudeFt = update.AltitudeFt
+	}
+	if update.GroundSpeedKt != nil {
+		state.GroundSpeedKt = update.GroundSpeedKt
+	}
+	if update.TrackDeg != nil {
+		state.TrackDeg = update.TrackDeg
+	}
+	if update.VerticalRateFpm != nil {
+		state.VerticalRateFpm = update.VerticalRateFpm
+	}
+	if update.Squawk != nil {
+		state.Squawk = *update.Squawk
+	}
+	if update.OnGround != nil {
+		state.OnGround = *update.OnGround
+	}
+	state.UpdatedAt = time.Now()
+
+	// Aircraft are only stored once they have a position
+	if state.Latitude != 0 || state.Longitude != 0 {
+		t.dirty[update.ICAO] = true
+	}
+}
+
+// flush returns the aircraft changed since the last flush and forgets ones
+// not heard from within ttl
+func (t *aircraftTracker) flush(ttl time.Duration) []models.Aircraft {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	changed := make([]models.Aircraft, 0, len(t.dirty))
+	for icao := range t.dirty {
+		changed = append(changed, *t.states[icao])
+	}
+	clear(t.dirty)
+
+	for icao, state := range t.states {
+		if time.Since(state.UpdatedAt) > ttl {
+			delete(t.states, icao)
+		}
+	}
+	return changed
+}
+
+// StartADSBIngestion starts reading aircraft from the first configured
+// source, storing them in Redis and publishing changes to the cluster, until
+// ctx is cancelled:
+//   - ADSB_REPLAY_FILE: recorded SBS messages, replayed at ADSB_REPLAY_SPEED
+//     (default 1, 0 for as fast as possible), looping if ADSB_REPLAY_LOOP=true
+//   - ADSB_SBS_ADDR: a dump1090-style SBS-1/BaseStation TCP feed (host:30003)
+//   - ADSB_AIRCRAFT_JSON: an aircraft.json URL or file, polled every
+//     ADSB_POLL_INTERVAL (default 1s)
+//
+// Run it on one instance per feed.
+func StartADSBIngestion(ctx context.Context) {
+	tracker := newAircraftTracker()
+	switch {
+	case os.Getenv("ADSB_REPLAY_FILE") != "":
+		speed := config.GetEnvFloat("ADSB_REPLAY_SPEED", 1)
+		go runSBSReplay(ctx, os.Getenv("ADSB_REPLAY_FILE"), speed, config.GetEnv("ADSB_REPLAY_LOOP", "false") == "true", tracker)
+	case os.Getenv("ADSB_SBS_ADDR") != "":
+		go runSBSFeed(ctx, os.Getenv("ADSB_SBS_ADDR"), tracker)
+	case os.Getenv("ADSB_AIRCRAFT_JSON") != "":
+		go runAircraftJSONPoller(ctx, os.Getenv("ADSB_AIRCRAFT_JSON"), config.GetEnvDuration("ADSB_POLL_INTERVAL", time.Second), tracker)
+	default:
+		return
+	}
+	go runAircraftStore(ctx, tracker,
+		config.GetEnvDuration("ADSB_FLUSH_INTERVAL", time.Second),
+		config.GetEnvDuration("ADSB_AIRCRAFT_TTL", 60*time.Second))
+}
+
+// runSBSFeed reads an SBS TCP feed, reconnecting with exponential backoff
+func runSBSFeed(ctx context.Context, addr string, tracker *aircraftTracker) {
+	backoff := adsbMinBackoff
+	for {
+		var dialer net.Dialer
+		conn, err := dialer.DialContext(ctx, "tcp", addr)
+		if err == nil {
+			slog.Info("Connected to SBS feed", "addr", addr)
+			backoff = adsbMinBackoff
+			stop := context.AfterFunc(ctx, func() { conn.Close() })
+			err = readSBS(ctx, conn, 0, tracker)
+			stop()
+			conn.Close()
+		}
+		if ctx.Err() != nil {
+			return
+		}
+		slog.Warn("SBS feed lost", "addr", addr, "error", err, "retry_in", backoff)
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(backoff):
+		}
+		backoff = min(backoff*2, adsbMaxBackoff)
+	}
+}
+
+// runSBSReplay feeds a recorded SBS file through the tracker, paced by the
+// messages' timestamps divided by speed
+func runSBSReplay(ctx context.Context, path string, speed float64, loop bool, tracker *aircraftTracker) {
+	for {
+		file, err := os.Open(path)
+		if err != nil {
+			slog.Error("Could not open SBS replay", "path", path, "error", err)
+			return
+		}
+		slog.Info("Replaying SBS recording", "path", path, "speed", speed)
+		err = readSBS(ctx, file, speed, tracker)
+		file.Close()
+		if err != nil && ctx.Err() == nil {
+			slog.Warn("SBS replay failed", "path", path, "error", err)
+		}
+		if !loop || ctx.Err() != nil {
+			return
+		}
+	}
+}
+
+// readSBS applies SBS lines until EOF or ctx is cancelled. A positive speed
+// sleeps between messages as recorded, divided by speed.
+func readSBS(ctx context.Context, r io.Reader, speed float64, tracker *aircraftTracker) error {
+	scanner := bufio.NewScanner(r)
+	var last time.Time
+	for scanner.Scan() {
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		update, ok := parseSBS(scanner.Text())
+		if !ok {
+			continue
+		}
+		if speed > 0 && !update.Time.IsZero() {
+			if !last.IsZero() && update.Time.After(last) {
+				select {
+				case <-ctx.Done():
+					return ctx.Err()
+				case <-time.After(time.Duration(float64(update.Time.Sub(last)) / speed)):
+				}
+			}
+			last = update.Time
+		}
+		tracker.apply(update)
+	}
+	return scanner.Err()
+}
+
+// parseSBS parses a BaseStation "MSG" line. Each transmission type carries
+// a subset of the fields; empty fields are left nil.
+func parseSBS(line string) (aircraftUpdate, bool) {
+	fields := strings.Split(strings.TrimSpace(line), ",")
+	if len(fields) < 22 || fields[0] != "MSG" || fields[4] == "" {
+		return aircraftUpdate{}, false
+	}
+
+	update := aircraftUpdate{ICAO: strings.ToLower(fields[4])}
+	if t, err := time.ParseInLocation(sbsTimeLayout, fields[6]+" "+fields[7], time.UTC); err == nil {
+		update.Time = t
+	}
+	if callsign := strings.TrimSpace(fields[10]); callsign != "" {
+		update.Callsign = &callsign
+	}
+	update.AltitudeFt = parseOptionalInt(fields[11])
+	update.GroundSpeedKt = parseOptionalFloat(fields[12])
+	update.TrackDeg = parseOptionalFloat(fields[13])
+	update.Latitude = parseOptionalFloat(fields[14])
+	update.Longitude = parseOptionalFloat(fields[15])
+	update.VerticalRateFpm = parseOptionalInt(fields[16])
+	if squawk := strings.TrimSpace(fields[17]); squawk != "" {
+		update.Squawk = &squawk
+	}
+	// dump1090 writes -1 for true, 0 for false
+	if onGround := strings.TrimSpace(fields[21]); onGround != "" {
+		value := onGround == "-1" || onGround == "1"
+		update.OnGround = &value
+	}
+	return update, true
+}
+
+// parseOptionalFloat parses a numeric field, treating empty, malformed and
+// non-finite values ("NaN", "Inf") as missing
+func parseOptionalFloat(value string) *float64 {
+	f, err := strconv.ParseFloat(strings.TrimSpace(value), 64)
+	if err != nil || math.IsNaN(f) || math.IsInf(f, 0) {
+		return nil
+	}
+	return &f
+}
+
+func parseOptionalInt(value string) *int {
+	f := parseOptionalFloat(value)
+	if f == nil {
+		return nil
+	}
+	n := int(*f)
+	return &n
+}
+
+// dump1090JSON is the aircraft.json format of dump1090-fa and readsb
+type dump1090JSON struct {
+	Aircraft []struct {
+		Hex      string          `json:"hex"`
+		Flight   string          `json:"flight"`
+		Lat      *float64        `json:"lat"`
+		Lon      *float64        `json:"lon"`
+		AltBaro  json.RawMessage `json:"alt_baro"` // feet, or "ground"
+		GS       *float64        `json:"gs"`
+		Track    *float64        `json:"track"`
+		BaroRate *int            `json:"baro_rate"`
+		Squawk   string          `json:"squawk"`
+		SeenPos  *float64        `json:"seen_pos"` // seconds since the last position
+	} `json:"aircraft"`
+}
+
+// runAircraftJSONPoller polls an aircraft.json URL or file
+func runAircraftJSONPoller(ctx context.Context, source string, interval time.Duration, tracker *aircraftTracker) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	client := &http.Client{Timeout: interval * 5}
+	failing := false
+	for {
+		err := pollAircraftJSON(ctx, client, source, tracker)
+		if err != nil && !failing {
+			slog.Warn("Could not read aircraft.json", "source", source, "error", err)
+		}
+		failing = err != nil
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func pollAircraftJSON(ctx context.Context, client *http.Client, source string, tracker *aircraftTracker) error {
+	var body []byte
+	if strings.HasPrefix(source, "http://") || strings.HasPrefix(source, "https://") {
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet, source, nil)
+		if err != nil {
+			return err
+		}
+		resp, err := client.Do(req)
+		if err != nil {
+			return err
+		}
+		defer resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			return fmt.Errorf("http %d", resp.StatusCode)
+		}
+		if body, err = io.ReadAll(resp.Body); err != nil {
+			return err
+		}
+	} else {
+		var err error
+		if body, err = os.ReadFile(source); err != nil {
+			return err
+		}
+	}
+
+	var feed dump1090JSON
+	if err := json.Unmarshal(body, &feed); err != nil {
+		return fmt.Errorf("decode: %w", err)
+	}
+	for _, entry := range feed.Aircraft {
+		if entry.Hex == "" {
+			continue
+		}
+		update := aircraftUpdate{
+			ICAO:          strings.ToLower(strings.TrimPrefix(entry.Hex, "~")),
+			GroundSpeedKt: entry.GS,
+			TrackDeg:      entry.Track,
+
+			VerticalRateFpm: entry.BaroRate,
+		}
+		// Positions are repeated until they age out; only take fresh ones
+		if entry.SeenPos != nil && *entry.SeenPos < 60 {
+			update.Latitude, update.Longitude = entry.Lat, entry.Lon
+		}
+		if callsign := strings.TrimSpace(entry.Flight); callsign != "" {
+			update.Callsign = &callsign
+		}
+		if entry.Squawk != "" {
+			update.Squawk = &entry.Squawk
+		}
+		var altitude int
+		if json.Unmarshal(entry.AltBaro, &altitude) == nil {
+			onGround := false
+			update.AltitudeFt, update.OnGround = &altitude, &onGround
+		} else if strings.Trim(string(entry.AltBaro), `"`) == "ground" {
+			onGround := true
+			update.OnGround = &onGround
+		}
+		tracker.apply(update)
+	}
+	return nil
+}
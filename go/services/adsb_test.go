@@ -0,0 +1,146 @@
+package services
+
+import (
+	"context"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"testing"
+	"time"
+)
+
+func TestParseSBS(t *testing.T) {
+	update, ok := parseSBS("MSG,3,1,1,4CA2D6,1,2024/11/20,03:12:45.310,2024/11/20,03:12:45.310,,37000,,,53.42130,-6.27010,,,0,0,0,-1\r\n")
+	if !ok {
+		t.Fatal("position message rejected")
+	}
+	if update.ICAO != "4ca2d6" {
+		t.Errorf("ICAO %q, want lower-case 4ca2d6", update.ICAO)
+	}
+	if want := time.Date(2024, 11, 20, 3, 12, 45, 310e6, time.UTC); !update.Time.Equal(want) {
+		t.Errorf("time %v, want %v", update.Time, want)
+	}
+	if update.Latitude == nil || *update.Latitude != 53.4213 || update.Longitude == nil || *update.Longitude != -6.2701 {
+		t.Errorf("position %v,%v", update.Latitude, update.Longitude)
+	}
+	if update.AltitudeFt == nil || *update.AltitudeFt != 37000 {
+		t.Errorf("altitude %v, want 37000", update.AltitudeFt)
+	}
+	if update.OnGround == nil || !*update.OnGround {
+		t.Errorf("on ground %v, want true for -1", update.OnGround)
+	}
+	if update.Callsign != nil || update.GroundSpeedKt != nil || update.Squawk != nil {
+		t.Error("empty fields were not left nil")
+	}
+
+	update, _ = parseSBS("MSG,1,1,1,4CA2D6,1,2024/11/20,03:12:45.012,2024/11/20,03:12:45.012,RYR4PN  ,,,,,,,,0,0,0,")
+	if update.Callsign == nil || *update.Callsign != "RYR4PN" {
+		t.Errorf("callsign %v, want RYR4PN without padding", update.Callsign)
+	}
+	update, _ = parseSBS("MSG,3,1,1,4CA2D6,1,2024/11/20,03:12:47.100,2024/11/20,03:12:47.100,,NaN,,,NaN,Inf,,,0,0,0,")
+	if update.AltitudeFt != nil || update.Latitude != nil || update.Longitude != nil {
+		t.Error("non-finite values were not treated as missing")
+	}
+
+	for _, line := range []string{
+		"",
+		"STA,,5,179,4CA2D6,10103,2024/11/20,03:12:45.400,2024/11/20,03:12:45.400,RM",
+		"MSG,3,1,1,4CA2D6,1,2024/11/20,03:12:46.500",
+		"MSG,3,1,1,,1,2024/11/20,03:12:45.310,2024/11/20,03:12:45.310,,37000,,,53.42130,-6.27010,,,0,0,0,0",
+	} {
+		if _, ok := parseSBS(line); ok {
+			t.Errorf("parseSBS(%q) accepted", line)
+		}
+	}
+}
+
+func TestSBSReplay(t *testing.T) {
+	tracker := newAircraftTracker()
+	runSBSReplay(context.Background(), filepath.Join("testdata", "adsb_replay.sbs"), 0, false, tracker)
+
+	// 3c6586 only sent its callsign, so it is not flushed until it has a position
+	changed := tracker.flush(time.Minute)
+	sort.Slice(changed, func(i, j int) bool { return changed[i].ICAO < changed[j].ICAO })
+	if len(changed) != 2 || changed[0].ICAO != "4ca2d6" || changed[1].ICAO != "4ca7b5" {
+		t.Fatalf("flushed %+v, want 4ca2d6 and 4ca7b5", changed)
+	}
+
+	// Partial messages merge into one state, and the NaN position is skipped
+	airborne := changed[0]
+	if airborne.Callsign != "RYR4PN" || airborne.Squawk != "7421" || airborne.OnGround {
+		t.Errorf("4ca2d6 = %q squawking %q, on ground %v", airborne.Callsign, airborne.Squawk, airborne.OnGround)
+	}
+	if airborne.Latitude != 53.4219 || airborne.Longitude != -6.2618 {
+		t.Errorf("4ca2d6 at %v,%v, want the last valid position", airborne.Latitude, airborne.Longitude)
+	}
+	if airborne.AltitudeFt == nil || *airborne.AltitudeFt != 36975 ||
+		airborne.GroundSpeedKt == nil || *airborne.GroundSpeedKt != 451.2 ||
+		airborne.TrackDeg == nil || *airborne.TrackDeg != 87.3 ||
+		airborne.VerticalRateFpm == nil || *airborne.VerticalRateFpm != -64 {
+		t.Errorf("4ca2d6 motion = %v ft, %v kt, %v°, %v fpm",
+			airborne.AltitudeFt, airborne.GroundSpeedKt, airborne.TrackDeg, airborne.VerticalRateFpm)
+	}
+	if surface := changed[1]; !surface.OnGround || surface.AltitudeFt != nil {
+		t.Errorf("4ca7b5 on ground %v at %v ft, want on the ground without altitude", surface.OnGround, surface.AltitudeFt)
+	}
+
+	if changed := tracker.flush(time.Minute); len(changed) != 0 {
+		t.Errorf("second flush returned %d aircraft, want none", len(changed))
+	}
+}
+
+func TestAircraftTrackerEviction(t *testing.T) {
+	tracker := newAircraftTracker()
+	callsign := "RYR4PN"
+	lat, lon := 53.4213, -6.2701
+	tracker.apply(aircraftUpdate{ICAO: "4ca2d6", Callsign: &callsign, Latitude: &lat, Longitude: &lon})
+	tracker.apply(aircraftUpdate{ICAO: "4ca7b5", Latitude: &lat, Longitude: &lon})
+	tracker.flush(time.Minute)
+
+	// 4ca2d6 goes quiet for longer than the TTL
+	tracker.states["4ca2d6"].UpdatedAt = time.Now().Add(-2 * time.Minute)
+	tracker.flush(time.Minute)
+	if _, ok := tracker.states["4ca2d6"]; ok {
+		t.Error("4ca2d6 was kept past the TTL")
+	}
+	if _, ok := tracker.states["4ca7b5"]; !ok {
+		t.Error("4ca7b5 was evicted within the TTL")
+	}
+
+	// An evicted aircraft starts over rather than keeping its old callsign
+	tracker.apply(aircraftUpdate{ICAO: "4ca2d6", Latitude: &lat, Longitude: &lon})
+	changed := tracker.flush(time.Minute)
+	if len(changed) != 1 || changed[0].Callsign != "" {
+		t.Errorf("flushed %+v, want 4ca2d6 without a callsign", changed)
+	}
+}
+
+func TestReadSBSPacing(t *testing.T) {
+	file, err := os.Open(filepath.Join("testdata", "adsb_replay.sbs"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+
+	// The recording spans about 2.3s, so 100x speed takes at least 20ms
+	start := time.Now()
+	if err := readSBS(context.Background(), file, 100, newAircraftTracker()); err != nil {
+		t.Fatalf("readSBS: %v", err)
+	}
+	if elapsed := time.Since(start); elapsed < 20*time.Millisecond {
+		t.Errorf("replay took %v, want the recorded gaps scaled by speed", elapsed)
+	}
+
+	// A cancelled replay stops before applying anything
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	file.Seek(0, io.SeekStart)
+	tracker := newAircraftTracker()
+	if err := readSBS(ctx, file, 0, tracker); err != context.Canceled {
+		t.Errorf("readSBS = %v, want context.Canceled", err)
+	}
+	if len(tracker.states) != 0 {
+		t.Errorf("applied %d aircraft after cancellation", len(tracker.states))
+	}
+}
@@ -0,0 +1,280 @@
+package services
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"math"
+	"strconv"
+	"sync"
+	"time"
+
+	socketio "github.com/doquangtan/socketio/v4"
+	"github.com/go-redis/redis/v8"
+	"github.com/tthogho1/redisconnect/go/config"
+	"github.com/tthogho1/redisconnect/go/models"
+)
+
+// Redis keys for aircraft: a GEO set of positions, a sorted set of last-seen
+// times, and one JSON state per aircraft
+const (
+	AircraftGeoKey  = "aircraft_locations"
+	aircraftSeenKey = "aircraft_seen"
+)
+
+func aircraftKey(icao string) string {
+	return "aircraft:" + icao
+}
+
+// ErrInvalidViewport is returned for viewports outside valid coordinates
+var ErrInvalidViewport = errors.New("invalid viewport")
+
+// runAircraftStore writes changed aircraft to Redis every interval and
+// removes ones not seen within ttl, publishing both to the cluster
+func runAircraftStore(ctx context.Context, tracker *aircraftTracker, interval, ttl time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if changed := tracker.flush(ttl); len(changed) > 0 {
+				if err := storeAircraft(ctx, changed, ttl); err != nil {
+					slog.Warn("Error storing aircraft", "count", len(changed), "error", err)
+				}
+			}
+			if err := sweepAircraft(ctx, ttl); err != nil {
+				slog.Warn("Error removing stale aircraft", "error", err)
+			}
+		}
+	}
+}
+
+// storeAircraft saves aircraft states and positions and publishes them as one
+// aircraft:updated message
+func storeAircraft(ctx context.Context, aircraft []models.Aircraft, ttl time.Duration) error {
+	pipe := config.Rdb.Pipeline()
+	for _, a := range aircraft {
+		data, err := json.Marshal(a)
+		if err != nil {
+			return err
+		}
+		pipe.Set(ctx, aircraftKey(a.ICAO), data, ttl)
+		pipe.GeoAdd(ctx, AircraftGeoKey, &redis.GeoLocation{Name: a.ICAO, Latitude: a.Latitude, Longitude: a.Longitude})
+		pipe.ZAdd(ctx, aircraftSeenKey, &redis.Z{Score: float64(a.UpdatedAt.Unix()), Member: a.ICAO})
+	}
+	if _, err := pipe.Exec(ctx); err != nil {
+		return err
+	}
+	return PublishEvent(ctx, AircraftUpdatedChannel, map[string]interface{}{"aircraft": aircraft})
+}
+
+// sweepAircraft removes aircraft last seen more than ttl ago and publishes
+// them as one aircraft:removed message. Only the caller whose ZREM succeeds
+// reports an aircraft, so concurrent sweeps never report it twice.
+func sweepAircraft(ctx context.Context, ttl time.Duration) error {
+	cutoff := strconv.FormatInt(time.Now().Add(-ttl).Unix(), 10)
+	stale, err := config.Rdb.ZRangeByScore(ctx, aircraftSeenKey, &redis.ZRangeBy{Min: "-inf", Max: "(" + cutoff}).Result()
+	if err != nil || len(stale) == 0 {
+		return err
+	}
+
+	removed := []string{}
+	for _, icao := range stale {
+		n, err := config.Rdb.ZRem(ctx, aircraftSeenKey, icao).Result()
+		if err != nil {
+			return err
+		}
+		if n == 0 {
+			continue
+		}
+		config.Rdb.ZRem(ctx, AircraftGeoKey, icao)
+		config.Rdb.Del(ctx, aircraftKey(icao))
+		removed = append(removed, icao)
+	}
+	if len(removed) == 0 {
+		return nil
+	}
+	return PublishEvent(ctx, AircraftRemovedChannel, map[string]interface{}{"icao": removed})
+}
+
+// AircraftInViewport returns the stored aircraft inside a viewport
+func AircraftInViewport(ctx context.Context, viewport models.Viewport) ([]models.Aircraft, error) {
+	box, err := viewportBox(viewport)
+	if err != nil {
+		return nil, err
+	}
+
+	// Search a box in kilometres around the center, at least as large as the
+	// viewport, then filter exactly
+	lat, lon := (box.South+box.North)/2, (box.West+box.East)/2
+	lonSpan := box.East - box.West
+	if box.West > box.East {
+		lon = normalizeLon(lon + 180)
+		lonSpan += 360
+	}
+	equatorward := 0.0
+	if box.South > 0 || box.North < 0 {
+		equatorward = math.Min(math.Abs(box.South), math.Abs(box.North))
+	}
+	kmPerDeg := earthRadiusMeters / 1000 * math.Pi / 180
+	locations, err := config.Rdb.GeoSearch(ctx, AircraftGeoKey, &redis.GeoSearchQuery{
+		Latitude:  lat,
+		Longitude: lon,
+		BoxWidth:  lonSpan*kmPerDeg*math.Cos(equatorward*math.Pi/180) + 1,
+		BoxHeight: (box.North-box.South)*kmPerDeg + 1,
+		BoxUnit:   "km",
+	}).Result()
+	if err != nil {
+		return nil, err
+	}
+
+	aircraft := []models.Aircraft{}
+	if len(locations) == 0 {
+		return aircraft, nil
+	}
+	keys := make([]string, len(locations))
+	for i, icao := range locations {
+		keys[i] = aircraftKey(icao)
+	}
+	values, err := config.Rdb.MGet(ctx, keys...).Result()
+	if err != nil {
+		return nil, err
+	}
+	for _, value := range values {
+		data, ok := value.(string)
+		if !ok {
+			// Expired before the sweep removed it from the GEO set
+			continue
+		}
+		var a models.Aircraft
+		if json.Unmarshal([]byte(data), &a) == nil && box.contains(a.Latitude, a.Longitude) {
+			aircraft = append(aircraft, a)
+		}
+	}
+	return aircraft, nil
+}
+
+func viewportBox(viewport models.Viewport) (geoBox, error) {
+	if viewport.South < -90 || viewport.North > 90 || viewport.South > viewport.North ||
+		viewport.West < -180 || viewport.West > 180 || viewport.East < -180 || viewport.East > 180 {
+		return geoBox{}, ErrInvalidViewport
+	}
+	return geoBox{South: viewport.South, West: viewport.West, North: viewport.North, East: viewport.East}, nil
+}
+
+// aircraftSubscriber is a socket watching a viewport, with the aircraft it
+// has been sent and not yet told were removed
+type aircraftSubscriber struct {
+	socket  *socketio.Socket
+	box     geoBox
+	visible map[string]bool
+}
+
+var (
+	aircraftSubscribers     = make(map[string]*aircraftSubscriber) // socket ID -> subscriber
+	aircraftSubscribersLock sync.Mutex
+)
+
+// SubscribeAircraft sets a socket's viewport, replacing any previous one, and
+// returns the aircraft currently inside it
+func SubscribeAircraft(ctx context.Context, socket *socketio.Socket, viewport models.Viewport) ([]models.Aircraft, error) {
+	box, err := viewportBox(viewport)
+	if err != nil {
+		return nil, err
+	}
+	aircraft, err := AircraftInViewport(ctx, viewport)
+	if err != nil {
+		return nil, err
+	}
+
+	subscriber := &aircraftSubscriber{socket: socket, box: box, visible: make(map[string]bool, len(aircraft))}
+	for _, a := range aircraft {
+		subscriber.visible[a.ICAO] = true
+	}
+
+	aircraftSubscribersLock.Lock()
+	previous := aircraftSubscribers[socket.Id]
+	aircraftSubscribers[socket.Id] = subscriber
+	aircraftSubscribersLock.Unlock()
+
+	// Aircraft shown for the old viewport that are outside the new one
+	if previous != nil {
+		var left []string
+		for icao := range previous.visible {
+			if !subscriber.visible[icao] {
+				left = append(left, icao)
+			}
+		}
+		if len(left) > 0 {
+			socket.Emit("aircraft_removed", map[string]interface{}{"icao": left})
+		}
+	}
+	return aircraft, nil
+}
+
+// UnsubscribeAircraft stops sending aircraft to a socket
+func UnsubscribeAircraft(socketID string) {
+	aircraftSubscribersLock.Lock()
+	delete(aircraftSubscribers, socketID)
+	aircraftSubscribersLock.Unlock()
+}
+
+// dispatchAircraftUpdated sends each local subscriber the updated aircraft in
+// its viewport, and removals for ones that flew out of it
+func dispatchAircraftUpdated(data map[string]interface{}) {
+	raw, err := json.Marshal(data["aircraft"])
+	if err != nil {
+		return
+	}
+	var aircraft []models.Aircraft
+	if err := json.Unmarshal(raw, &aircraft); err != nil {
+		slog.Warn("Invalid aircraft update", "error", err)
+		return
+	}
+
+	aircraftSubscribersLock.Lock()
+	defer aircraftSubscribersLock.Unlock()
+	for _, subscriber := range aircraftSubscribers {
+		var inside []models.Aircraft
+		var left []string
+		for _, a := range aircraft {
+			if subscriber.box.contains(a.Latitude, a.Longitude) {
+				inside = append(inside, a)
+				subscriber.visible[a.ICAO] = true
+			} else if subscriber.visible[a.ICAO] {
+				left = append(left, a.ICAO)
+				delete(subscriber.visible, a.ICAO)
+			}
+		}
+		if len(inside) > 0 {
+			subscriber.socket.Emit("aircraft_updated", map[string]interface{}{"aircraft": inside})
+		}
+		if len(left) > 0 {
+			subscriber.socket.Emit("aircraft_removed", map[string]interface{}{"icao": left})
+		}
+	}
+}
+
+// dispatchAircraftRemoved tells local subscribers about removed aircraft they
+// were shown
+func dispatchAircraftRemoved(data map[string]interface{}) {
+	icaos, _ := data["icao"].([]interface{})
+
+	aircraftSubscribersLock.Lock()
+	defer aircraftSubscribersLock.Unlock()
+	for _, subscriber := range aircraftSubscribers {
+		var removed []string
+		for _, value := range icaos {
+			if icao, ok := value.(string); ok && subscriber.visible[icao] {
+				removed = append(removed, icao)
+				delete(subscriber.visible, icao)
+			}
+		}
+		if len(removed) > 0 {
+			subscriber.socket.Emit("aircraft_removed", map[string]interface{}{"icao": removed})
+		}
+	}
+}
@@ -0,0 +1,357 @@
+package services
+
+import (
+	"context"
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"math"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/tthogho1/redisconnect/go/models"
+)
+
+// ErrAirportsNotLoaded is returned by the local provider before a dataset loads
+var ErrAirportsNotLoaded = errors.New("airport dataset not loaded")
+
+// LocalAirportProvider serves airports from an in-memory copy of the
+// OurAirports CSV files, indexed on a 1° grid
+type LocalAirportProvider struct {
+	// Path is airports.csv; runways.csv and frequencies.csv are read from
+	// the same directory when present
+	Path string
+
+	dataset atomic.Pointer[airportDataset]
+}
+
+type localAirport struct {
+	models.Airport
+	scheduled bool
+}
+
+type airportDataset struct {
+	airports []localAirport
+	grid     map[[2]int][]int // [lat, lon] cell -> indexes into airports
+	codes    map[string][]int // IATA code, ICAO code or ident -> indexes into airports
+	stamp    string           // file sizes and modification times
+}
+
+// Name implements AirportProvider
+func (p *LocalAirportProvider) Name() string { return AirportProviderLocal }
+
+// FetchAirports implements AirportProvider
+func (p *LocalAirportProvider) FetchAirports(ctx context.Context, query AirportQuery) (AirportPage, error) {
+	dataset := p.dataset.Load()
+	if dataset == nil {
+		return AirportPage{}, ErrAirportsNotLoaded
+	}
+
+	box := query.box()
+	var matches []models.Airport
+	for _, cell := range gridCells(box) {
+		for _, i := range dataset.grid[cell] {
+			airport := dataset.airports[i]
+			if !box.contains(airport.LatitudeDeg, airport.LongitudeDeg) ||
+				!slices.Contains(query.Types, airport.Type) ||
+				(query.ScheduledOnly && !airport.scheduled) ||
+				(query.HasIata != nil && *query.HasIata != (airport.IataCode != nil)) {
+				continue
+			}
+			matches = append(matches, airport.Airport)
+		}
+	}
+
+	var (
+		page AirportPage
+		err  error
+	)
+	if query.OrderBy == AirportOrderDistance {
+		page, err = pageAirportsByDistance(matches, query)
+	} else {
+		page, err = pageAirportsBySize(matches, query)
+	}
+	if page.Airports == nil {
+		page.Airports = []models.Airport{}
+	}
+	page.Source = p.Name()
+	return page, err
+}
+
+// AirportByCode implements AirportProvider, matching IATA codes, or ICAO
+// codes and idents
+func (p *LocalAirportProvider) AirportByCode(ctx context.Context, code string) (*models.Airport, error) {
+	dataset := p.dataset.Load()
+	if dataset == nil {
+		return nil, ErrAirportsNotLoaded
+	}
+	var matches []models.Airport
+	for _, i := range dataset.codes[code] {
+		airport := dataset.airports[i].Airport
+		if len(code) == 3 && (airport.IataCode == nil || *airport.IataCode != code) {
+			// An ident that happens to be 3 characters
+			continue
+		}
+		matches = append(matches, airport)
+	}
+	return bestAirport(matches), nil
+}
+
+// gridCells lists the 1° cells overlapping a box
+func gridCells(box geoBox) [][2]int {
+	lonRanges := [][2]int{{gridIndex(box.West), gridIndex(box.East)}}
+	if box.West > box.East {
+		lonRanges = [][2]int{{gridIndex(box.West), 179}, {-180, gridIndex(box.East)}}
+	}
+	var cells [][2]int
+	for lat := gridIndex(box.South); lat <= gridIndex(box.North); lat++ {
+		for _, lons := range lonRanges {
+			for lon := lons[0]; lon <= lons[1]; lon++ {
+				cells = append(cells, [2]int{lat, lon})
+			}
+		}
+	}
+	return cells
+}
+
+// gridIndex is the 1° cell of a coordinate; 90 and 180 join the cell below
+func gridIndex(deg float64) int {
+	return min(int(math.Floor(deg)), 179)
+}
+
+// Load reads the CSV files and swaps in the new dataset; on error the previous
+// dataset is kept
+func (p *LocalAirportProvider) Load() error {
+	start := time.Now()
+	stamp, err := p.stamp()
+	if err != nil {
+		return err
+	}
+	airports, err := readAirportsCSV(p.Path)
+	if err != nil {
+		return err
+	}
+
+	index := make(map[int64]int, len(airports))
+	for i, airport := range airports {
+		index[airport.ID] = i
+	}
+	dir := filepath.Dir(p.Path)
+	if err := readRunwaysCSV(filepath.Join(dir, "runways.csv"), airports, index); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	if err := readFrequenciesCSV(filepath.Join(dir, "frequencies.csv"), airports, index); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+
+	dataset := &airportDataset{
+		airports: airports,
+		grid:     make(map[[2]int][]int),
+		codes:    make(map[string][]int),
+		stamp:    stamp,
+	}
+	for i, airport := range airports {
+		cell := [2]int{gridIndex(airport.LatitudeDeg), gridIndex(airport.LongitudeDeg)}
+		dataset.grid[cell] = append(dataset.grid[cell], i)
+
+		codes := []string{strings.ToUpper(airport.Ident)}
+		for _, code := range []*string{airport.IataCode, airport.IcaoCode} {
+			if code != nil {
+				codes = append(codes, strings.ToUpper(*code))
+			}
+		}
+		slices.Sort(codes)
+		for _, code := range slices.Compact(codes) {
+			dataset.codes[code] = append(dataset.codes[code], i)
+		}
+	}
+	p.dataset.Store(dataset)
+	slog.Info("Airport dataset loaded", "path", p.Path, "airports", len(airports), "elapsed", time.Since(start))
+	return nil
+}
+
+// Watch reloads the dataset when a file's size or modification time changes,
+// checking every interval until ctx is cancelled
+func (p *LocalAirportProvider) Watch(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			stamp, err := p.stamp()
+			if err != nil {
+				slog.Warn("Could not check airport dataset", "path", p.Path, "error", err)
+				continue
+			}
+			if current := p.dataset.Load(); current != nil && current.stamp == stamp {
+				continue
+			}
+			if err := p.Load(); err != nil {
+				slog.Warn("Could not reload airport dataset", "path", p.Path, "error", err)
+			}
+		}
+	}
+}
+
+// stamp summarizes the files' sizes and modification times
+func (p *LocalAirportProvider) stamp() (string, error) {
+	dir := filepath.Dir(p.Path)
+	var parts []string
+	for _, path := range []string{p.Path, filepath.Join(dir, "runways.csv"), filepath.Join(dir, "frequencies.csv")} {
+		info, err := os.Stat(path)
+		if errors.Is(err, os.ErrNotExist) && path != p.Path {
+			continue
+		}
+		if err != nil {
+			return "", err
+		}
+		parts = append(parts, fmt.Sprintf("%s:%d:%d", filepath.Base(path), info.Size(), info.ModTime().UnixNano()))
+	}
+	return strings.Join(parts, ","), nil
+}
+
+// readCSV calls fn for each record with a lookup of its columns by header name
+func readCSV(path string, fn func(field func(string) string) error) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	reader := csv.NewReader(file)
+	reader.FieldsPerRecord = -1
+	reader.ReuseRecord = true
+	header, err := reader.Read()
+	if err != nil {
+		return fmt.Errorf("%s: read header: %w", filepath.Base(path), err)
+	}
+	columns := make(map[string]int, len(header))
+	for i, name := range header {
+		columns[strings.TrimSpace(name)] = i
+	}
+
+	for {
+		record, err := reader.Read()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("%s: %w", filepath.Base(path), err)
+		}
+		field := func(name string) string {
+			if i, ok := columns[name]; ok && i < len(record) {
+				return strings.TrimSpace(record[i])
+			}
+			return ""
+		}
+		if err := fn(field); err != nil {
+			return err
+		}
+	}
+}
+
+func readAirportsCSV(path string) ([]localAirport, error) {
+	var airports []localAirport
+	err := readCSV(path, func(field func(string) string) error {
+		id, err := strconv.ParseInt(field("id"), 10, 64)
+		if err != nil {
+			return nil
+		}
+		lat, latErr := strconv.ParseFloat(field("latitude_deg"), 64)
+		lon, lonErr := strconv.ParseFloat(field("longitude_deg"), 64)
+		if latErr != nil || lonErr != nil || lat < -90 || lat > 90 || lon < -180 || lon > 180 {
+			return nil
+		}
+		icao := field("icao_code")
+		if icao == "" {
+			// Older files have no icao_code column
+			icao = field("gps_code")
+		}
+		airports = append(airports, localAirport{
+			Airport: models.Airport{
+				ID:               id,
+				Ident:            field("ident"),
+				Name:             field("name"),
+				Type:             field("type"),
+				IataCode:         optionalString(field("iata_code")),
+				IcaoCode:         optionalString(icao),
+				LatitudeDeg:      lat,
+				LongitudeDeg:     lon,
+				ElevationFt:      optionalInt(field("elevation_ft")),
+				Municipality:     field("municipality"),
+				IsoCountry:       field("iso_country"),
+				IsoRegion:        field("iso_region"),
+				ScheduledService: field("scheduled_service"),
+				HomeLink:         optionalString(field("home_link")),
+				WikipediaLink:    optionalString(field("wikipedia_link")),
+			},
+			scheduled: field("scheduled_service") == "yes",
+		})
+		return nil
+	})
+	return airports, err
+}
+
+func readRunwaysCSV(path string, airports []localAirport, index map[int64]int) error {
+	return readCSV(path, func(field func(string) string) error {
+		ref, err := strconv.ParseInt(field("airport_ref"), 10, 64)
+		i, ok := index[ref]
+		if err != nil || !ok {
+			return nil
+		}
+		airports[i].Runways = append(airports[i].Runways, models.Runway{
+			LengthFt: optionalInt(field("length_ft")),
+			WidthFt:  optionalInt(field("width_ft")),
+			Surface:  field("surface"),
+			Lighted:  field("lighted") == "1",
+			Closed:   field("closed") == "1",
+			LeIdent:  field("le_ident"),
+			HeIdent:  field("he_ident"),
+		})
+		return nil
+	})
+}
+
+func readFrequenciesCSV(path string, airports []localAirport, index map[int64]int) error {
+	return readCSV(path, func(field func(string) string) error {
+		ref, err := strconv.ParseInt(field("airport_ref"), 10, 64)
+		i, ok := index[ref]
+		if err != nil || !ok {
+			return nil
+		}
+		mhz, err := strconv.ParseFloat(field("frequency_mhz"), 64)
+		if err != nil {
+			return nil
+		}
+		airports[i].Frequencies = append(airports[i].Frequencies, models.AirportFrequency{
+			Type:         field("type"),
+			Description:  field("description"),
+			FrequencyMHz: mhz,
+		})
+		return nil
+	})
+}
+
+func optionalString(value string) *string {
+	if value == "" {
+		return nil
+	}
+	return &value
+}
+
+func optionalInt(value string) *int {
+	n, err := strconv.Atoi(value)
+	if err != nil {
+		return nil
+	}
+	return &n
+}
@@ -0,0 +1,87 @@
+package services
+
+import (
+	"context"
+	"log/slog"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/tthogho1/redisconnect/go/config"
+	"github.com/tthogho1/redisconnect/go/models"
+)
+
+// Airport provider names, as used in AIRPORT_PROVIDER and X-Airport-Source
+const (
+	AirportProviderHasura = "hasura"
+	AirportProviderLocal  = "local"
+)
+
+// AirportProvider is a source of airports
+type AirportProvider interface {
+	// Name identifies the provider in AIRPORT_PROVIDER and responses
+	Name() string
+	// FetchAirports returns one page of airports matching the query
+	FetchAirports(ctx context.Context, query AirportQuery) (AirportPage, error)
+	// AirportByCode returns the full record for an upper-case IATA (3
+	// letters) or ICAO (4 characters) code, or nil if there is none
+	AirportByCode(ctx context.Context, code string) (*models.Airport, error)
+}
+
+var (
+	airportProvider     AirportProvider
+	airportProviderLock sync.RWMutex
+	airportProviderOnce sync.Once
+
+	// localAirports holds the OurAirports dataset once AIRPORTS_CSV is loaded
+	localAirports = &LocalAirportProvider{}
+)
+
+// loadAirportProvider selects AIRPORT_PROVIDER (default "hasura"). The Hasura
+// provider falls back to the local dataset unless AIRPORTS_FALLBACK=false.
+func loadAirportProvider() {
+	if strings.EqualFold(config.GetEnv("AIRPORT_PROVIDER", AirportProviderHasura), AirportProviderLocal) {
+		airportProvider = localAirports
+		return
+	}
+	hasura := &HasuraAirportProvider{
+		Endpoint:    os.Getenv("HASURA_ENDPOINT"),
+		AdminSecret: os.Getenv("HASURA_ADMIN_SECRET"),
+	}
+	if config.GetEnv("AIRPORTS_FALLBACK", "true") != "false" {
+		hasura.Fallback = localAirports
+	}
+	airportProvider = hasura
+}
+
+// currentAirportProvider returns the configured provider
+func currentAirportProvider() AirportProvider {
+	airportProviderOnce.Do(loadAirportProvider)
+	airportProviderLock.RLock()
+	defer airportProviderLock.RUnlock()
+	return airportProvider
+}
+
+// SetAirportProvider replaces the configured provider, e.g. with a fixture
+func SetAirportProvider(provider AirportProvider) {
+	airportProviderOnce.Do(loadAirportProvider)
+	airportProviderLock.Lock()
+	defer airportProviderLock.Unlock()
+	airportProvider = provider
+}
+
+// InitAirportData loads the OurAirports dataset from AIRPORTS_CSV, if set,
+// and reloads it when the files change (checked every
+// AIRPORTS_RELOAD_INTERVAL, default 30s) until ctx is cancelled.
+func InitAirportData(ctx context.Context) {
+	path := os.Getenv("AIRPORTS_CSV")
+	if path == "" {
+		return
+	}
+	localAirports.Path = path
+	if err := localAirports.Load(); err != nil {
+		slog.Warn("Could not load airport dataset", "path", path, "error", err)
+	}
+	go localAirports.Watch(ctx, config.GetEnvDuration("AIRPORTS_RELOAD_INTERVAL", 30*time.Second))
+}
@@ -0,0 +1,102 @@
+package services
+
+import (
+	"context"
+	"encoding/json"
+	"log/slog"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+	"github.com/tthogho1/redisconnect/go/config"
+	"github.com/tthogho1/redisconnect/go/logging"
+	"golang.org/x/sync/singleflight"
+)
+
+// CacheStatus describes how a cached response was served (X-Cache header)
+type CacheStatus string
+
+// Cache statuses
+const (
+	CacheHit   CacheStatus = "HIT"   // fresh entry
+	CacheStale CacheStatus = "STALE" // expired entry served while revalidating
+	CacheMiss  CacheStatus = "MISS"  // fetched from upstream
+)
+
+// combineCacheStatus summarizes several lookups: any MISS is a MISS, then any STALE
+func combineCacheStatus(a, b CacheStatus) CacheStatus {
+	if a == CacheMiss || b == CacheMiss {
+		return CacheMiss
+	}
+	if a == CacheStale || b == CacheStale {
+		return CacheStale
+	}
+	return CacheHit
+}
+
+// cacheFetchTimeout bounds a shared upstream fetch, which outlives any single caller
+const cacheFetchTimeout = 30 * time.Second
+
+type cacheEntry struct {
+	StoredAt time.Time       `json:"stored_at"`
+	Data     json.RawMessage `json:"data"`
+}
+
+var cacheGroup singleflight.Group
+
+// cachedFetch returns the value stored under key, calling fetch on a miss.
+// Entries are fresh for ttl and then served stale for up to stale more while a
+// background refresh runs. Concurrent misses for the same key share one fetch.
+// Redis errors fall back to fetching directly.
+func cachedFetch[T any](ctx context.Context, key string, ttl, stale time.Duration, fetch func(context.Context) (T, error)) (T, CacheStatus, error) {
+	logger := logging.FromContext(ctx)
+
+	if raw, err := config.Rdb.Get(ctx, key).Bytes(); err == nil {
+		var entry cacheEntry
+		var value T
+		if err := json.Unmarshal(raw, &entry); err == nil && json.Unmarshal(entry.Data, &value) == nil {
+			age := time.Since(entry.StoredAt)
+			if age < ttl {
+				return value, CacheHit, nil
+			}
+			if age < ttl+stale {
+				RunBackground(func() {
+					if _, err := refreshCache(ctx, key, ttl, stale, fetch); err != nil {
+						slog.Warn("Cache revalidation failed", "key", key, "error", err)
+					}
+				})
+				return value, CacheStale, nil
+			}
+		}
+	} else if err != redis.Nil {
+		logger.Warn("Cache read failed", "key", key, "error", err)
+	}
+
+	value, err := refreshCache(ctx, key, ttl, stale, fetch)
+	return value, CacheMiss, err
+}
+
+// refreshCache fetches and stores a value, collapsing concurrent calls per key
+func refreshCache[T any](ctx context.Context, key string, ttl, stale time.Duration, fetch func(context.Context) (T, error)) (T, error) {
+	result, err, _ := cacheGroup.Do(key, func() (interface{}, error) {
+		// Detach from the caller so one cancelled request does not fail the others
+		fetchCtx, cancel := context.WithTimeout(context.WithoutCancel(ctx), cacheFetchTimeout)
+		defer cancel()
+
+		value, err := fetch(fetchCtx)
+		if err != nil {
+			return value, err
+		}
+
+		data, err := json.Marshal(value)
+		if err == nil {
+			entry, _ := json.Marshal(cacheEntry{StoredAt: time.Now(), Data: data})
+			if err := config.Rdb.Set(fetchCtx, key, entry, ttl+stale).Err(); err != nil {
+				logging.FromContext(ctx).Warn("Cache write failed", "key", key, "error", err)
+			}
+		}
+		return value, nil
+	})
+
+	value, _ := result.(T)
+	return value, err
+}
@@ -1,12 +1,22 @@
 package services
 
 import (
+	"context"
 	"encoding/json"
-	"log"
+	"errors"
+	"log/slog"
+	"net"
 	"sync"
+	"time"
 
 	socketio "github.com/doquangtan/socketio/v4"
+	"github.com/go-redis/redis/v8"
 	"github.com/tthogho1/redisconnect/go/config"
+	"github.com/tthogho1/redisconnect/go/logging"
+	"github.com/tthogho1/redisconnect/go/metrics"
+	"github.com/tthogho1/redisconnect/go/tracing"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
 )
 
 // Redis channel constants for clustering
@@ -15,51 +25,314 @@ const (
 	ChatBroadcastChannel = "chat:broadcast"
 	ChatPrivateChannel   = "chat:private"
 	UserDeletedChannel   = "user:deleted"
+	UserPrivacyChannel   = "user:privacy"
+
+	AircraftUpdatedChannel = "aircraft:updated"
+	AircraftRemovedChannel = "aircraft:removed"
+
+	TripStartedChannel = "trip:started"
+	TripEndedChannel   = "trip:ended"
+)
+
+// clusterChannels lists every channel the subscriber listens on
+var clusterChannels = []string{ChatBroadcastChannel, ChatPrivateChannel, UserLocationChannel, UserDeletedChannel, UserPrivacyChannel, AircraftUpdatedChannel, AircraftRemovedChannel, TripStartedChannel, TripEndedChannel}
+
+func init() {
+	metrics.RegisterChannels(clusterChannels...)
+}
+
+// Subscription supervision settings
+const (
+	subscribeMinBackoff     = 500 * time.Millisecond
+	subscribeMaxBackoff     = 30 * time.Second
+	subscribeReceiveTimeout = 30 * time.Second
 )
 
-// InitializeRedisSubscriptions subscribes to Redis channels for clustering support
-func InitializeRedisSubscriptions(io *socketio.Io, userSIDMap map[string]*socketio.Socket, userSIDLock *sync.RWMutex) {
-	pubsub := config.Rdb.Subscribe(config.Ctx, ChatBroadcastChannel, ChatPrivateChannel, UserLocationChannel, UserDeletedChannel)
+// SubscriptionStatus describes the health of the Redis Pub/Sub subscriber
+type SubscriptionStatus struct {
+	Connected       bool      `json:"connected"`
+	LastConnectedAt time.Time `json:"last_connected_at"`
+	LastMessageAt   time.Time `json:"last_message_at"`
+	Reconnects      int       `json:"reconnects"`
+	LastError       string    `json:"last_error,omitempty"`
+}
+
+var (
+	subscriptionStatus     SubscriptionStatus
+	subscriptionStatusLock sync.RWMutex
+)
+
+// SubscriptionHealth returns a snapshot of the Pub/Sub subscriber state
+func SubscriptionHealth() SubscriptionStatus {
+	subscriptionStatusLock.RLock()
+	defer subscriptionStatusLock.RUnlock()
+	return subscriptionStatus
+}
+
+func setSubscriptionConnected() {
+	subscriptionStatusLock.Lock()
+	defer subscriptionStatusLock.Unlock()
+	if !subscriptionStatus.LastConnectedAt.IsZero() {
+		subscriptionStatus.Reconnects++
+	}
+	subscriptionStatus.Connected = true
+	subscriptionStatus.LastConnectedAt = time.Now()
+	subscriptionStatus.LastError = ""
+}
+
+func setSubscriptionDisconnected(err error) {
+	subscriptionStatusLock.Lock()
+	defer subscriptionStatusLock.Unlock()
+	subscriptionStatus.Connected = false
+	if err != nil {
+		subscriptionStatus.LastError = err.Error()
+	}
+}
+
+func markSubscriptionMessage() {
+	subscriptionStatusLock.Lock()
+	subscriptionStatus.LastMessageAt = time.Now()
+	subscriptionStatusLock.Unlock()
+}
+
+// InitializeRedisSubscriptions subscribes to Redis channels for clustering support.
+// The subscription is supervised: when the connection drops it is re-established
+// with exponential backoff, and local clients are resynced after each reconnect.
+// It returns when ctx is cancelled.
+func InitializeRedisSubscriptions(ctx context.Context, io *socketio.Io, userSIDMap map[string]*socketio.Socket, userSIDLock *sync.RWMutex) {
+	backoff := subscribeMinBackoff
+	connectedBefore := false
+
+	for {
+		err := runSubscription(ctx, io, userSIDMap, userSIDLock, func() {
+			// Subscription confirmed: reset backoff and resync after a reconnect
+			backoff = subscribeMinBackoff
+			if connectedBefore {
+				resyncLocalClients(io, userSIDMap, userSIDLock)
+			}
+			connectedBefore = true
+		})
+		if ctx.Err() != nil {
+			setSubscriptionDisconnected(nil)
+			slog.Info("Redis subscription stopped")
+			return
+		}
+		setSubscriptionDisconnected(err)
+
+		slog.Warn("Redis subscription lost", "error", err, "retry_in", backoff)
+		select {
+		case <-ctx.Done():
+			setSubscriptionDisconnected(nil)
+			return
+		case <-time.After(backoff):
+		}
+
+		backoff *= 2
+		if backoff > subscribeMaxBackoff {
+			backoff = subscribeMaxBackoff
+		}
+	}
+}
+
+// runSubscription subscribes to the cluster channels and dispatches messages
+// until the connection fails. It always returns a non-nil error.
+func runSubscription(ctx context.Context, io *socketio.Io, userSIDMap map[string]*socketio.Socket, userSIDLock *sync.RWMutex, onSubscribed func()) error {
+	pubsub := config.Rdb.Subscribe(ctx, clusterChannels...)
 	defer pubsub.Close()
 
-	channel := pubsub.Channel()
-	for msg := range channel {
-		switch msg.Channel {
-		case ChatBroadcastChannel:
-			// Handle broadcast messages from other instances
-			var chatData map[string]interface{}
-			json.Unmarshal([]byte(msg.Payload), &chatData)
-			io.Emit("chat_message", chatData)
-			log.Printf("📡 Received broadcast message from Redis: %v", chatData)
-
-		case ChatPrivateChannel:
-			// Handle private messages directed to users on this instance
-			var chatData map[string]interface{}
-			json.Unmarshal([]byte(msg.Payload), &chatData)
-			toUser, _ := chatData["to"].(string)
-
-			userSIDLock.RLock()
-			recipientSocket, exists := userSIDMap[toUser]
-			userSIDLock.RUnlock()
-
-			if exists {
-				recipientSocket.Emit("chat_message", chatData)
-				log.Printf("📡 Delivered private message to local user %s", toUser)
+	subscribed := 0
+	for {
+		received, err := pubsub.ReceiveTimeout(ctx, subscribeReceiveTimeout)
+		if err != nil {
+			var netErr net.Error
+			if errors.As(err, &netErr) && netErr.Timeout() {
+				// Idle connection: verify it is still alive
+				if err := pubsub.Ping(ctx); err != nil {
+					return err
+				}
+				continue
+			}
+			return err
+		}
+
+		switch msg := received.(type) {
+		case *redis.Subscription:
+			if msg.Kind == "subscribe" {
+				subscribed++
+				if subscribed == len(clusterChannels) {
+					setSubscriptionConnected()
+					slog.Info("Subscribed to Redis channels", "channels", subscribed)
+					onSubscribed()
+				}
+			}
+
+		case *redis.Message:
+			markSubscriptionMessage()
+			metrics.PubSubReceived(msg.Channel)
+			dispatchClusterMessage(io, userSIDMap, userSIDLock, msg)
+
+		case *redis.Pong:
+			// Keep-alive response
+		}
+	}
+}
+
+// PublishEvent marshals data as a JSON object and publishes it to a cluster
+// channel. The context's correlation ID travels in the payload's "_meta" field,
+// which receivers strip before emitting to clients.
+func PublishEvent(ctx context.Context, channel string, data interface{}) (err error) {
+	ctx, span := tracing.Start(ctx, "publish "+channel,
+		trace.WithSpanKind(trace.SpanKindProducer),
+		trace.WithAttributes(
+			attribute.String("messaging.system", "redis"),
+			attribute.String("messaging.destination.name", channel),
+		))
+	defer func() { tracing.EndSpan(span, err) }()
+	defer trackInFlight()()
+	logger := logging.FromContext(ctx)
+
+	raw, err := json.Marshal(data)
+	if err != nil {
+		return err
+	}
+	var envelope map[string]interface{}
+	if err := json.Unmarshal(raw, &envelope); err != nil {
+		return err
+	}
+	meta := map[string]string{
+		"correlation_id": logging.CorrelationID(ctx),
+	}
+	tracing.Inject(ctx, meta)
+	envelope[logging.MetaKey] = meta
+	payload, err := json.Marshal(envelope)
+	if err != nil {
+		return err
+	}
+
+	if err := config.Rdb.Publish(ctx, channel, string(payload)).Err(); err != nil {
+		logger.Error("Error publishing to Redis", "channel", channel, "error", err)
+		return err
+	}
+	metrics.PubSubPublished(channel)
+	logger.Debug("Published to Redis", "channel", channel)
+	return nil
+}
+
+// decodeEnvelope parses a Pub/Sub payload, strips its "_meta" field and
+// returns a context carrying the publisher's correlation ID and trace context.
+func decodeEnvelope(payload string) (map[string]interface{}, context.Context, error) {
+	var data map[string]interface{}
+	if err := json.Unmarshal([]byte(payload), &data); err != nil {
+		return nil, nil, err
+	}
+
+	ctx := context.Background()
+	if meta, ok := data[logging.MetaKey].(map[string]interface{}); ok {
+		carrier := map[string]string{}
+		for key, value := range meta {
+			if s, ok := value.(string); ok {
+				carrier[key] = s
 			}
+		}
+		if id := carrier["correlation_id"]; id != "" {
+			ctx = logging.WithCorrelationID(ctx, id)
+		}
+		ctx = tracing.Extract(ctx, carrier)
+	}
+	if logging.CorrelationID(ctx) == "" {
+		ctx = logging.WithCorrelationID(ctx, logging.NewCorrelationID())
+	}
+	delete(data, logging.MetaKey)
+	return data, ctx, nil
+}
+
+// resyncLocalClients re-sends the user list each local socket may see, since
+// updates published while the subscription was down were missed.
+func resyncLocalClients(io *socketio.Io, userSIDMap map[string]*socketio.Socket, userSIDLock *sync.RWMutex) {
+	allUsers, policies, err := loadUsersWithPolicies(config.Ctx)
+	if err != nil {
+		slog.Warn("Could not resync users to local clients", "error", err)
+		return
+	}
+	for _, viewer := range localViewers(io, userSIDMap, userSIDLock) {
+		viewer.socket.Emit("all_users", visibleUsers(allUsers, policies, viewer.userID))
+	}
+	slog.Info("Resynced users to local clients after reconnect", "users", len(allUsers))
+}
 
-		case UserLocationChannel:
-			// Handle location updates from other instances
-			var locationData map[string]interface{}
-			json.Unmarshal([]byte(msg.Payload), &locationData)
-			io.Emit("user_updated", locationData)
-			// Logging disabled to reduce log noise
-
-		case UserDeletedChannel:
-			// Handle user deletions from other instances
-			var deleteData map[string]string
-			json.Unmarshal([]byte(msg.Payload), &deleteData)
-			io.Emit("user_deleted", deleteData)
-			log.Printf("📡 Received user deletion from Redis: %v", deleteData)
+// dispatchClusterMessage handles a single Pub/Sub message. A panic while
+// handling one message is recovered so it cannot kill the subscriber.
+func dispatchClusterMessage(io *socketio.Io, userSIDMap map[string]*socketio.Socket, userSIDLock *sync.RWMutex, msg *redis.Message) {
+	defer func() {
+		if r := recover(); r != nil {
+			slog.Error("Recovered panic handling Redis message", "channel", msg.Channel, "panic", r)
 		}
+	}()
+
+	data, ctx, err := decodeEnvelope(msg.Payload)
+	if err != nil {
+		slog.Warn("Invalid Redis payload", "channel", msg.Channel, "error", err)
+		return
+	}
+	ctx, span := tracing.Start(ctx, "receive "+msg.Channel,
+		trace.WithSpanKind(trace.SpanKindConsumer),
+		trace.WithAttributes(
+			attribute.String("messaging.system", "redis"),
+			attribute.String("messaging.destination.name", msg.Channel),
+		))
+	defer span.End()
+	logger := logging.FromContext(ctx)
+
+	switch msg.Channel {
+	case ChatBroadcastChannel:
+		// Handle broadcast messages from other instances
+		io.Emit("chat_message", data)
+		logger.Info("Received broadcast message from Redis", "from", data["from"], "message", data["message"])
+
+	case ChatPrivateChannel:
+		// Handle private messages directed to users on this instance
+		toUser, _ := data["to"].(string)
+
+		userSIDLock.RLock()
+		recipientSocket, exists := userSIDMap[toUser]
+		userSIDLock.RUnlock()
+
+		if exists {
+			recipientSocket.Emit("chat_message", data)
+			logger.Info("Delivered private message to local user", "to", toUser)
+		}
+
+	case UserLocationChannel:
+		// Fan location updates out to the sockets each user's privacy allows
+		userID, _ := data["id"].(string)
+		EmitToViewers(ctx, io, userSIDMap, userSIDLock, userID, "user_updated", data)
+		logger.Debug("Received location update from Redis", "user_id", userID)
+
+	case UserDeletedChannel:
+		// Handle user deletions from other instances
+		io.Emit("user_deleted", data)
+		logger.Info("Received user deletion from Redis", "user_id", data["id"])
+
+	case UserPrivacyChannel:
+		userID, _ := data["id"].(string)
+		refreshUserVisibility(ctx, io, userSIDMap, userSIDLock, userID)
+		logger.Info("Received privacy change from Redis", "user_id", userID)
+
+	case AircraftUpdatedChannel:
+		// Fan aircraft out to sockets watching their area
+		dispatchAircraftUpdated(data)
+
+	case AircraftRemovedChannel:
+		dispatchAircraftRemoved(data)
+
+	case TripStartedChannel:
+		userID, _ := data["user_id"].(string)
+		EmitToViewers(ctx, io, userSIDMap, userSIDLock, userID, "trip_started", data)
+		logger.Debug("Received trip start from Redis", "user_id", userID, "trip_id", data["trip_id"])
+
+	case TripEndedChannel:
+		userID, _ := data["user_id"].(string)
+		EmitToViewers(ctx, io, userSIDMap, userSIDLock, userID, "trip_ended", data)
+		logger.Debug("Received trip end from Redis", "user_id", userID, "trip_id", data["id"])
 	}
 }
@@ -0,0 +1,87 @@
+package services
+
+import (
+	"context"
+	"testing"
+
+	"github.com/tthogho1/redisconnect/go/config"
+	"github.com/tthogho1/redisconnect/go/logging"
+	"github.com/tthogho1/redisconnect/go/tracing"
+	"go.opentelemetry.io/otel"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"go.opentelemetry.io/otel/trace"
+)
+
+func TestPublishEventPropagatesTrace(t *testing.T) {
+	useTestRedis(t)
+	t.Setenv("OTEL_TRACES_EXPORTER", "none")
+	if _, err := tracing.Init(context.Background()); err != nil {
+		t.Fatalf("tracing.Init: %v", err)
+	}
+	recorder := tracetest.NewSpanRecorder()
+	provider := sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recorder))
+	previous := otel.GetTracerProvider()
+	otel.SetTracerProvider(provider)
+	t.Cleanup(func() {
+		otel.SetTracerProvider(previous)
+		provider.Shutdown(context.Background())
+	})
+
+	const channel = "tracing_test"
+	ctx := context.Background()
+	sub := config.Rdb.Subscribe(ctx, channel)
+	defer sub.Close()
+	if _, err := sub.Receive(ctx); err != nil {
+		t.Fatalf("subscribe: %v", err)
+	}
+
+	ctx = logging.WithCorrelationID(ctx, "corr-1")
+	ctx, request := tracing.Start(ctx, "request")
+	if err := PublishEvent(ctx, channel, map[string]interface{}{"id": "u1"}); err != nil {
+		t.Fatalf("PublishEvent: %v", err)
+	}
+	request.End()
+	msg, err := sub.ReceiveMessage(ctx)
+	if err != nil {
+		t.Fatalf("receive: %v", err)
+	}
+
+	// The subscriber's context continues the publisher's trace
+	data, received, err := decodeEnvelope(msg.Payload)
+	if err != nil {
+		t.Fatalf("decodeEnvelope: %v", err)
+	}
+	if _, ok := data[logging.MetaKey]; ok || data["id"] != "u1" {
+		t.Errorf("decoded %v, want the payload without its metadata", data)
+	}
+	if got := logging.CorrelationID(received); got != "corr-1" {
+		t.Errorf("correlation ID %q, want the publisher's", got)
+	}
+	remote := trace.SpanContextFromContext(received)
+	if !remote.IsRemote() || remote.TraceID() != request.SpanContext().TraceID() {
+		t.Errorf("decoded trace %s, want the publisher's %s", remote.TraceID(), request.SpanContext().TraceID())
+	}
+
+	// The receive span is a child of the publish span
+	dispatchClusterMessage(nil, nil, nil, msg)
+	spans := make(map[string]sdktrace.ReadOnlySpan)
+	for _, span := range recorder.Ended() {
+		spans[span.Name()] = span
+	}
+	publish, receive := spans["publish "+channel], spans["receive "+channel]
+	if publish == nil || receive == nil {
+		t.Fatalf("recorded %d spans, want publish and receive spans", len(spans))
+	}
+	if publish.Parent().SpanID() != request.SpanContext().SpanID() {
+		t.Errorf("publish span parent %s, want the request", publish.Parent().SpanID())
+	}
+	if receive.SpanContext().TraceID() != request.SpanContext().TraceID() ||
+		receive.Parent().SpanID() != publish.SpanContext().SpanID() || !receive.Parent().IsRemote() {
+		t.Errorf("receive span in trace %s under %s, want the publisher's trace under the publish span",
+			receive.SpanContext().TraceID(), receive.Parent().SpanID())
+	}
+	if receive.SpanKind() != trace.SpanKindConsumer || publish.SpanKind() != trace.SpanKindProducer {
+		t.Errorf("span kinds %v and %v, want producer and consumer", publish.SpanKind(), receive.SpanKind())
+	}
+}
@@ -0,0 +1,61 @@
+package services
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ErrInvalidCredential is returned for register credentials that are
+// malformed, expired or signed for another user
+var ErrInvalidCredential = errors.New("invalid credential")
+
+// ErrAuthNotConfigured is returned when AUTH_SECRET is not set, so no
+// credential can be checked
+var ErrAuthNotConfigured = errors.New("AUTH_SECRET is not set")
+
+// userCredentialMAC signs a user ID and expiry with AUTH_SECRET
+func userCredentialMAC(secret, userID, expiry string) []byte {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(userID + "\n" + expiry))
+	return mac.Sum(nil)
+}
+
+// SignUserCredential returns a credential proving its holder is userID until
+// ttl has passed: "<expiry unix seconds>.<hex HMAC-SHA256>" keyed with
+// AUTH_SECRET. The login service that knows who the user is issues it.
+func SignUserCredential(userID string, ttl time.Duration) (string, error) {
+	secret := os.Getenv("AUTH_SECRET")
+	if secret == "" {
+		return "", ErrAuthNotConfigured
+	}
+	expiry := strconv.FormatInt(time.Now().Add(ttl).Unix(), 10)
+	return expiry + "." + hex.EncodeToString(userCredentialMAC(secret, userID, expiry)), nil
+}
+
+// VerifyUserCredential checks that credential was signed for userID and has
+// not expired
+func VerifyUserCredential(userID, credential string) error {
+	secret := os.Getenv("AUTH_SECRET")
+	if secret == "" {
+		return ErrAuthNotConfigured
+	}
+	expiry, signature, ok := strings.Cut(credential, ".")
+	if !ok || userID == "" {
+		return ErrInvalidCredential
+	}
+	expiresAt, err := strconv.ParseInt(expiry, 10, 64)
+	if err != nil || time.Now().Unix() >= expiresAt {
+		return ErrInvalidCredential
+	}
+	got, err := hex.DecodeString(signature)
+	if err != nil || !hmac.Equal(got, userCredentialMAC(secret, userID, expiry)) {
+		return ErrInvalidCredential
+	}
+	return nil
+}
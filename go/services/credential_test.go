@@ -0,0 +1,44 @@
+package services
+
+import (
+	"testing"
+	"time"
+)
+
+func TestUserCredential(t *testing.T) {
+	t.Setenv("AUTH_SECRET", "")
+	if _, err := SignUserCredential("u1", time.Hour); err != ErrAuthNotConfigured {
+		t.Errorf("sign without AUTH_SECRET = %v, want ErrAuthNotConfigured", err)
+	}
+	if err := VerifyUserCredential("u1", "123.abc"); err != ErrAuthNotConfigured {
+		t.Errorf("verify without AUTH_SECRET = %v, want ErrAuthNotConfigured", err)
+	}
+
+	t.Setenv("AUTH_SECRET", "test-secret")
+	credential, err := SignUserCredential("u1", time.Hour)
+	if err != nil {
+		t.Fatalf("SignUserCredential: %v", err)
+	}
+	if err := VerifyUserCredential("u1", credential); err != nil {
+		t.Errorf("own credential rejected: %v", err)
+	}
+
+	expired, _ := SignUserCredential("u1", -time.Second)
+	for name, tc := range map[string]struct{ userID, credential string }{
+		"another user":   {"u2", credential},
+		"expired":        {"u1", expired},
+		"missing":        {"u1", ""},
+		"no signature":   {"u1", credential[:len(credential)-65]},
+		"altered expiry": {"u1", "9" + credential},
+		"empty user":     {"", credential},
+	} {
+		if err := VerifyUserCredential(tc.userID, tc.credential); err != ErrInvalidCredential {
+			t.Errorf("%s: %v, want ErrInvalidCredential", name, err)
+		}
+	}
+
+	t.Setenv("AUTH_SECRET", "rotated")
+	if err := VerifyUserCredential("u1", credential); err != ErrInvalidCredential {
+		t.Errorf("credential signed with an old secret = %v, want ErrInvalidCredential", err)
+	}
+}
@@ -1,89 +1,335 @@
 package services
 
 import (
-	"bytes"
 	"context"
+	"encoding/base64"
 	"encoding/json"
 	"errors"
 	"fmt"
-	"log"
-	"net/http"
-	"os"
+	"math"
+	"slices"
+	"sort"
+	"strings"
 
 	"github.com/tthogho1/redisconnect/go/models"
 )
 
-// graphQL request/response types scoped to this file.
+// Airport orderings for AirportsQueryVariables.OrderBy
+const (
+	AirportOrderSize     = "size"
+	AirportOrderDistance = "distance"
+)
+
+// airportTypes lists OurAirports types, largest first
+var airportTypes = []string{"large_airport", "medium_airport", "small_airport", "seaplane_base", "balloonport", "heliport", "closed"}
+
+// defaultAirportTypes excludes heliports and closed airports
+var defaultAirportTypes = airportTypes[:5]
+
+// Airport page size bounds
+const (
+	defaultAirportLimit = 500
+	maxAirportLimit     = 2000
+)
+
+// Errors returned for bad airport queries
+var (
+	ErrInvalidAirportQuery = errors.New("invalid airport query")
+	ErrTooManyAirports     = errors.New("too many airports in bounds to order by distance")
+)
+
+// AirportQuery is a validated airport search. Types are in size order.
+// West > East crosses the antimeridian.
+type AirportQuery struct {
+	South, West, North, East float64
 
-type airportsRequest struct {
-	Query string `json:"query"`
+	Types         []string
+	ScheduledOnly bool
+	HasIata       *bool // nil: either
+	Limit         int
+	OrderBy       string // AirportOrderSize or AirportOrderDistance
+	Cursor        string
+
+	// Distance origin when HasOrigin is set; otherwise the box center
+	OriginLat, OriginLon float64
+	HasOrigin            bool
 }
 
-type airportsResponse struct {
-	Data struct {
-		Airports []models.Airport `json:"airports"`
-	} `json:"data"`
-	Errors []struct {
-		Message string `json:"message"`
-	} `json:"errors"`
+func (q AirportQuery) box() geoBox {
+	return geoBox{South: q.South, West: q.West, North: q.North, East: q.East}
 }
 
-// FetchAirportsInBounds queries the Hasura GraphQL endpoint for airports within
-// the given latitude/longitude bounds and returns matching Airport records.
-// Heliports and closed airports are excluded.
-func FetchAirportsInBounds(ctx context.Context, variables models.AirportsQueryVariables) ([]models.Airport, error) {
-	query := fmt.Sprintf(`{
-  airports(where: {
-    type: { _nin: ["heliport", "closed"] },
-    latitude_deg: { _gte: %f, _lte: %f },
-    longitude_deg: { _gte: %f, _lte: %f }
-  }) {
-    name
-    type
-    iata_code
-    icao_code
-    latitude_deg
-    longitude_deg
-    home_link
-  }
-}`, variables.MinLat, variables.MaxLat, variables.MinLon, variables.MaxLon)
-
-	body, err := json.Marshal(airportsRequest{Query: query})
-	if err != nil {
-		log.Printf("airports: marshal request: %v", err)
-		return []models.Airport{}, err
+// origin returns the point distances are measured from
+func (q AirportQuery) origin() (float64, float64) {
+	if q.HasOrigin {
+		return q.OriginLat, q.OriginLon
 	}
+	lat, lon := (q.South+q.North)/2, (q.West+q.East)/2
+	if q.West > q.East {
+		lon = normalizeLon(lon + 180)
+	}
+	return lat, lon
+}
 
-	endpoint := os.Getenv("HASURA_ENDPOINT")
-	req, err := http.NewRequestWithContext(ctx, http.MethodPost, endpoint, bytes.NewReader(body))
-	if err != nil {
-		log.Printf("airports: build request: %v", err)
-		return nil, err
+// AirportPage is one page of airport results
+type AirportPage struct {
+	Airports   []models.Airport
+	NextCursor string // empty when there are no more results
+	Source     string // provider that served the page
+}
+
+// airportCursor marks the last airport returned: its ID plus its type (size
+// order) or distance (distance order)
+type airportCursor struct {
+	Order    string  `json:"o"`
+	Type     string  `json:"t,omitempty"`
+	Distance float64 `json:"d,omitempty"`
+	ID       int64   `json:"i"`
+}
+
+func encodeAirportCursor(cursor airportCursor) string {
+	data, _ := json.Marshal(cursor)
+	return base64.RawURLEncoding.EncodeToString(data)
+}
+
+func decodeAirportCursor(value, order string) (airportCursor, error) {
+	var cursor airportCursor
+	data, err := base64.RawURLEncoding.DecodeString(value)
+	if err != nil || json.Unmarshal(data, &cursor) != nil || cursor.Order != order {
+		return airportCursor{}, ErrInvalidCursor
+	}
+	return cursor, nil
+}
+
+// FetchAirportsInBounds returns one page of airports within the given
+// latitude/longitude bounds from the configured AirportProvider. Heliports
+// and closed airports are excluded unless requested. Hasura and GraphQL
+// failures are returned as *UpstreamError.
+func FetchAirportsInBounds(ctx context.Context, variables models.AirportsQueryVariables) (AirportPage, error) {
+	query := AirportQuery{
+		South:         variables.MinLat,
+		West:          variables.MinLon,
+		North:         variables.MaxLat,
+		East:          variables.MaxLon,
+		ScheduledOnly: variables.ScheduledOnly,
+		HasIata:       variables.HasIata,
+		Cursor:        variables.Cursor,
+	}
+	if query.South < -90 || query.North > 90 || query.South > query.North ||
+		query.West < -180 || query.West > 180 || query.East < -180 || query.East > 180 {
+		return AirportPage{}, ErrInvalidBounds
+	}
+
+	var err error
+	if query.Types, err = resolveAirportTypes(variables.Types); err != nil {
+		return AirportPage{}, err
+	}
+
+	query.Limit = variables.Limit
+	if query.Limit <= 0 {
+		query.Limit = defaultAirportLimit
+	}
+	if query.Limit > maxAirportLimit {
+		query.Limit = maxAirportLimit
+	}
+
+	switch strings.ToLower(variables.OrderBy) {
+	case "", AirportOrderSize:
+		query.OrderBy = AirportOrderSize
+	case AirportOrderDistance:
+		query.OrderBy = AirportOrderDistance
+	default:
+		return AirportPage{}, fmt.Errorf("%w: unknown order %q", ErrInvalidAirportQuery, variables.OrderBy)
 	}
-	req.Header.Set("Content-Type", "application/json")
-	req.Header.Set("X-Hasura-Admin-Secret", os.Getenv("HASURA_ADMIN_SECRET"))
 
-	resp, err := http.DefaultClient.Do(req)
+	return currentAirportProvider().FetchAirports(ctx, query)
+}
+
+// resolveAirportTypes validates requested types and puts them in size order,
+// defaulting to defaultAirportTypes
+func resolveAirportTypes(requested []string) ([]string, error) {
+	if len(requested) == 0 {
+		return defaultAirportTypes, nil
+	}
+	for _, airportType := range requested {
+		if !slices.Contains(airportTypes, airportType) {
+			return nil, fmt.Errorf("%w: unknown type %q", ErrInvalidAirportQuery, airportType)
+		}
+	}
+	var types []string
+	for _, airportType := range airportTypes {
+		if slices.Contains(requested, airportType) {
+			types = append(types, airportType)
+		}
+	}
+	return types, nil
+}
+
+// Nearest airport search bounds
+const (
+	defaultNearestAirports = 5
+	maxNearestAirports     = 50
+	nearestStartMeters     = 25000
+	// nearestGrowth and nearestMaxSteps take the radius from 25km past half
+	// the Earth's circumference (25,600km) in at most six queries
+	nearestGrowth   = 4
+	nearestMaxSteps = 6
+)
+
+// NearestAirports returns the n airports closest to a point by great-circle
+// distance, with distance and bearing. It searches boxes around the point,
+// growing the radius until n airports lie within it or the box covers the
+// globe. If a box holds too many airports for the provider to order, the
+// previous box's airports are returned as the best found.
+func NearestAirports(ctx context.Context, lat, lon float64, n int, types []string) (AirportPage, error) {
+	if lat < -90 || lat > 90 || lon < -180 || lon > 180 {
+		return AirportPage{}, ErrInvalidBounds
+	}
+	if n <= 0 {
+		n = defaultNearestAirports
+	}
+	if n > maxNearestAirports {
+		n = maxNearestAirports
+	}
+	types, err := resolveAirportTypes(types)
 	if err != nil {
-		log.Printf("airports: http request: %v", err)
-		return nil, err
+		return AirportPage{}, err
 	}
-	defer resp.Body.Close()
 
-	var result airportsResponse
-	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
-		log.Printf("airports: decode response: %v", err)
-		return []models.Airport{}, err
+	provider := currentAirportProvider()
+	best := AirportPage{Airports: []models.Airport{}, Source: provider.Name()}
+	radius := float64(nearestStartMeters)
+	for step := 0; step < nearestMaxSteps; step, radius = step+1, radius*nearestGrowth {
+		box := boxAround(lat, lon, radius)
+		page, err := provider.FetchAirports(ctx, AirportQuery{
+			South: box.South, West: box.West, North: box.North, East: box.East,
+			Types:     types,
+			Limit:     n,
+			OrderBy:   AirportOrderDistance,
+			OriginLat: lat,
+			OriginLon: lon,
+			HasOrigin: true,
+		})
+		if errors.Is(err, ErrTooManyAirports) {
+			break
+		}
+		if err != nil {
+			return AirportPage{}, err
+		}
+		page.NextCursor = ""
+		best = page
+		// Airports in the box corners may be farther than ones outside it,
+		// so only results within the radius are known to be nearest
+		covered := radius >= math.Pi*earthRadiusMeters
+		if covered || (len(page.Airports) == n && *page.Airports[n-1].DistanceMeters <= radius) {
+			break
+		}
 	}
+	return best, nil
+}
 
-	if len(result.Errors) > 0 {
-		log.Printf("airports: GraphQL errors: %v", result.Errors)
-		return []models.Airport{}, errors.New("GraphQL query failed")
+// AirportByCode resolves a 3-letter IATA or 4-character ICAO code. It
+// returns nil if no airport has the code.
+func AirportByCode(ctx context.Context, code string) (*models.Airport, error) {
+	code = strings.ToUpper(strings.TrimSpace(code))
+	if len(code) < 3 || len(code) > 4 || strings.IndexFunc(code, func(r rune) bool {
+		return (r < 'A' || r > 'Z') && (r < '0' || r > '9')
+	}) >= 0 {
+		return nil, fmt.Errorf("%w: code must be a 3-letter IATA or 4-character ICAO code", ErrInvalidAirportQuery)
 	}
+	return currentAirportProvider().AirportByCode(ctx, code)
+}
 
-	if result.Data.Airports == nil {
-		return []models.Airport{}, nil
+// bestAirport picks the largest (and then lowest ID) airport, so that active
+// airports win over closed ones sharing a code
+func bestAirport(airports []models.Airport) *models.Airport {
+	if len(airports) == 0 {
+		return nil
+	}
+	rank := func(airport models.Airport) int { return slices.Index(airportTypes, airport.Type) }
+	best := airports[0]
+	for _, airport := range airports[1:] {
+		if rank(airport) < rank(best) || (rank(airport) == rank(best) && airport.ID < best.ID) {
+			best = airport
+		}
 	}
+	return &best
+}
+
+// pageAirportsBySize orders airports by type rank then ID and returns the
+// page after the cursor
+func pageAirportsBySize(airports []models.Airport, query AirportQuery) (AirportPage, error) {
+	rank := func(airport models.Airport) int { return slices.Index(airportTypes, airport.Type) }
+	sort.Slice(airports, func(i, j int) bool {
+		if rank(airports[i]) != rank(airports[j]) {
+			return rank(airports[i]) < rank(airports[j])
+		}
+		return airports[i].ID < airports[j].ID
+	})
+
+	start := 0
+	if query.Cursor != "" {
+		cursor, err := decodeAirportCursor(query.Cursor, AirportOrderSize)
+		if err != nil {
+			return AirportPage{}, err
+		}
+		if !slices.Contains(query.Types, cursor.Type) {
+			// The cursor belongs to a different type filter
+			return AirportPage{}, ErrInvalidCursor
+		}
+		cursorRank := slices.Index(airportTypes, cursor.Type)
+		start = sort.Search(len(airports), func(i int) bool {
+			r := rank(airports[i])
+			return r > cursorRank || (r == cursorRank && airports[i].ID > cursor.ID)
+		})
+	}
+
+	page := AirportPage{Airports: airports[start:min(start+query.Limit, len(airports))]}
+	if start+query.Limit < len(airports) {
+		last := page.Airports[len(page.Airports)-1]
+		page.NextCursor = encodeAirportCursor(airportCursor{Order: AirportOrderSize, Type: last.Type, ID: last.ID})
+	}
+	return page, nil
+}
 
-	return result.Data.Airports, nil
+// pageAirportsByDistance orders airports by distance from the query origin
+// then ID, setting DistanceMeters and BearingDeg, and returns the page after
+// the cursor
+func pageAirportsByDistance(airports []models.Airport, query AirportQuery) (AirportPage, error) {
+	var cursor *airportCursor
+	if query.Cursor != "" {
+		decoded, err := decodeAirportCursor(query.Cursor, AirportOrderDistance)
+		if err != nil {
+			return AirportPage{}, err
+		}
+		cursor = &decoded
+	}
+
+	originLat, originLon := query.origin()
+	for i := range airports {
+		distance := HaversineMeters(originLat, originLon, airports[i].LatitudeDeg, airports[i].LongitudeDeg)
+		bearing := BearingDegrees(originLat, originLon, airports[i].LatitudeDeg, airports[i].LongitudeDeg)
+		airports[i].DistanceMeters, airports[i].BearingDeg = &distance, &bearing
+	}
+	sort.Slice(airports, func(i, j int) bool {
+		if *airports[i].DistanceMeters != *airports[j].DistanceMeters {
+			return *airports[i].DistanceMeters < *airports[j].DistanceMeters
+		}
+		return airports[i].ID < airports[j].ID
+	})
+
+	start := 0
+	if cursor != nil {
+		start = sort.Search(len(airports), func(i int) bool {
+			distance := *airports[i].DistanceMeters
+			return distance > cursor.Distance || (distance == cursor.Distance && airports[i].ID > cursor.ID)
+		})
+	}
+
+	page := AirportPage{Airports: airports[start:min(start+query.Limit, len(airports))]}
+	if start+query.Limit < len(airports) {
+		last := page.Airports[len(page.Airports)-1]
+		page.NextCursor = encodeAirportCursor(airportCursor{Order: AirportOrderDistance, Distance: *last.DistanceMeters, ID: last.ID})
+	}
+	return page, nil
 }
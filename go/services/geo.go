@@ -0,0 +1,232 @@
+package services
+
+import (
+	"math"
+	"strings"
+)
+
+const earthRadiusMeters = 6371000.0
+
+const geohashAlphabet = "0123456789bcdefghjkmnpqrstuvwxyz"
+
+// EncodeGeohash returns the geohash of a coordinate at the given precision (1-12)
+func EncodeGeohash(lat, lon float64, precision int) string {
+	latRange := [2]float64{-90, 90}
+	lonRange := [2]float64{-180, 180}
+
+	var sb strings.Builder
+	bit, ch := 0, 0
+	even := true
+	for sb.Len() < precision {
+		if even {
+			mid := (lonRange[0] + lonRange[1]) / 2
+			if lon >= mid {
+				ch |= 1 << (4 - bit)
+				lonRange[0] = mid
+			} else {
+				lonRange[1] = mid
+			}
+		} else {
+			mid := (latRange[0] + latRange[1]) / 2
+			if lat >= mid {
+				ch |= 1 << (4 - bit)
+				latRange[0] = mid
+			} else {
+				latRange[1] = mid
+			}
+		}
+		even = !even
+
+		if bit < 4 {
+			bit++
+		} else {
+			sb.WriteByte(geohashAlphabet[ch])
+			bit, ch = 0, 0
+		}
+	}
+	return sb.String()
+}
+
+// DecodeGeohash returns the center of a geohash cell and its half-sizes in degrees
+func DecodeGeohash(hash string) (lat, lon, latErr, lonErr float64) {
+	latRange := [2]float64{-90, 90}
+	lonRange := [2]float64{-180, 180}
+
+	even := true
+	for _, c := range hash {
+		idx := strings.IndexRune(geohashAlphabet, c)
+		if idx < 0 {
+			break
+		}
+		for bit := 4; bit >= 0; bit-- {
+			set := idx&(1<<bit) != 0
+			if even {
+				mid := (lonRange[0] + lonRange[1]) / 2
+				if set {
+					lonRange[0] = mid
+				} else {
+					lonRange[1] = mid
+				}
+			} else {
+				mid := (latRange[0] + latRange[1]) / 2
+				if set {
+					latRange[0] = mid
+				} else {
+					latRange[1] = mid
+				}
+			}
+			even = !even
+		}
+	}
+
+	lat = (latRange[0] + latRange[1]) / 2
+	lon = (lonRange[0] + lonRange[1]) / 2
+	return lat, lon, (latRange[1] - latRange[0]) / 2, (lonRange[1] - lonRange[0]) / 2
+}
+
+// geohashCellWidthMeters is the approximate east-west cell width at the equator per precision
+var geohashCellWidthMeters = []float64{0, 5000000, 1250000, 156000, 39100, 4890, 1220, 153, 38.2, 4.77, 1.19, 0.149, 0.0372}
+
+// GeohashPrecisionFor returns the coarsest precision whose cells are at most
+// maxCellMeters wide
+func GeohashPrecisionFor(maxCellMeters float64) int {
+	for precision := 1; precision < len(geohashCellWidthMeters); precision++ {
+		if geohashCellWidthMeters[precision] <= maxCellMeters {
+			return precision
+		}
+	}
+	return len(geohashCellWidthMeters) - 1
+}
+
+// SnapToGeohash moves a coordinate to the center of its geohash cell
+func SnapToGeohash(lat, lon float64, precision int) (float64, float64, string) {
+	hash := EncodeGeohash(lat, lon, precision)
+	snappedLat, snappedLon, _, _ := DecodeGeohash(hash)
+	return snappedLat, snappedLon, hash
+}
+
+// HaversineMeters returns the great-circle distance between two coordinates
+func HaversineMeters(lat1, lon1, lat2, lon2 float64) float64 {
+	phi1 := lat1 * math.Pi / 180
+	phi2 := lat2 * math.Pi / 180
+	dPhi := (lat2 - lat1) * math.Pi / 180
+	dLambda := (lon2 - lon1) * math.Pi / 180
+
+	a := math.Sin(dPhi/2)*math.Sin(dPhi/2) +
+		math.Cos(phi1)*math.Cos(phi2)*math.Sin(dLambda/2)*math.Sin(dLambda/2)
+	return 2 * earthRadiusMeters * math.Asin(math.Min(1, math.Sqrt(a)))
+}
+
+// geoBox is a latitude/longitude rectangle. West > East means it crosses the
+// antimeridian.
+type geoBox struct {
+	South, West, North, East float64
+}
+
+// contains reports whether a coordinate lies inside the box, edges included
+func (b geoBox) contains(lat, lon float64) bool {
+	if lat < b.South || lat > b.North {
+		return false
+	}
+	if b.West <= b.East {
+		return lon >= b.West && lon <= b.East
+	}
+	return lon >= b.West || lon <= b.East
+}
+
+// BearingDegrees returns the initial great-circle bearing from the first
+// coordinate to the second, clockwise from north in [0, 360)
+func BearingDegrees(lat1, lon1, lat2, lon2 float64) float64 {
+	phi1 := lat1 * math.Pi / 180
+	phi2 := lat2 * math.Pi / 180
+	dLambda := (lon2 - lon1) * math.Pi / 180
+
+	y := math.Sin(dLambda) * math.Cos(phi2)
+	x := math.Cos(phi1)*math.Sin(phi2) - math.Sin(phi1)*math.Cos(phi2)*math.Cos(dLambda)
+	return math.Mod(math.Atan2(y, x)*180/math.Pi+360, 360)
+}
+
+// boxAround returns the box enclosing a circle, clamped at the poles. A
+// circle reaching a pole spans every longitude.
+func boxAround(lat, lon, radiusMeters float64) geoBox {
+	dLat := radiusMeters / earthRadiusMeters * 180 / math.Pi
+	box := geoBox{South: math.Max(lat-dLat, -90), North: math.Min(lat+dLat, 90), West: -180, East: 180}
+
+	cosLat := math.Cos(lat * math.Pi / 180)
+	if cosLat > 1e-6 && box.South > -90 && box.North < 90 {
+		dLon := dLat / cosLat
+		if dLon < 180 {
+			box.West = normalizeLon(lon - dLon)
+			box.East = normalizeLon(lon + dLon)
+		}
+	}
+	return box
+}
+
+// normalizeLon wraps a longitude into [-180, 180]
+func normalizeLon(lon float64) float64 {
+	for lon > 180 {
+		lon -= 360
+	}
+	for lon < -180 {
+		lon += 360
+	}
+	return lon
+}
+
+// geohashCellDegrees returns the height and width of cells at a precision
+func geohashCellDegrees(precision int) (float64, float64) {
+	bits := 5 * precision
+	lonBits := (bits + 1) / 2
+	latBits := bits / 2
+	return 180 / math.Exp2(float64(latBits)), 360 / math.Exp2(float64(lonBits))
+}
+
+// geohashCover returns the geohash cells intersecting the box at the finest
+// precision (up to maxPrecision) that needs at most maxCells cells, or
+// precision 1 if none does, ordered north to south, then west to east.
+func geohashCover(box geoBox, maxCells, maxPrecision int) []string {
+	precision := 1
+	for p := 2; p <= maxPrecision; p++ {
+		if len(geohashCells(box, p, maxCells)) == 0 {
+			break
+		}
+		precision = p
+	}
+	return geohashCells(box, precision, -1)
+}
+
+// geohashCells lists the cells intersecting the box at a precision, or nil
+// when there are more than limit (limit < 0 means no limit)
+func geohashCells(box geoBox, precision, limit int) []string {
+	latStep, lonStep := geohashCellDegrees(precision)
+	rowCount := int(math.Round(180 / latStep))
+	colCount := int(math.Round(360 / lonStep))
+
+	index := func(value, origin, step float64, count int) int {
+		i := int(math.Floor((value - origin) / step))
+		return min(max(i, 0), count-1)
+	}
+	rowFirst := index(box.South, -90, latStep, rowCount)
+	rowLast := index(box.North, -90, latStep, rowCount)
+	colFirst := index(box.West, -180, lonStep, colCount)
+	colLast := index(box.East, -180, lonStep, colCount)
+	if colLast < colFirst {
+		colLast += colCount
+	}
+
+	rows, cols := rowLast-rowFirst+1, colLast-colFirst+1
+	if limit >= 0 && rows*cols > limit {
+		return nil
+	}
+
+	cells := make([]string, 0, rows*cols)
+	for row := rowLast; row >= rowFirst; row-- {
+		lat := -90 + (float64(row)+0.5)*latStep
+		for col := colFirst; col <= colLast; col++ {
+			lon := -180 + (float64(col%colCount)+0.5)*lonStep
+			cells = append(cells, EncodeGeohash(lat, lon, precision))
+		}
+	}
+	return cells
+}
@@ -0,0 +1,321 @@
+package services
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"slices"
+	"strings"
+
+	"github.com/tthogho1/redisconnect/go/config"
+	"github.com/tthogho1/redisconnect/go/logging"
+	"github.com/tthogho1/redisconnect/go/models"
+)
+
+// airportFields is the selection shared by every airport query
+const airportFields = `fragment airportFields on airports {
+  id
+  name
+  type
+  iata_code
+  icao_code
+  latitude_deg
+  longitude_deg
+  home_link
+}`
+
+// airportDetailFields selects the full airport record
+const airportDetailFields = `fragment airportDetailFields on airports {
+  id
+  ident
+  name
+  type
+  iata_code
+  icao_code
+  latitude_deg
+  longitude_deg
+  elevation_ft
+  municipality
+  iso_country
+  iso_region
+  scheduled_service
+  home_link
+  wikipedia_link
+}`
+
+// graphQL request/response types scoped to this file.
+
+type airportsRequest struct {
+	Query     string         `json:"query"`
+	Variables map[string]any `json:"variables,omitempty"`
+}
+
+type airportsResponse struct {
+	Data   map[string][]models.Airport `json:"data"`
+	Errors []struct {
+		Message string `json:"message"`
+	} `json:"errors"`
+}
+
+// HasuraAirportProvider queries an OurAirports table through Hasura GraphQL
+type HasuraAirportProvider struct {
+	Endpoint    string
+	AdminSecret string
+	Client      *http.Client // nil uses http.DefaultClient
+	// Fallback serves queries Hasura fails; nil returns the failure
+	Fallback AirportProvider
+}
+
+// Name implements AirportProvider
+func (p *HasuraAirportProvider) Name() string { return AirportProviderHasura }
+
+// FetchAirports implements AirportProvider, falling back when Hasura is
+// unconfigured or fails
+func (p *HasuraAirportProvider) FetchAirports(ctx context.Context, query AirportQuery) (AirportPage, error) {
+	page, err := p.fetch(ctx, query)
+	if !p.shouldFallBack(ctx, err) {
+		return page, err
+	}
+	fallbackPage, fallbackErr := p.Fallback.FetchAirports(ctx, query)
+	if p.fellBack(ctx, err, fallbackErr) {
+		return fallbackPage, nil
+	}
+	return page, err
+}
+
+// AirportByCode implements AirportProvider, falling back like FetchAirports
+func (p *HasuraAirportProvider) AirportByCode(ctx context.Context, code string) (*models.Airport, error) {
+	airport, err := p.airportByCode(ctx, code)
+	if !p.shouldFallBack(ctx, err) {
+		return airport, err
+	}
+	fallbackAirport, fallbackErr := p.Fallback.AirportByCode(ctx, code)
+	if p.fellBack(ctx, err, fallbackErr) {
+		return fallbackAirport, nil
+	}
+	return airport, err
+}
+
+// shouldFallBack reports whether a Hasura error should be retried on the
+// fallback: not for bad cursors or cancelled requests
+func (p *HasuraAirportProvider) shouldFallBack(ctx context.Context, err error) bool {
+	return err != nil && p.Fallback != nil && !errors.Is(err, ErrInvalidCursor) && ctx.Err() == nil
+}
+
+// fellBack logs the outcome of a fallback call and reports whether it succeeded
+func (p *HasuraAirportProvider) fellBack(ctx context.Context, err, fallbackErr error) bool {
+	logger := logging.FromContext(ctx)
+	if fallbackErr != nil {
+		logger.Warn("Airport fallback failed", "provider", p.Fallback.Name(), "error", fallbackErr)
+		return false
+	}
+	logger.Warn("Airports served by fallback", "provider", p.Fallback.Name(), "error", err)
+	return true
+}
+
+// airportByCode matches IATA codes, or ICAO codes and idents
+func (p *HasuraAirportProvider) airportByCode(ctx context.Context, code string) (*models.Airport, error) {
+	if p.Endpoint == "" {
+		return nil, errors.New("airports: HASURA_ENDPOINT is not set")
+	}
+
+	where := map[string]any{"iata_code": map[string]any{"_eq": code}}
+	if len(code) == 4 {
+		where = map[string]any{"_or": []any{
+			map[string]any{"icao_code": map[string]any{"_eq": code}},
+			map[string]any{"ident": map[string]any{"_eq": code}},
+		}}
+	}
+	gql := "query AirportByCode($where: airports_bool_exp!) {\n" +
+		"  t0: airports(where: $where, order_by: {id: asc}, limit: 10) { ...airportDetailFields }\n}\n" + airportDetailFields
+	data, err := p.query(ctx, gql, map[string]any{"where": where})
+	if err != nil {
+		return nil, err
+	}
+	return bestAirport(data["t0"]), nil
+}
+
+func (p *HasuraAirportProvider) fetch(ctx context.Context, query AirportQuery) (AirportPage, error) {
+	if p.Endpoint == "" {
+		return AirportPage{}, errors.New("airports: HASURA_ENDPOINT is not set")
+	}
+
+	filters := hasuraBoundsFilters(query.box())
+	if query.ScheduledOnly {
+		filters = append(filters, map[string]any{"scheduled_service": map[string]any{"_eq": "yes"}})
+	}
+	if query.HasIata != nil {
+		if *query.HasIata {
+			filters = append(filters, map[string]any{"iata_code": map[string]any{"_is_null": false, "_neq": ""}})
+		} else {
+			filters = append(filters, map[string]any{"_or": []any{
+				map[string]any{"iata_code": map[string]any{"_is_null": true}},
+				map[string]any{"iata_code": map[string]any{"_eq": ""}},
+			}})
+		}
+	}
+
+	var (
+		page AirportPage
+		err  error
+	)
+	if query.OrderBy == AirportOrderDistance {
+		page, err = p.fetchByDistance(ctx, filters, query)
+	} else {
+		page, err = p.fetchBySize(ctx, filters, query)
+	}
+	page.Source = p.Name()
+	return page, err
+}
+
+// hasuraBoundsFilters matches coordinates inside the box
+func hasuraBoundsFilters(box geoBox) []any {
+	lon := map[string]any{"longitude_deg": map[string]any{"_gte": box.West, "_lte": box.East}}
+	if box.West > box.East {
+		lon = map[string]any{"_or": []any{
+			map[string]any{"longitude_deg": map[string]any{"_gte": box.West}},
+			map[string]any{"longitude_deg": map[string]any{"_lte": box.East}},
+		}}
+	}
+	return []any{
+		map[string]any{"latitude_deg": map[string]any{"_gte": box.South, "_lte": box.North}},
+		lon,
+	}
+}
+
+// fetchBySize lists airports largest type first, then by ID. Each remaining
+// type is queried under its own alias in a single request, keyset paged on ID
+// within the cursor's type.
+func (p *HasuraAirportProvider) fetchBySize(ctx context.Context, filters []any, query AirportQuery) (AirportPage, error) {
+	types := query.Types
+	var cursor airportCursor
+	if query.Cursor != "" {
+		var err error
+		if cursor, err = decodeAirportCursor(query.Cursor, AirportOrderSize); err != nil {
+			return AirportPage{}, err
+		}
+		index := slices.Index(types, cursor.Type)
+		if index < 0 {
+			// The cursor belongs to a different type filter
+			return AirportPage{}, ErrInvalidCursor
+		}
+		types = types[index:]
+	}
+
+	var (
+		declarations = []string{"$limit: Int!"}
+		fields       []string
+		variables    = map[string]any{"limit": query.Limit + 1}
+	)
+	for i, airportType := range types {
+		where := append(slices.Clone(filters), map[string]any{"type": map[string]any{"_eq": airportType}})
+		if i == 0 && cursor.ID > 0 {
+			where = append(where, map[string]any{"id": map[string]any{"_gt": cursor.ID}})
+		}
+		variables[fmt.Sprintf("w%d", i)] = map[string]any{"_and": where}
+		declarations = append(declarations, fmt.Sprintf("$w%d: airports_bool_exp!", i))
+		fields = append(fields, fmt.Sprintf("  t%d: airports(where: $w%d, order_by: {id: asc}, limit: $limit) { ...airportFields }", i, i))
+	}
+	gql := fmt.Sprintf("query Airports(%s) {\n%s\n}\n%s", strings.Join(declarations, ", "), strings.Join(fields, "\n"), airportFields)
+
+	data, err := p.query(ctx, gql, variables)
+	if err != nil {
+		return AirportPage{}, err
+	}
+
+	page := AirportPage{Airports: []models.Airport{}}
+	for i := range types {
+		for _, airport := range data[fmt.Sprintf("t%d", i)] {
+			if len(page.Airports) == query.Limit {
+				last := page.Airports[query.Limit-1]
+				page.NextCursor = encodeAirportCursor(airportCursor{Order: AirportOrderSize, Type: last.Type, ID: last.ID})
+				return page, nil
+			}
+			page.Airports = append(page.Airports, airport)
+		}
+	}
+	return page, nil
+}
+
+// fetchByDistance lists airports nearest the box center first. Hasura cannot
+// order by distance, so every match in the box is fetched (up to
+// AIRPORTS_DISTANCE_MAX, default 5000) and sorted here.
+func (p *HasuraAirportProvider) fetchByDistance(ctx context.Context, filters []any, query AirportQuery) (AirportPage, error) {
+	if query.Cursor != "" {
+		if _, err := decodeAirportCursor(query.Cursor, AirportOrderDistance); err != nil {
+			return AirportPage{}, err
+		}
+	}
+
+	maxAirports := config.GetEnvInt("AIRPORTS_DISTANCE_MAX", 5000)
+	where := append(slices.Clone(filters), map[string]any{"type": map[string]any{"_in": query.Types}})
+	gql := "query Airports($where: airports_bool_exp!, $limit: Int!) {\n" +
+		"  t0: airports(where: $where, order_by: {id: asc}, limit: $limit) { ...airportFields }\n}\n" + airportFields
+	data, err := p.query(ctx, gql, map[string]any{"where": map[string]any{"_and": where}, "limit": maxAirports + 1})
+	if err != nil {
+		return AirportPage{}, err
+	}
+	airports := data["t0"]
+	if len(airports) > maxAirports {
+		return AirportPage{}, fmt.Errorf("%w: more than %d, narrow the bounds or filters", ErrTooManyAirports, maxAirports)
+	}
+	return pageAirportsByDistance(airports, query)
+}
+
+// query runs a GraphQL query and returns its data. Non-2xx responses and
+// GraphQL errors become *UpstreamError.
+func (p *HasuraAirportProvider) query(ctx context.Context, query string, variables map[string]any) (map[string][]models.Airport, error) {
+	logger := logging.FromContext(ctx)
+
+	body, err := json.Marshal(airportsRequest{Query: query, Variables: variables})
+	if err != nil {
+		return nil, fmt.Errorf("airports: marshal request: %w", err)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, p.Endpoint, bytes.NewReader(body))
+	if err != nil {
+		return nil, fmt.Errorf("airports: build request: %w", err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-Hasura-Admin-Secret", p.AdminSecret)
+
+	resp, err := DoUpstream(UpstreamHasura, providerClient(p.Client), req)
+	if err != nil {
+		logger.Error("airports: http request", "error", err)
+		return nil, fmt.Errorf("airports: %w", err)
+	}
+	defer resp.Body.Close()
+
+	respBody, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, fmt.Errorf("airports: read response body: %w", err)
+	}
+
+	var result airportsResponse
+	decodeErr := json.Unmarshal(respBody, &result)
+	upstreamErr := &UpstreamError{Upstream: UpstreamHasura, StatusCode: resp.StatusCode}
+	for _, graphQLErr := range result.Errors {
+		upstreamErr.Messages = append(upstreamErr.Messages, graphQLErr.Message)
+	}
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		if len(upstreamErr.Messages) == 0 && len(respBody) > 0 {
+			upstreamErr.Messages = []string{truncateBody(respBody)}
+		}
+		logger.Error("airports: http error", "status", resp.StatusCode, "messages", upstreamErr.Messages)
+		return nil, upstreamErr
+	}
+	if decodeErr != nil {
+		logger.Error("airports: decode response", "error", decodeErr)
+		return nil, fmt.Errorf("airports: decode response: %w; body=%s", decodeErr, truncateBody(respBody))
+	}
+	if len(upstreamErr.Messages) > 0 {
+		logger.Error("airports: GraphQL errors", "errors", upstreamErr.Messages)
+		return nil, upstreamErr
+	}
+	return result.Data, nil
+}
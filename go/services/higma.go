@@ -2,13 +2,16 @@ package services
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
-	"log"
+	"log/slog"
 	"net/http"
 	"os"
 	"time"
 
 	socketio "github.com/doquangtan/socketio/v4"
+	"github.com/tthogho1/redisconnect/go/config"
+	"github.com/tthogho1/redisconnect/go/logging"
 )
 
 // RegisterInitialUser registers the HIGMA user at startup
@@ -17,16 +20,15 @@ func RegisterInitialUser(io *socketio.Io) {
 	latitude := 34.7642462
 	longitude := 137.3875706
 
-	log.Printf("📝 Registering initial user: %s", userID)
+	slog.Info("Registering initial user", "user_id", userID)
 
-	DeleteUserFromRedis(userID)
+	DeleteUserFromRedis(config.Ctx, userID)
 
-	if err := SaveUserToRedis(userID, userID, latitude, longitude); err != nil {
+	if err := SaveUserToRedis(config.Ctx, userID, userID, latitude, longitude); err != nil {
 		return
 	}
 
-	log.Printf("✅ HIGMA registered without expiration")
-	log.Printf("✅ Registered initial user %s at position [%f, %f]", userID, longitude, latitude)
+	slog.Info("Registered initial user without expiration", "user_id", userID, "latitude", latitude, "longitude", longitude)
 
 	io.Emit("user_added", map[string]interface{}{
 		"id":        userID,
@@ -34,14 +36,16 @@ func RegisterInitialUser(io *socketio.Io) {
 		"latitude":  latitude,
 		"longitude": longitude,
 	})
-	log.Printf("📡 Broadcasted HIGMA user to all clients")
+	slog.Info("Broadcasted initial user to all clients", "user_id", userID)
 }
 
 // SendMessageToHIGMA sends a message to HIGMA API and returns the response
-func SendMessageToHIGMA(socket *socketio.Socket, fromUser, message, timestamp string) {
+func SendMessageToHIGMA(ctx context.Context, socket *socketio.Socket, fromUser, message, timestamp string) {
+	logger := logging.FromContext(ctx)
+
 	higmaAPIURL := os.Getenv("HIGMA_API_URL")
 	if higmaAPIURL == "" {
-		log.Println("HIGMA_API_URL not configured")
+		logger.Warn("HIGMA_API_URL not configured")
 		return
 	}
 
@@ -52,22 +56,29 @@ func SendMessageToHIGMA(socket *socketio.Socket, fromUser, message, timestamp st
 
 	jsonData, err := json.Marshal(reqBody)
 	if err != nil {
-		log.Printf("Error marshaling HIGMA request: %v", err)
+		logger.Error("Error marshaling HIGMA request", "error", err)
+		return
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, higmaAPIURL, bytes.NewBuffer(jsonData))
+	if err != nil {
+		logger.Error("Error building HIGMA request", "error", err)
 		return
 	}
+	req.Header.Set("Content-Type", "application/json")
 
-	resp, err := http.Post(higmaAPIURL, "application/json", bytes.NewBuffer(jsonData))
+	resp, err := DoUpstream(UpstreamHIGMA, http.DefaultClient, req)
 	if err != nil {
-		log.Printf("Error calling HIGMA API: %v", err)
+		logger.Error("Error calling HIGMA API", "error", err)
 		return
 	}
 	defer resp.Body.Close()
 
-	log.Printf("HIGMA API called successfully for message from %s (status: %d)", fromUser, resp.StatusCode)
+	logger.Info("HIGMA API called", "from", fromUser, "status", resp.StatusCode)
 
 	var responseData map[string]interface{}
 	if err := json.NewDecoder(resp.Body).Decode(&responseData); err != nil {
-		log.Printf("Error decoding HIGMA response: %v", err)
+		logger.Error("Error decoding HIGMA response", "error", err)
 		return
 	}
 
@@ -75,7 +86,7 @@ func SendMessageToHIGMA(socket *socketio.Socket, fromUser, message, timestamp st
 	if reply, ok := responseData["answer"].(string); ok {
 		replyMessage = reply
 	} else {
-		log.Printf("No reply message found in HIGMA response: %+v", responseData)
+		logger.Warn("No reply message found in HIGMA response", "fields", len(responseData))
 		return
 	}
 
@@ -88,5 +99,5 @@ func SendMessageToHIGMA(socket *socketio.Socket, fromUser, message, timestamp st
 		"timestamp": time.Now().Format(time.RFC3339),
 	})
 
-	log.Printf("HIGMA reply sent to %s: %s", fromUser, replyMessage)
+	logger.Info("HIGMA reply sent", "to", fromUser, "reply", replyMessage)
 }
@@ -0,0 +1,140 @@
+package services
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/tthogho1/redisconnect/go/config"
+	"github.com/tthogho1/redisconnect/go/models"
+)
+
+// radiusBucketsKm are the radii queries are rounded up to, so nearby
+// requests with slightly different radii share a cache entry
+var radiusBucketsKm = []int{1, 2, 5, 10, 20, 50, 100, 200, 500}
+
+// bucketRadiusKm rounds a radius in meters up to the next bucket
+func bucketRadiusKm(radiusMeters int) int {
+	km := int(math.Ceil(float64(radiusMeters) / 1000.0))
+	for _, bucket := range radiusBucketsKm {
+		if km <= bucket {
+			return bucket
+		}
+	}
+	return km
+}
+
+// snapForRadius snaps a coordinate to a geohash cell a quarter of the radius wide
+func snapForRadius(lat, lon float64, radiusKm int) (float64, float64, string) {
+	precision := GeohashPrecisionFor(float64(radiusKm) * 1000 / 4)
+	return SnapToGeohash(lat, lon, precision)
+}
+
+func landmarkCacheTTLs() (time.Duration, time.Duration) {
+	return config.GetEnvDuration("LANDMARK_CACHE_TTL", time.Hour),
+		config.GetEnvDuration("LANDMARK_CACHE_STALE", 24*time.Hour)
+}
+
+// cachedLandmarkTile serves one page of a provider's results for a geohash
+// cell through the cache. Cells are fixed, so every viewport covering a cell
+// shares its entries.
+func cachedLandmarkTile(ctx context.Context, provider LandmarkProvider, query LandmarkCellQuery) (landmarkTile, CacheStatus, error) {
+	key := fmt.Sprintf("cache:landmarks:tile:%s:%s:%s:%d%s", provider.Name(), query.Lang, query.Cell, query.Page, query.filter().searchKey())
+	ttl, stale := landmarkCacheTTLs()
+	return cachedFetch(ctx, key, ttl, stale, func(ctx context.Context) (landmarkTile, error) {
+		return searchProviderCell(ctx, provider, query)
+	})
+}
+
+// CachedSearchLandmarksNearby normalizes the query (coordinate snapped to a
+// geohash cell, radius bucketed) and serves it through the landmark cache.
+// With a bounding box it searches the box instead, like FetchLandmarksInBounds,
+// and with providers other than Wikipedia it searches the circle's cells.
+func CachedSearchLandmarksNearby(ctx context.Context, params models.LandmarkQueryParams) (LandmarkPage, error) {
+	if box := params.BoundingBox; box != nil {
+		vars := models.FetchLandmarksInBoundsVars{
+			MinLat:     box.South,
+			MaxLat:     box.North,
+			MinLon:     box.West,
+			MaxLon:     box.East,
+			Lang:       params.Lang,
+			Cursor:     params.Cursor,
+			Providers:  params.Providers,
+			Categories: params.Categories,
+			Keywords:   params.Keywords,
+			Exclude:    params.Exclude,
+		}
+		vars.Settings.Limit = params.Limit
+		return FetchLandmarksInBounds(ctx, vars)
+	}
+
+	radiusMeters := params.Radius
+	if radiusMeters <= 0 {
+		radiusMeters = 10000
+	}
+
+	providers, err := selectLandmarkProviders(params.Providers)
+	if err != nil {
+		return LandmarkPage{}, err
+	}
+	if len(providers) > 1 || providers[0].Name() != ProviderWikipedia {
+		return searchLandmarksInRadius(ctx, params, float64(radiusMeters))
+	}
+	radiusKm := bucketRadiusKm(radiusMeters)
+
+	normalized := params
+	normalized.Lang = ResolveWikiLang(params.Lang)
+	var cell string
+	normalized.Lat, normalized.Lon, cell = snapForRadius(params.Lat, params.Lon, radiusKm)
+	normalized.Radius = radiusKm * 1000
+
+	filter := newLandmarkFilter(params.Categories, params.Keywords, params.Exclude)
+	normalized.Categories, normalized.Keywords, normalized.Exclude = nil, nil, nil
+	key := fmt.Sprintf("cache:landmarks:nearby:%s:%s:%d:%d%s", normalized.Lang, cell, radiusKm, params.Limit, filter.searchKey())
+	ttl, stale := landmarkCacheTTLs()
+	landmarks, status, err := cachedFetch(ctx, key, ttl, stale, func(ctx context.Context) ([]models.Landmark, error) {
+		return searchLandmarksNearby(ctx, normalized, filter)
+	})
+	// The entry is for the snapped center and bucketed radius, so results are
+	// cut back to the requested circle; classes are filtered after the cache
+	// too so every class shares one entry
+	limit := params.Limit
+	if limit <= 0 {
+		limit = 10
+	}
+	kept := make([]models.Landmark, 0, len(landmarks))
+	for _, landmark := range landmarks {
+		if len(kept) == limit {
+			break
+		}
+		if HaversineMeters(params.Lat, params.Lon, landmark.Lat, landmark.Lon) <= float64(radiusMeters) &&
+			filter.keepClass(landmark) {
+			kept = append(kept, landmark)
+		}
+	}
+	return LandmarkPage{Landmarks: kept, Cache: status}, err
+}
+
+// CachedFetchLandmarkDetails serves landmark details through the cache.
+// Details change rarely, so they use LANDMARK_DETAILS_CACHE_TTL (default 24h).
+func CachedFetchLandmarkDetails(ctx context.Context, params models.LandmarkDetailsParams) (*models.Landmark, CacheStatus, error) {
+	params, err := normalizeDetailsParams(params)
+	if err != nil {
+		return nil, CacheMiss, err
+	}
+	key := fmt.Sprintf("cache:landmarks:details:%s:%d", params.Lang, params.PageID)
+	if params.PageID <= 0 {
+		key = fmt.Sprintf("cache:landmarks:details:%s:title:%s", params.Lang, url.QueryEscape(params.Title))
+	}
+	if len(params.Fields) > 0 {
+		key += fmt.Sprintf(":%s:%v:%d", strings.Join(params.Fields, ","), params.ImageSizes, params.ImageLimit)
+	}
+	ttl := config.GetEnvDuration("LANDMARK_DETAILS_CACHE_TTL", 24*time.Hour)
+	_, stale := landmarkCacheTTLs()
+	return cachedFetch(ctx, key, ttl, stale, func(ctx context.Context) (*models.Landmark, error) {
+		return FetchLandmarkDetails(ctx, params)
+	})
+}
@@ -0,0 +1,219 @@
+package services
+
+import (
+	"fmt"
+	"regexp"
+	"slices"
+	"sort"
+	"strings"
+	"unicode"
+
+	"github.com/tthogho1/redisconnect/go/models"
+)
+
+// Normalized landmark classes, for map icons and filtering
+const (
+	ClassStation  = "station"
+	ClassMuseum   = "museum"
+	ClassShrine   = "shrine"
+	ClassTemple   = "temple"
+	ClassChurch   = "church"
+	ClassCastle   = "castle"
+	ClassZoo      = "zoo"
+	ClassStadium  = "stadium"
+	ClassTower    = "tower"
+	ClassBridge   = "bridge"
+	ClassPark     = "park"
+	ClassMountain = "mountain"
+	ClassWater    = "water"
+	ClassMonument = "monument"
+	ClassHistoric = "historic"
+	ClassOther    = "other"
+)
+
+// classRule assigns a class when any keyword appears in a category name or
+// description. ASCII keywords must start a word ("bridge" does not match
+// "Cambridge").
+type classRule struct {
+	class    string
+	keywords []string
+	pattern  *regexp.Regexp
+}
+
+// landmarkClassRules are checked in order; the first match wins
+var landmarkClassRules = compileClassRules([]classRule{
+	{class: ClassStation, keywords: []string{"railway station", "train station", "metro station", "subway station", "駅"}},
+	{class: ClassMuseum, keywords: []string{"museum", "art gallery", "博物館", "美術館", "資料館", "記念館"}},
+	{class: ClassShrine, keywords: []string{"shrine", "神社", "神宮", "大社"}},
+	{class: ClassTemple, keywords: []string{"temple", "monaster", "寺院", "寺", "仏閣"}},
+	{class: ClassChurch, keywords: []string{"church", "cathedral", "basilica", "chapel", "mosque", "教会", "大聖堂"}},
+	{class: ClassCastle, keywords: []string{"castle", "palace", "城郭", "日本の城", "城跡", "宮殿"}},
+	{class: ClassZoo, keywords: []string{"zoo", "aquarium", "動物園", "水族館"}},
+	{class: ClassStadium, keywords: []string{"stadium", "arena", "スタジアム", "競技場", "球場"}},
+	{class: ClassTower, keywords: []string{"tower", "タワー", "塔"}},
+	{class: ClassBridge, keywords: []string{"bridge", "橋"}},
+	{class: ClassPark, keywords: []string{"park", "garden", "公園", "庭園"}},
+	{class: ClassMountain, keywords: []string{"mountain", "volcano", "山岳", "火山", "日本の山"}},
+	{class: ClassWater, keywords: []string{"lake", "river", "waterfall", "湖", "河川", "滝"}},
+	{class: ClassMonument, keywords: []string{"monument", "memorial", "statue", "記念碑", "銅像"}},
+	{class: ClassHistoric, keywords: []string{"historic site", "ruins", "heritage", "archaeological", "史跡", "遺跡", "文化財"}},
+})
+
+// landmarkClasses lists every class accepted in filters
+var landmarkClasses = func() []string {
+	classes := []string{ClassOther}
+	for _, rule := range landmarkClassRules {
+		classes = append(classes, rule.class)
+	}
+	return classes
+}()
+
+func compileClassRules(rules []classRule) []classRule {
+	for i, rule := range rules {
+		parts := make([]string, len(rule.keywords))
+		for j, keyword := range rule.keywords {
+			parts[j] = regexp.QuoteMeta(keyword)
+			if isASCII(keyword) {
+				parts[j] = `\b` + parts[j]
+			}
+		}
+		rules[i].pattern = regexp.MustCompile(`(?i)` + strings.Join(parts, "|"))
+	}
+	return rules
+}
+
+func isASCII(s string) bool {
+	for _, r := range s {
+		if r > unicode.MaxASCII {
+			return false
+		}
+	}
+	return true
+}
+
+// classifyLandmark picks a class from category names first, then the
+// description and title
+func classifyLandmark(categories []string, description, title string) string {
+	for _, texts := range [][]string{categories, {description}, {title}} {
+		for _, rule := range landmarkClassRules {
+			for _, text := range texts {
+				if text != "" && rule.pattern.MatchString(text) {
+					return rule.class
+				}
+			}
+		}
+	}
+	return ClassOther
+}
+
+// landmarkFilter is a normalized set of category, keyword and exclude filters.
+// Known class names filter on Landmark.Class for every provider; other
+// category names are wiki categories, which only Wikipedia can match.
+type landmarkFilter struct {
+	Classes           []string
+	ExcludeClasses    []string
+	Categories        []string
+	ExcludeCategories []string
+	Keywords          []string
+	ExcludeKeywords   []string
+}
+
+// newLandmarkFilter sorts and dedupes the request filters and splits class
+// names from wiki category names. Exclude entries that are not classes are
+// excluded both as categories and as keywords.
+func newLandmarkFilter(categories, keywords, exclude []string) landmarkFilter {
+	var filter landmarkFilter
+	for _, value := range categories {
+		value = strings.TrimSpace(value)
+		if class := strings.ToLower(value); slices.Contains(landmarkClasses, class) {
+			filter.Classes = append(filter.Classes, class)
+		} else if value != "" {
+			filter.Categories = append(filter.Categories, value)
+		}
+	}
+	for _, value := range exclude {
+		value = strings.TrimSpace(value)
+		if class := strings.ToLower(value); slices.Contains(landmarkClasses, class) {
+			filter.ExcludeClasses = append(filter.ExcludeClasses, class)
+		} else if value != "" {
+			filter.ExcludeCategories = append(filter.ExcludeCategories, value)
+			filter.ExcludeKeywords = append(filter.ExcludeKeywords, value)
+		}
+	}
+	for _, value := range keywords {
+		if value = strings.TrimSpace(value); value != "" {
+			filter.Keywords = append(filter.Keywords, value)
+		}
+	}
+
+	for _, list := range []*[]string{&filter.Classes, &filter.ExcludeClasses, &filter.Categories,
+		&filter.ExcludeCategories, &filter.Keywords, &filter.ExcludeKeywords} {
+		sort.Strings(*list)
+		*list = slices.Compact(*list)
+	}
+	return filter
+}
+
+// searchKey identifies the provider-side part of the filter in cache keys
+func (f landmarkFilter) searchKey() string {
+	if len(f.Categories)+len(f.ExcludeCategories)+len(f.Keywords)+len(f.ExcludeKeywords) == 0 {
+		return ""
+	}
+	return fmt.Sprintf("%q%q%q%q", f.Categories, f.ExcludeCategories, f.Keywords, f.ExcludeKeywords)
+}
+
+// cirrusClauses translates the filter to CirrusSearch syntax: one category
+// becomes deepcat: (subcategories included), several an incategory: OR list;
+// keywords are ORed; excludes are negated.
+func (f landmarkFilter) cirrusClauses() string {
+	var clauses []string
+	switch len(f.Categories) {
+	case 0:
+	case 1:
+		clauses = append(clauses, fmt.Sprintf("deepcat:%q", f.Categories[0]))
+	default:
+		clauses = append(clauses, fmt.Sprintf("incategory:%q", strings.Join(f.Categories, "|")))
+	}
+	for _, category := range f.ExcludeCategories {
+		clauses = append(clauses, fmt.Sprintf("-incategory:%q", category))
+	}
+	for _, keyword := range f.ExcludeKeywords {
+		clauses = append(clauses, fmt.Sprintf("-%q", keyword))
+	}
+	if len(f.Keywords) > 0 {
+		quoted := make([]string, len(f.Keywords))
+		for i, keyword := range f.Keywords {
+			quoted[i] = fmt.Sprintf("%q", keyword)
+		}
+		clauses = append(clauses, strings.Join(quoted, " OR "))
+	}
+	return strings.Join(clauses, " ")
+}
+
+// keepClass reports whether a landmark passes the class filters
+func (f landmarkFilter) keepClass(landmark models.Landmark) bool {
+	if len(f.Classes) > 0 && !slices.Contains(f.Classes, landmark.Class) {
+		return false
+	}
+	return !slices.Contains(f.ExcludeClasses, landmark.Class)
+}
+
+// matchesText reports whether a title or description passes the keyword
+// filters, for providers without full-text search
+func (f landmarkFilter) matchesText(texts ...string) bool {
+	joined := strings.ToLower(strings.Join(texts, " "))
+	for _, keyword := range f.ExcludeKeywords {
+		if strings.Contains(joined, strings.ToLower(keyword)) {
+			return false
+		}
+	}
+	if len(f.Keywords) == 0 {
+		return true
+	}
+	for _, keyword := range f.Keywords {
+		if strings.Contains(joined, strings.ToLower(keyword)) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,234 @@
+package services
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/url"
+	"regexp"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/tthogho1/redisconnect/go/models"
+)
+
+// Optional landmark detail fields, selected with LandmarkDetailsParams.Fields
+const (
+	FieldExtract    = "extract"
+	FieldImages     = "images"
+	FieldCategories = "categories"
+	FieldURL        = "url"
+	FieldWikidata   = "wikidata"
+	FieldModified   = "modified"
+)
+
+var landmarkDetailFields = []string{FieldExtract, FieldImages, FieldCategories, FieldURL, FieldWikidata, FieldModified}
+
+// Image size and count bounds for detail requests
+const (
+	minImageWidth     = 20
+	maxImageWidth     = 2000
+	maxImageSizes     = 4
+	defaultImageLimit = 10
+	maxImageLimit     = 50
+)
+
+var defaultImageSizes = []int{200, 800}
+
+// galleryMimeTypes are the image types listed in galleries; SVGs are mostly
+// icons, maps and flags
+var galleryMimeTypes = map[string]bool{"image/jpeg": true, "image/png": true, "image/webp": true}
+
+// ErrInvalidFields is returned for unknown detail fields or image sizes
+var ErrInvalidFields = errors.New("invalid fields")
+
+// thumbWidthPattern matches the width segment of a Wikimedia thumbnail URL
+var thumbWidthPattern = regexp.MustCompile(`/\d+px-([^/]+)$`)
+
+// normalizeDetailsParams resolves the language, validates, sorts and dedupes
+// the fields ("all" selects every field) and applies image defaults, so equal
+// requests share a cache entry.
+func normalizeDetailsParams(params models.LandmarkDetailsParams) (models.LandmarkDetailsParams, error) {
+	params.Lang = ResolveWikiLang(params.Lang)
+
+	var fields []string
+	for _, field := range params.Fields {
+		field = strings.ToLower(strings.TrimSpace(field))
+		switch {
+		case field == "all":
+			fields = append(fields, landmarkDetailFields...)
+		case slices.Contains(landmarkDetailFields, field):
+			fields = append(fields, field)
+		default:
+			return params, fmt.Errorf("%w: unknown field %q", ErrInvalidFields, field)
+		}
+	}
+	sort.Strings(fields)
+	params.Fields = slices.Compact(fields)
+
+	if !slices.Contains(params.Fields, FieldImages) {
+		params.ImageSizes, params.ImageLimit = nil, 0
+		return params, nil
+	}
+
+	sizes := slices.Clone(params.ImageSizes)
+	if len(sizes) == 0 {
+		sizes = slices.Clone(defaultImageSizes)
+	}
+	for _, size := range sizes {
+		if size < minImageWidth || size > maxImageWidth {
+			return params, fmt.Errorf("%w: image size %d outside %d-%d", ErrInvalidFields, size, minImageWidth, maxImageWidth)
+		}
+	}
+	sort.Ints(sizes)
+	sizes = slices.Compact(sizes)
+	if len(sizes) > maxImageSizes {
+		return params, fmt.Errorf("%w: at most %d image sizes", ErrInvalidFields, maxImageSizes)
+	}
+	params.ImageSizes = sizes
+
+	if params.ImageLimit <= 0 {
+		params.ImageLimit = defaultImageLimit
+	}
+	if params.ImageLimit > maxImageLimit {
+		params.ImageLimit = maxImageLimit
+	}
+	return params, nil
+}
+
+// addDetailProps requests the page props backing the given fields
+func addDetailProps(q url.Values, fields []string) {
+	props := []string{q.Get("prop")}
+	for _, field := range fields {
+		switch field {
+		case FieldExtract:
+			props = append(props, "extracts")
+			q.Set("exintro", "1")
+			q.Set("explaintext", "1")
+		case FieldImages:
+			// The gallery is fetched separately; pageimage orders it
+			q.Set("piprop", "thumbnail|name")
+		case FieldCategories:
+			// categories are always requested by wikimediaQuery
+		case FieldURL:
+			props = append(props, "info")
+			q.Set("inprop", "url")
+		case FieldWikidata:
+			// pageprops are always requested by wikimediaQuery
+		case FieldModified:
+			props = append(props, "revisions")
+			q.Set("rvprop", "timestamp")
+		}
+	}
+	q.Set("prop", strings.Join(props, "|"))
+}
+
+// applyDetails copies the requested detail props onto a landmark
+func applyDetails(lm *models.Landmark, page wmPage, fields []string) {
+	for _, field := range fields {
+		switch field {
+		case FieldExtract:
+			if extract := strings.TrimSpace(page.Extract); extract != "" {
+				lm.Extract = &extract
+			}
+		case FieldCategories:
+			lm.Categories = []string{}
+			for _, category := range page.Categories {
+				lm.Categories = append(lm.Categories, stripNamespace(category.Title))
+			}
+		case FieldURL:
+			if page.CanonicalURL != "" {
+				canonical := page.CanonicalURL
+				lm.URL = &canonical
+			}
+		case FieldModified:
+			if len(page.Revisions) > 0 {
+				if modified, err := time.Parse(time.RFC3339, page.Revisions[0].Timestamp); err == nil {
+					lm.LastModified = &modified
+				}
+			}
+		}
+	}
+}
+
+// fetchLandmarkImages lists the photos used on a page, the page's lead image
+// first, with a thumbnail per requested width
+func fetchLandmarkImages(ctx context.Context, endpoint, title, pageImage string, sizes []int, limit int) ([]models.LandmarkImage, error) {
+	q := url.Values{}
+	q.Set("generator", "images")
+	q.Set("titles", title)
+	// Over-fetch since icons and diagrams are filtered out
+	q.Set("gimlimit", strconv.Itoa(limit*2))
+	q.Set("prop", "imageinfo")
+	q.Set("iiprop", "url|size|mime")
+	q.Set("iiurlwidth", strconv.Itoa(sizes[0]))
+
+	result, _, err := wikimediaQueryPages(ctx, endpoint, q)
+	if err != nil {
+		return nil, err
+	}
+
+	lead := normalizeFileName(pageImage)
+	files := make([]wmPage, 0, len(result.Pages))
+	for _, page := range result.Pages {
+		if len(page.ImageInfo) > 0 && galleryMimeTypes[page.ImageInfo[0].Mime] {
+			files = append(files, page)
+		}
+	}
+	sort.Slice(files, func(i, j int) bool {
+		iLead := normalizeFileName(files[i].Title) == lead
+		jLead := normalizeFileName(files[j].Title) == lead
+		if iLead != jLead {
+			return iLead
+		}
+		return files[i].Title < files[j].Title
+	})
+	if len(files) > limit {
+		files = files[:limit]
+	}
+
+	images := make([]models.LandmarkImage, 0, len(files))
+	for _, file := range files {
+		info := file.ImageInfo[0]
+		image := models.LandmarkImage{
+			Title:  stripNamespace(file.Title),
+			URL:    info.URL,
+			Width:  info.Width,
+			Height: info.Height,
+		}
+		for _, size := range sizes {
+			image.Thumbnails = append(image.Thumbnails, models.ImageThumbnail{
+				Width: min(size, info.Width),
+				URL:   thumbnailURL(info, size),
+			})
+		}
+		images = append(images, image)
+	}
+	return images, nil
+}
+
+// thumbnailURL returns the URL of an image scaled to width. Wikimedia serves
+// any width by rewriting the thumbnail path; images narrower than the width
+// are returned at original size.
+func thumbnailURL(info wmImageInfo, width int) string {
+	if width >= info.Width || !thumbWidthPattern.MatchString(info.ThumbURL) {
+		return info.URL
+	}
+	return thumbWidthPattern.ReplaceAllString(info.ThumbURL, "/"+strconv.Itoa(width)+"px-$1")
+}
+
+// stripNamespace removes a "Category:" or "File:" style prefix
+func stripNamespace(title string) string {
+	if _, name, ok := strings.Cut(title, ":"); ok {
+		return name
+	}
+	return title
+}
+
+// normalizeFileName makes "File:Foo bar.jpg" and "Foo_bar.jpg" compare equal
+func normalizeFileName(name string) string {
+	return strings.ReplaceAll(stripNamespace(name), "_", " ")
+}
@@ -0,0 +1,270 @@
+package services
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"slices"
+	"strings"
+	"sync"
+	"unicode"
+
+	"github.com/tthogho1/redisconnect/go/config"
+	"github.com/tthogho1/redisconnect/go/models"
+)
+
+// Landmark provider names, as used in requests and Landmark.Sources
+const (
+	ProviderWikipedia = "wikipedia"
+	ProviderWikidata  = "wikidata"
+	ProviderOverpass  = "osm"
+)
+
+// mergeDistanceMeters is how close two landmarks without a shared Wikidata ID
+// must be to be considered the same place
+const mergeDistanceMeters = 150
+
+// mergeNameSimilarity is the minimum name similarity (0-1) for merging by proximity
+const mergeNameSimilarity = 0.8
+
+// ErrUnknownProvider is returned when a request names an unregistered provider
+var ErrUnknownProvider = errors.New("unknown landmark provider")
+
+// LandmarkCellQuery asks a provider for one page of landmarks inside a
+// geohash cell
+type LandmarkCellQuery struct {
+	Cell string // geohash
+	Lang string // resolved wiki language for titles and descriptions
+	Page int    // 0-based
+
+	// Search filters. Providers that cannot match wiki categories return
+	// nothing when Categories is set.
+	Categories        []string // wiki category names, any of
+	ExcludeCategories []string
+	Keywords          []string // any of
+	ExcludeKeywords   []string
+}
+
+// filter returns the query's search filters
+func (q LandmarkCellQuery) filter() landmarkFilter {
+	return landmarkFilter{
+		Categories:        q.Categories,
+		ExcludeCategories: q.ExcludeCategories,
+		Keywords:          q.Keywords,
+		ExcludeKeywords:   q.ExcludeKeywords,
+	}
+}
+
+// LandmarkProvider is a source of landmarks. Providers search one geohash
+// cell at a time so that results can be cached per cell and paged by cursor.
+type LandmarkProvider interface {
+	// Name identifies the provider in requests, cache keys and Landmark.Sources
+	Name() string
+	// SearchCell returns one page of landmarks for the cell and whether more
+	// pages follow. Results outside the cell are dropped by the caller.
+	SearchCell(ctx context.Context, query LandmarkCellQuery) ([]models.Landmark, bool, error)
+}
+
+var (
+	landmarkProviders     map[string]LandmarkProvider
+	landmarkProvidersLock sync.RWMutex
+	landmarkProvidersOnce sync.Once
+)
+
+// loadLandmarkProviders registers the built-in providers, with endpoints from
+// WIKIPEDIA_API_URL, WIKIDATA_SPARQL_URL and OVERPASS_URL
+func loadLandmarkProviders() {
+	landmarkProviders = map[string]LandmarkProvider{
+		ProviderWikipedia: &WikipediaProvider{},
+		ProviderWikidata: &WikidataProvider{
+			BaseURL: config.GetEnv("WIKIDATA_SPARQL_URL", defaultWikidataSPARQLURL),
+		},
+		ProviderOverpass: &OverpassProvider{
+			BaseURL: config.GetEnv("OVERPASS_URL", defaultOverpassURL),
+		},
+	}
+}
+
+// RegisterLandmarkProvider adds a provider or replaces the one with the same
+// name, e.g. to point a built-in provider at a fixture server
+func RegisterLandmarkProvider(provider LandmarkProvider) {
+	landmarkProvidersOnce.Do(loadLandmarkProviders)
+	landmarkProvidersLock.Lock()
+	defer landmarkProvidersLock.Unlock()
+	landmarkProviders[provider.Name()] = provider
+}
+
+// selectLandmarkProviders resolves requested provider names, defaulting to
+// LANDMARK_PROVIDERS (default "wikipedia"). Earlier providers win when
+// merging duplicate landmarks.
+func selectLandmarkProviders(names []string) ([]LandmarkProvider, error) {
+	landmarkProvidersOnce.Do(loadLandmarkProviders)
+	if len(names) == 0 {
+		names = strings.Split(config.GetEnv("LANDMARK_PROVIDERS", ProviderWikipedia), ",")
+	}
+
+	landmarkProvidersLock.RLock()
+	defer landmarkProvidersLock.RUnlock()
+
+	var providers []LandmarkProvider
+	seen := make(map[string]bool)
+	for _, name := range names {
+		name = strings.ToLower(strings.TrimSpace(name))
+		if name == "" || seen[name] {
+			continue
+		}
+		provider, ok := landmarkProviders[name]
+		if !ok {
+			return nil, fmt.Errorf("%w: %q", ErrUnknownProvider, name)
+		}
+		seen[name] = true
+		providers = append(providers, provider)
+	}
+	if len(providers) == 0 {
+		return nil, fmt.Errorf("%w: none selected", ErrUnknownProvider)
+	}
+	return providers, nil
+}
+
+// providerNames returns the names of providers, in order
+func providerNames(providers []LandmarkProvider) []string {
+	names := make([]string, len(providers))
+	for i, provider := range providers {
+		names[i] = provider.Name()
+	}
+	return names
+}
+
+func providerClient(client *http.Client) *http.Client {
+	if client == nil {
+		return http.DefaultClient
+	}
+	return client
+}
+
+// mergeLandmarks combines provider results, in priority order. Landmarks are
+// the same place when they share a Wikidata ID, or lie within
+// mergeDistanceMeters with similar names; the earlier entry is kept and
+// missing fields are filled from the later one.
+func mergeLandmarks(groups [][]models.Landmark) []models.Landmark {
+	var merged []models.Landmark
+	for _, group := range groups {
+		for _, candidate := range group {
+			if i := findSameLandmark(merged, candidate); i >= 0 {
+				fillLandmark(&merged[i], candidate)
+				continue
+			}
+			merged = append(merged, candidate)
+		}
+	}
+	return merged
+}
+
+func findSameLandmark(landmarks []models.Landmark, candidate models.Landmark) int {
+	for i, existing := range landmarks {
+		if existing.WikidataID != nil && candidate.WikidataID != nil {
+			if *existing.WikidataID == *candidate.WikidataID {
+				return i
+			}
+			continue
+		}
+		if HaversineMeters(existing.Lat, existing.Lon, candidate.Lat, candidate.Lon) <= mergeDistanceMeters &&
+			nameSimilarity(existing.Title, candidate.Title) >= mergeNameSimilarity {
+			return i
+		}
+	}
+	return -1
+}
+
+// fillLandmark copies fields missing from dst and records the extra sources
+func fillLandmark(dst *models.Landmark, src models.Landmark) {
+	if dst.PageID == 0 {
+		dst.PageID = src.PageID
+	}
+	if dst.Class == "" || dst.Class == ClassOther {
+		dst.Class = src.Class
+	}
+	if dst.ThumbnailURL == nil {
+		dst.ThumbnailURL, dst.ThumbnailWidth, dst.ThumbnailHeight = src.ThumbnailURL, src.ThumbnailWidth, src.ThumbnailHeight
+	}
+	if dst.Description == nil {
+		dst.Description = src.Description
+	}
+	if dst.WikidataID == nil {
+		dst.WikidataID = src.WikidataID
+	}
+	if dst.OSMID == nil {
+		dst.OSMID = src.OSMID
+	}
+	if dst.URL == nil {
+		dst.URL = src.URL
+	}
+	if len(dst.LangLinks) == 0 {
+		dst.LangLinks = src.LangLinks
+	}
+	for _, source := range src.Sources {
+		if !slices.Contains(dst.Sources, source) {
+			dst.Sources = append(dst.Sources, source)
+		}
+	}
+}
+
+// landmarkKey identifies a landmark across pages and providers
+func landmarkKey(landmark models.Landmark) string {
+	switch {
+	case landmark.WikidataID != nil:
+		return "wikidata:" + *landmark.WikidataID
+	case landmark.PageID > 0:
+		return fmt.Sprintf("wikipedia:%s:%d", landmark.Lang, landmark.PageID)
+	case landmark.OSMID != nil:
+		return "osm:" + *landmark.OSMID
+	}
+	return fmt.Sprintf("%s@%f,%f", landmark.Title, landmark.Lat, landmark.Lon)
+}
+
+// nameSimilarity compares names ignoring case, spaces and punctuation: 1 when
+// one contains the other (and is at least 3 characters), otherwise
+// 1 - edit distance / longer length
+func nameSimilarity(a, b string) float64 {
+	ra, rb := normalizeName(a), normalizeName(b)
+	if len(ra) == 0 || len(rb) == 0 {
+		return 0
+	}
+	if min(len(ra), len(rb)) >= 3 &&
+		(strings.Contains(string(ra), string(rb)) || strings.Contains(string(rb), string(ra))) {
+		return 1
+	}
+	return 1 - float64(editDistance(ra, rb))/float64(max(len(ra), len(rb)))
+}
+
+func normalizeName(name string) []rune {
+	var runes []rune
+	for _, r := range strings.ToLower(name) {
+		if unicode.IsLetter(r) || unicode.IsNumber(r) {
+			runes = append(runes, r)
+		}
+	}
+	return runes
+}
+
+// editDistance is the Levenshtein distance between two rune slices
+func editDistance(a, b []rune) int {
+	prev := make([]int, len(b)+1)
+	curr := make([]int, len(b)+1)
+	for j := range prev {
+		prev[j] = j
+	}
+	for i := 1; i <= len(a); i++ {
+		curr[0] = i
+		for j := 1; j <= len(b); j++ {
+			cost := 1
+			if a[i-1] == b[j-1] {
+				cost = 0
+			}
+			curr[j] = min(prev[j]+1, curr[j-1]+1, prev[j-1]+cost)
+		}
+		prev, curr = curr, prev
+	}
+	return prev[len(b)]
+}
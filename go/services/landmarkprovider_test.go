@@ -0,0 +1,213 @@
+package services
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/tthogho1/redisconnect/go/models"
+)
+
+// testCell is the geohash cell around Tokyo Tower the fixtures were recorded for
+var testCell = EncodeGeohash(35.6586, 139.7454, 5)
+
+// serveFixture answers every request with a file from testdata, after
+// checking the request with check
+func serveFixture(t *testing.T, check func(r *http.Request) string) *httptest.Server {
+	t.Helper()
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, err := os.ReadFile(filepath.Join("testdata", check(r)))
+		if err != nil {
+			t.Errorf("read fixture: %v", err)
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Write(body)
+	}))
+	t.Cleanup(server.Close)
+	return server
+}
+
+func landmarkTitles(landmarks []models.Landmark) string {
+	titles := make([]string, len(landmarks))
+	for i, landmark := range landmarks {
+		titles[i] = landmark.Title
+	}
+	return strings.Join(titles, ", ")
+}
+
+func TestWikipediaProviderSearchCell(t *testing.T) {
+	requests := 0
+	server := serveFixture(t, func(r *http.Request) string {
+		requests++
+		q := r.URL.Query()
+		if r.URL.Path != "/en/w/api.php" {
+			t.Errorf("path %s, want the en wiki's endpoint", r.URL.Path)
+		}
+		if q.Get("generator") != "search" || q.Get("gsroffset") != "50" ||
+			!strings.HasPrefix(q.Get("gsrsearch"), "nearcoord:") {
+			t.Errorf("unexpected search parameters: %s", r.URL.RawQuery)
+		}
+		// The first response leaves langlinks pending
+		if q.Get("llcontinue") != "" {
+			return "wikipedia_search_continue.json"
+		}
+		return "wikipedia_search.json"
+	})
+
+	provider := &WikipediaProvider{URLTemplate: server.URL + "/%s/w/api.php"}
+	landmarks, more, err := provider.SearchCell(context.Background(), LandmarkCellQuery{Cell: testCell, Lang: "en", Page: 1})
+	if err != nil {
+		t.Fatalf("SearchCell: %v", err)
+	}
+	if requests != 2 {
+		t.Errorf("made %d requests, want 2 to follow the langlinks continuation", requests)
+	}
+	if !more {
+		t.Error("more = false, want true while the search continues")
+	}
+	// The page without coordinates is dropped; the rest keep search order
+	if got := landmarkTitles(landmarks); got != "Tokyo Tower, Zōjō-ji" {
+		t.Fatalf("landmarks %q, want Tokyo Tower, Zōjō-ji", got)
+	}
+
+	tower := landmarks[0]
+	if tower.PageID != 1234 || tower.Lat != 35.658581 || tower.Lon != 139.745433 {
+		t.Errorf("tower = page %d at %v,%v", tower.PageID, tower.Lat, tower.Lon)
+	}
+	if tower.WikidataID == nil || *tower.WikidataID != "Q183536" {
+		t.Errorf("tower Wikidata ID %v, want Q183536", tower.WikidataID)
+	}
+	if tower.ThumbnailWidth == nil || *tower.ThumbnailWidth != 200 {
+		t.Errorf("tower thumbnail width %v, want 200", tower.ThumbnailWidth)
+	}
+	if len(tower.LangLinks) != 2 {
+		t.Errorf("tower has %d language links, want both batches merged: %+v", len(tower.LangLinks), tower.LangLinks)
+	}
+	if tower.Class != ClassTower || landmarks[1].Class != ClassTemple {
+		t.Errorf("classes %q, %q, want %q, %q", tower.Class, landmarks[1].Class, ClassTower, ClassTemple)
+	}
+}
+
+func TestWikidataProviderSearchCell(t *testing.T) {
+	server := serveFixture(t, func(r *http.Request) string {
+		if r.Method != http.MethodPost || r.Header.Get("Accept") != "application/sparql-results+json" {
+			t.Errorf("%s with Accept %q, want a SPARQL JSON POST", r.Method, r.Header.Get("Accept"))
+		}
+		if sparql := r.FormValue("query"); !strings.Contains(sparql, "LIMIT 50 OFFSET 0") ||
+			!strings.Contains(sparql, "<https://en.wikipedia.org/>") {
+			t.Errorf("unexpected query:\n%s", sparql)
+		}
+		return "wikidata_cell.json"
+	})
+
+	provider := &WikidataProvider{BaseURL: server.URL}
+	landmarks, more, err := provider.SearchCell(context.Background(), LandmarkCellQuery{Cell: testCell, Lang: "en"})
+	if err != nil {
+		t.Fatalf("SearchCell: %v", err)
+	}
+	if more {
+		t.Error("more = true for a short page")
+	}
+	// Repeated rows collapse, and items labelled with their ID are dropped
+	if got := landmarkTitles(landmarks); got != "Tokyo Tower, Zōjō-ji" {
+		t.Fatalf("landmarks %q, want Tokyo Tower, Zōjō-ji", got)
+	}
+
+	tower := landmarks[0]
+	if tower.Lat != 35.658581 || tower.Lon != 139.745433 {
+		t.Errorf("tower at %v,%v, want the WKT point's lat and lon", tower.Lat, tower.Lon)
+	}
+	if tower.URL == nil || *tower.URL != "https://en.wikipedia.org/wiki/Tokyo_Tower" {
+		t.Errorf("tower URL %v", tower.URL)
+	}
+	if tower.ThumbnailURL == nil || !strings.HasSuffix(*tower.ThumbnailURL, "?width=200") {
+		t.Errorf("tower thumbnail %v, want a 200px FilePath URL", tower.ThumbnailURL)
+	}
+	if landmarks[1].ThumbnailURL != nil {
+		t.Errorf("temple thumbnail %v, want none", *landmarks[1].ThumbnailURL)
+	}
+
+	// Keywords are matched against the label and description
+	landmarks, _, err = provider.SearchCell(context.Background(),
+		LandmarkCellQuery{Cell: testCell, Lang: "en", Keywords: []string{"temple"}})
+	if err != nil {
+		t.Fatalf("SearchCell with keywords: %v", err)
+	}
+	if got := landmarkTitles(landmarks); got != "Zōjō-ji" {
+		t.Errorf("keyword search returned %q, want Zōjō-ji", got)
+	}
+}
+
+func TestOverpassProviderSearchCell(t *testing.T) {
+	server := serveFixture(t, func(r *http.Request) string {
+		if ql := r.FormValue("data"); !strings.HasPrefix(ql, "[out:json]") || !strings.Contains(ql, "out center tags 100;") {
+			t.Errorf("unexpected query:\n%s", ql)
+		}
+		return "overpass_cell.json"
+	})
+
+	provider := &OverpassProvider{BaseURL: server.URL}
+	landmarks, more, err := provider.SearchCell(context.Background(), LandmarkCellQuery{Cell: testCell, Lang: "en"})
+	if err != nil {
+		t.Fatalf("SearchCell: %v", err)
+	}
+	if more {
+		t.Error("more = true, but Overpass results are not paged")
+	}
+	// Elements without a name are dropped; names prefer the query language
+	if got := landmarkTitles(landmarks); got != "Tokyo Tower, Zōjō-ji, Memorial to the Sakhalin Telegraph Operators" {
+		t.Fatalf("landmarks %q", got)
+	}
+
+	for i, want := range []struct {
+		osmID, class string
+		lat          float64
+	}{
+		{"way/26606328", ClassTower, 35.6585696},
+		{"node/1682745311", ClassTemple, 35.6574185},
+		{"node/5873216810", ClassMonument, 35.6563},
+	} {
+		landmark := landmarks[i]
+		if landmark.OSMID == nil || *landmark.OSMID != want.osmID || landmark.Class != want.class || landmark.Lat != want.lat {
+			t.Errorf("%s = %v, %q at %v; want %s, %q at %v",
+				landmark.Title, landmark.OSMID, landmark.Class, landmark.Lat, want.osmID, want.class, want.lat)
+		}
+	}
+	// Only a wikipedia tag in the query language gives an article URL
+	if url := landmarks[0].URL; url == nil || *url != "https://en.wikipedia.org/wiki/Tokyo_Tower" {
+		t.Errorf("tower URL %v", url)
+	}
+	if landmarks[1].URL != nil {
+		t.Errorf("temple URL %q, want none for a ja article", *landmarks[1].URL)
+	}
+
+	// Later pages are empty without a request
+	landmarks, _, err = provider.SearchCell(context.Background(), LandmarkCellQuery{Cell: testCell, Lang: "en", Page: 1})
+	if err != nil || len(landmarks) != 0 {
+		t.Errorf("page 1 = %d landmarks, %v; want none", len(landmarks), err)
+	}
+}
+
+func TestLandmarkProviderHTTPError(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "rate limited", http.StatusTooManyRequests)
+	}))
+	defer server.Close()
+
+	for _, provider := range []LandmarkProvider{
+		&WikipediaProvider{URLTemplate: server.URL + "/%s"},
+		&WikidataProvider{BaseURL: server.URL},
+		&OverpassProvider{BaseURL: server.URL},
+	} {
+		_, _, err := provider.SearchCell(context.Background(), LandmarkCellQuery{Cell: testCell, Lang: "en"})
+		if err == nil || !strings.Contains(err.Error(), "http 429") {
+			t.Errorf("%s: error %v, want http 429", provider.Name(), err)
+		}
+	}
+}
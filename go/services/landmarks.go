@@ -2,135 +2,284 @@ package services
 
 import (
 	"context"
+	"encoding/base64"
 	"encoding/json"
+	"errors"
 	"fmt"
-	"io"
-	"log"
-	"math"
-	"net/http"
-	"net/url"
-	"strconv"
+	"slices"
 	"strings"
+	"sync"
 
+	"github.com/tthogho1/redisconnect/go/logging"
 	"github.com/tthogho1/redisconnect/go/models"
 )
 
-// FetchLandmarksInBounds queries the Wikimedia API for pages near the
-// geographic bounds and returns a slice of Landmark with coordinates,
-// thumbnail and description.
-func FetchLandmarksInBounds(ctx context.Context, vars models.FetchLandmarksInBoundsVars) ([]models.Landmark, error) {
-	centerLat := (vars.MinLat + vars.MaxLat) / 2.0
-	centerLon := (vars.MinLon + vars.MaxLon) / 2.0
+// landmarkTilePageSize is how many search results are requested per tile page
+const landmarkTilePageSize = 50
 
-	radiusMeters := vars.Settings.Radius
-	if radiusMeters <= 0 {
-		radiusMeters = 50000 // default 50km
-	}
-	radiusKm := int(math.Round(float64(radiusMeters) / 1000.0))
-	if radiusKm < 1 {
-		radiusKm = 1
-	}
+// maxLandmarkTiles bounds how many geohash cells a box is split into
+const maxLandmarkTiles = 9
 
-	limit := vars.Settings.Limit
-	if limit <= 0 {
-		limit = 10
-	}
-	if limit > 50 {
-		limit = 50
-	}
+// maxLandmarkTilePrecision keeps cells at least about 1km wide, since smaller
+// searches gain nothing and fragment the cache
+const maxLandmarkTilePrecision = 6
 
-	log.Printf("FetchLandmarksInBounds: vars=%+v center=(%f,%f) radiusMeters=%d radiusKm=%d limit=%d",
-		vars, centerLat, centerLon, radiusMeters, radiusKm, limit)
+// maxLandmarkTilePages bounds the tile pages read for one request; the
+// cursor resumes from where the request stopped
+const maxLandmarkTilePages = 8
 
-	gsrsearch := fmt.Sprintf(
-		"nearcoord:%dkm,%f,%f hastemplate:\"Coord\"",
-		radiusKm,
-		centerLat,
-		centerLon,
-	)
+// Errors returned for bad bounds queries
+var (
+	ErrInvalidBounds = errors.New("invalid bounds")
+	ErrInvalidCursor = errors.New("invalid cursor")
+)
 
-	q := url.Values{}
-	q.Set("action", "query")
-	q.Set("generator", "search")
-	q.Set("gsrsearch", gsrsearch)
-	q.Set("gsrlimit", strconv.Itoa(limit))
-	q.Set("prop", "coordinates|description|pageimages")
-	q.Set("piprop", "thumbnail")
-	q.Set("pithumbsize", "200")
-	q.Set("format", "json")
-	q.Set("origin", "*")
+// LandmarkPage is one page of landmark results
+type LandmarkPage struct {
+	Landmarks  []models.Landmark
+	NextCursor string      // empty when there are no more results
+	Cache      CacheStatus // how the underlying search results were served
+}
 
-	reqURL := WikimediaBaseURL + "?" + q.Encode()
+// landmarkTile is one page of a provider's results inside a geohash cell
+type landmarkTile struct {
+	Landmarks []models.Landmark `json:"landmarks"`
+	More      bool              `json:"more"` // whether the provider has further pages
+}
 
-	log.Printf("FetchLandmarksInBounds: reqURL=%s", reqURL)
+// landmarkCursor marks a position: a cell, a page within it and the number
+// of matching results of that page already returned
+type landmarkCursor struct {
+	Cell string `json:"c"`
+	Page int    `json:"p"`
+	Skip int    `json:"s"`
+}
 
-	req, err := http.NewRequestWithContext(ctx, http.MethodGet, reqURL, nil)
-	if err != nil {
-		return []models.Landmark{}, fmt.Errorf("landmarks: build request: %w", err)
+func encodeLandmarkCursor(cursor landmarkCursor) string {
+	data, _ := json.Marshal(cursor)
+	return base64.RawURLEncoding.EncodeToString(data)
+}
+
+func decodeLandmarkCursor(value string) (landmarkCursor, error) {
+	var cursor landmarkCursor
+	data, err := base64.RawURLEncoding.DecodeString(value)
+	if err != nil || json.Unmarshal(data, &cursor) != nil || cursor.Page < 0 || cursor.Skip < 0 {
+		return landmarkCursor{}, ErrInvalidCursor
 	}
-	req.Header.Set("Accept", "application/json")
-	req.Header.Set("User-Agent", "redisconnect/0.1 (github.com/tthogho1/redisconnect; contact:tthogho1@gmail.com)")
+	return cursor, nil
+}
 
-	resp, err := http.DefaultClient.Do(req)
-	if err != nil {
-		return []models.Landmark{}, fmt.Errorf("landmarks: http request: %w", err)
+// boundsBox validates the bounds; MinLon > MaxLon crosses the antimeridian
+func boundsBox(vars models.FetchLandmarksInBoundsVars) (geoBox, error) {
+	box := geoBox{South: vars.MinLat, West: vars.MinLon, North: vars.MaxLat, East: vars.MaxLon}
+	if box.South < -90 || box.North > 90 || box.South > box.North ||
+		box.West < -180 || box.West > 180 || box.East < -180 || box.East > 180 {
+		return geoBox{}, ErrInvalidBounds
 	}
-	defer resp.Body.Close()
+	return box, nil
+}
 
-	// Read response body for logging and robust decode errors.
-	bodyBytes, err := io.ReadAll(resp.Body)
+// landmarkSearch holds the options of a cell-based landmark search
+type landmarkSearch struct {
+	Box       geoBox
+	Lang      string
+	Providers []string
+	Cursor    string
+	Limit     int
+	Filter    landmarkFilter
+	// Keep filters results further, e.g. to a radius; nil keeps everything in Box
+	Keep func(models.Landmark) bool
+}
+
+// FetchLandmarksInBounds returns landmarks strictly inside the bounds from the
+// selected providers. NextCursor continues the listing.
+func FetchLandmarksInBounds(ctx context.Context, vars models.FetchLandmarksInBoundsVars) (LandmarkPage, error) {
+	box, err := boundsBox(vars)
 	if err != nil {
-		return []models.Landmark{}, fmt.Errorf("landmarks: read response body: %w", err)
+		return LandmarkPage{}, err
 	}
+	return searchLandmarkCells(ctx, landmarkSearch{
+		Box:       box,
+		Lang:      vars.Lang,
+		Providers: vars.Providers,
+		Cursor:    vars.Cursor,
+		Limit:     vars.Settings.Limit,
+		Filter:    newLandmarkFilter(vars.Categories, vars.Keywords, vars.Exclude),
+	})
+}
 
-	log.Printf("FetchLandmarksInBounds: http status=%d body=%s", resp.StatusCode, strings.TrimSpace(string(bodyBytes)))
+// searchLandmarksInRadius searches the cells around a circle, keeping
+// landmarks within the radius
+func searchLandmarksInRadius(ctx context.Context, params models.LandmarkQueryParams, radiusMeters float64) (LandmarkPage, error) {
+	if params.Lat < -90 || params.Lat > 90 || params.Lon < -180 || params.Lon > 180 {
+		return LandmarkPage{}, ErrInvalidBounds
+	}
+	return searchLandmarkCells(ctx, landmarkSearch{
+		Box:       boxAround(params.Lat, params.Lon, radiusMeters),
+		Lang:      params.Lang,
+		Providers: params.Providers,
+		Cursor:    params.Cursor,
+		Limit:     params.Limit,
+		Filter:    newLandmarkFilter(params.Categories, params.Keywords, params.Exclude),
+		Keep: func(landmark models.Landmark) bool {
+			return HaversineMeters(params.Lat, params.Lon, landmark.Lat, landmark.Lon) <= radiusMeters
+		},
+	})
+}
 
-	if resp.StatusCode != http.StatusOK {
-		return []models.Landmark{}, fmt.Errorf("landmarks: http %d: %s", resp.StatusCode, strings.TrimSpace(string(bodyBytes)))
+// searchLandmarkCells splits the box into geohash cells and walks them page by
+// page. Each page merges every provider's results for the cell; a landmark
+// belongs to the one cell containing it, so results never repeat across
+// cells. Cell pages are cached per provider.
+func searchLandmarkCells(ctx context.Context, search landmarkSearch) (LandmarkPage, error) {
+	limit := search.Limit
+	if limit <= 0 {
+		limit = 10
+	}
+	if limit > 50 {
+		limit = 50
 	}
 
-	var result wmResponse
-	if err := json.Unmarshal(bodyBytes, &result); err != nil {
-		return []models.Landmark{}, fmt.Errorf("landmarks: decode response: %w; body=%s", err, strings.TrimSpace(string(bodyBytes)))
+	providers, err := selectLandmarkProviders(search.Providers)
+	if err != nil {
+		return LandmarkPage{}, err
 	}
 
-	if result.Query == nil {
-		return []models.Landmark{}, nil
+	lang := ResolveWikiLang(search.Lang)
+	cells := geohashCover(search.Box, maxLandmarkTiles, maxLandmarkTilePrecision)
+
+	cursor := landmarkCursor{Cell: cells[0]}
+	if search.Cursor != "" {
+		if cursor, err = decodeLandmarkCursor(search.Cursor); err != nil {
+			return LandmarkPage{}, err
+		}
+	}
+	cellIndex := slices.Index(cells, cursor.Cell)
+	if cellIndex < 0 {
+		// The cursor belongs to different bounds
+		return LandmarkPage{}, ErrInvalidCursor
 	}
 
-	landmarks := make([]models.Landmark, 0, len(result.Query.Pages))
-	for _, page := range result.Query.Pages {
-		if len(page.Coordinates) == 0 {
-			continue
+	logging.FromContext(ctx).Debug("Landmark cell search", "lang", lang, "providers", providerNames(providers),
+		"cells", len(cells), "cell", cursor.Cell, "page", cursor.Page, "limit", limit)
+
+	page := LandmarkPage{Landmarks: []models.Landmark{}, Cache: CacheHit}
+	seen := make(map[string]bool)
+	for pages := 0; ; pages++ {
+		if len(page.Landmarks) == limit || pages == maxLandmarkTilePages {
+			page.NextCursor = encodeLandmarkCursor(cursor)
+			return page, nil
 		}
 
-		landmark := models.Landmark{
-			PageID: page.PageID,
-			Title:  page.Title,
-			Lat:    page.Coordinates[0].Lat,
-			Lon:    page.Coordinates[0].Lon,
+		landmarks, more, status, err := fetchMergedCellPage(ctx, providers, LandmarkCellQuery{
+			Cell:              cursor.Cell,
+			Lang:              lang,
+			Page:              cursor.Page,
+			Categories:        search.Filter.Categories,
+			ExcludeCategories: search.Filter.ExcludeCategories,
+			Keywords:          search.Filter.Keywords,
+			ExcludeKeywords:   search.Filter.ExcludeKeywords,
+		})
+		if err != nil {
+			return LandmarkPage{}, fmt.Errorf("landmarks: %w", err)
 		}
+		page.Cache = combineCacheStatus(page.Cache, status)
 
-		if page.Thumbnail != nil {
-			src := page.Thumbnail.Source
-			w := page.Thumbnail.Width
-			h := page.Thumbnail.Height
-			landmark.ThumbnailURL = &src
-			landmark.ThumbnailWidth = &w
-			landmark.ThumbnailHeight = &h
+		matching := make([]models.Landmark, 0, len(landmarks))
+		for _, landmark := range landmarks {
+			if search.Box.contains(landmark.Lat, landmark.Lon) && search.Filter.keepClass(landmark) &&
+				(search.Keep == nil || search.Keep(landmark)) {
+				matching = append(matching, landmark)
+			}
 		}
+		for i := cursor.Skip; i < len(matching); i++ {
+			if len(page.Landmarks) == limit {
+				cursor.Skip = i
+				page.NextCursor = encodeLandmarkCursor(cursor)
+				return page, nil
+			}
+			key := landmarkKey(matching[i])
+			if seen[key] {
+				continue
+			}
+			seen[key] = true
+			page.Landmarks = append(page.Landmarks, matching[i])
+		}
+
+		if more {
+			cursor = landmarkCursor{Cell: cursor.Cell, Page: cursor.Page + 1}
+			continue
+		}
+		cellIndex++
+		if cellIndex == len(cells) {
+			return page, nil
+		}
+		cursor = landmarkCursor{Cell: cells[cellIndex]}
+	}
+}
+
+// fetchMergedCellPage queries every provider for a cell page concurrently and
+// merges the results. A failing provider is skipped unless all of them fail.
+func fetchMergedCellPage(ctx context.Context, providers []LandmarkProvider, query LandmarkCellQuery) ([]models.Landmark, bool, CacheStatus, error) {
+	tiles := make([]landmarkTile, len(providers))
+	statuses := make([]CacheStatus, len(providers))
+	errs := make([]error, len(providers))
+
+	var wg sync.WaitGroup
+	for i, provider := range providers {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			tiles[i], statuses[i], errs[i] = cachedLandmarkTile(ctx, provider, query)
+		}()
+	}
+	wg.Wait()
 
-		if page.Description != "" {
-			desc := page.Description
-			landmark.Description = &desc
+	status := CacheHit
+	more := false
+	var groups [][]models.Landmark
+	var failed []error
+	for i, provider := range providers {
+		if errs[i] != nil {
+			logging.FromContext(ctx).Warn("Landmark provider failed", "provider", provider.Name(), "cell", query.Cell, "error", errs[i])
+			failed = append(failed, errs[i])
+			continue
 		}
+		status = combineCacheStatus(status, statuses[i])
+		more = more || tiles[i].More
+		groups = append(groups, tiles[i].Landmarks)
+	}
+	if len(failed) == len(providers) {
+		return nil, false, CacheMiss, errors.Join(failed...)
+	}
+	return mergeLandmarks(groups), more, status, nil
+}
 
-		landmarks = append(landmarks, landmark)
+// searchProviderCell runs a provider's cell search, keeping only landmarks
+// inside the cell
+func searchProviderCell(ctx context.Context, provider LandmarkProvider, query LandmarkCellQuery) (landmarkTile, error) {
+	landmarks, more, err := provider.SearchCell(ctx, query)
+	if err != nil {
+		return landmarkTile{}, fmt.Errorf("%s: %w", provider.Name(), err)
 	}
 
-	if len(landmarks) > limit {
-		landmarks = landmarks[:limit]
+	tile := landmarkTile{Landmarks: []models.Landmark{}, More: more}
+	for _, landmark := range landmarks {
+		if EncodeGeohash(landmark.Lat, landmark.Lon, len(query.Cell)) == query.Cell {
+			tile.Landmarks = append(tile.Landmarks, landmark)
+		}
 	}
+	return tile, nil
+}
+
+// maxErrorBodyBytes bounds how much of an upstream body is quoted in errors
+const maxErrorBodyBytes = 512
 
-	return landmarks, nil
+// truncateBody returns a trimmed, length-limited copy of an upstream body
+func truncateBody(body []byte) string {
+	text := strings.TrimSpace(string(body))
+	if len(text) > maxErrorBodyBytes {
+		return text[:maxErrorBodyBytes] + "..."
+	}
+	return text
 }
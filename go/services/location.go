@@ -0,0 +1,145 @@
+package services
+
+import (
+	"context"
+	"errors"
+	"math"
+	"strconv"
+	"time"
+
+	"github.com/tthogho1/redisconnect/go/config"
+	"github.com/tthogho1/redisconnect/go/models"
+)
+
+// ErrInvalidLocation is returned for location updates without a user ID or
+// with coordinates out of range
+var ErrInvalidLocation = errors.New("invalid location")
+
+// Bounds for deriving speed and heading from the previous fix
+const (
+	// maxDeriveGap skips derivation when the previous fix is older than this
+	maxDeriveGap = 5 * time.Minute
+	// minHeadingMeters is the least movement a heading is derived from, since
+	// GPS noise makes the bearing of shorter moves meaningless
+	minHeadingMeters = 5.0
+)
+
+// ProcessLocation saves a user's position and publishes it to every instance,
+// which emit it to their clients as user_updated. It is the shared path for
+// Socket.IO clients and device feeds, and returns the published payload.
+//
+// Telemetry out of range is dropped. A missing timestamp, or one further in
+// the future than LOCATION_MAX_CLOCK_SKEW, is set to the receive time. The
+// position then goes through the location filter, which may smooth it, flag
+// it (the payload's "flag" field) or not apply it (*LocationRejection).
+// Missing speed and heading are derived from the user's previous fix. Applied
+// fixes feed trip detection.
+func ProcessLocation(ctx context.Context, location models.LocationData) (map[string]interface{}, error) {
+	// Written so that NaN coordinates fail the range checks
+	if location.ID == "" || !(location.Latitude >= -90 && location.Latitude <= 90) ||
+		!(location.Longitude >= -180 && location.Longitude <= 180) {
+		return nil, ErrInvalidLocation
+	}
+
+	sanitizeTelemetry(&location.Telemetry)
+	// A fix dated ahead of the server clock would pass the speed check and
+	// make every later fix look out of order, so it is taken as received now
+	now := time.Now().UnixMilli()
+	if location.Timestamp == nil || *location.Timestamp > now+currentLocationFilter().MaxClockSkew.Milliseconds() {
+		location.Timestamp = &now
+	}
+	flag, err := filterLocation(ctx, &location)
+	if err != nil {
+		return nil, err
+	}
+	if location.Speed == nil || location.Heading == nil {
+		deriveMotion(ctx, &location)
+	}
+
+	if err := SaveLocationToRedis(ctx, location); err != nil {
+		return nil, err
+	}
+
+	locationData := locationPayload(location)
+	if flag != "" {
+		locationData["flag"] = flag
+	}
+	PublishEvent(ctx, UserLocationChannel, locationData)
+	trackTrips(ctx, location)
+	return locationData, nil
+}
+
+// sanitizeTelemetry drops values no device reports, such as the NaN heading
+// of a stationary browser
+func sanitizeTelemetry(telemetry *models.Telemetry) {
+	for _, check := range []struct {
+		value    **float64
+		min, max float64
+	}{
+		{&telemetry.Speed, 0, math.MaxFloat64},
+		{&telemetry.Heading, 0, 360},
+		{&telemetry.Accuracy, 0, math.MaxFloat64},
+		{&telemetry.Battery, 0, 100},
+		{&telemetry.Altitude, -math.MaxFloat64, math.MaxFloat64},
+	} {
+		// NaN and infinities fail the range check
+		if v := *check.value; v != nil && !(*v >= check.min && *v <= check.max) {
+			*check.value = nil
+		}
+	}
+	if telemetry.Heading != nil && *telemetry.Heading == 360 {
+		zero := 0.0
+		telemetry.Heading = &zero
+	}
+	if telemetry.Timestamp != nil && *telemetry.Timestamp <= 0 {
+		telemetry.Timestamp = nil
+	}
+}
+
+// deriveMotion fills in missing speed and heading from the distance and time
+// since the user's previous fix
+func deriveMotion(ctx context.Context, location *models.LocationData) {
+	previous, err := config.Rdb.HMGet(ctx, "user_info:"+location.ID, "latitude", "longitude", "timestamp").Result()
+	if err != nil || len(previous) != 3 {
+		return
+	}
+	values := make([]float64, 3)
+	for i, value := range previous {
+		s, ok := value.(string)
+		if !ok {
+			return
+		}
+		if values[i], err = strconv.ParseFloat(s, 64); err != nil {
+			return
+		}
+	}
+	elapsed := time.Duration(*location.Timestamp-int64(values[2])) * time.Millisecond
+	if elapsed <= 0 || elapsed > maxDeriveGap {
+		return
+	}
+
+	distance := HaversineMeters(values[0], values[1], location.Latitude, location.Longitude)
+	if location.Speed == nil {
+		speed := distance / elapsed.Seconds()
+		location.Speed = &speed
+	}
+	if location.Heading == nil && distance >= minHeadingMeters {
+		heading := BearingDegrees(values[0], values[1], location.Latitude, location.Longitude)
+		location.Heading = &heading
+	}
+}
+
+// locationPayload is the user_updated payload for a location, with the
+// telemetry it carries
+func locationPayload(location models.LocationData) map[string]interface{} {
+	locationData := map[string]interface{}{
+		"id":        location.ID,
+		"name":      location.Name,
+		"latitude":  location.Latitude,
+		"longitude": location.Longitude,
+	}
+	for field, value := range telemetryFields(location.Telemetry) {
+		locationData[field] = value
+	}
+	return locationData
+}
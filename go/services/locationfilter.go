@@ -0,0 +1,328 @@
+package services
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"hash/fnv"
+	"math"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+	"github.com/tthogho1/redisconnect/go/config"
+	"github.com/tthogho1/redisconnect/go/logging"
+	"github.com/tthogho1/redisconnect/go/metrics"
+	"github.com/tthogho1/redisconnect/go/models"
+)
+
+// Location filter results, as counted in metrics
+const (
+	LocationAccepted = "accepted"
+	LocationFlagged  = "flagged"
+	LocationHeld     = "held"
+	LocationRejected = "rejected"
+)
+
+// Reasons the location filter flags, holds or rejects an update
+const (
+	ReasonLowAccuracy      = "low_accuracy"
+	ReasonImplausibleSpeed = "implausible_speed"
+	ReasonOutOfOrder       = "out_of_order"
+)
+
+// Smoothing filters for LOCATION_SMOOTHING
+const (
+	SmoothingOff     = "off"
+	SmoothingKalman  = "kalman"
+	SmoothingAverage = "average"
+)
+
+// LocationRejection is returned by ProcessLocation for updates the filter did
+// not apply. Held updates are kept and applied if the next fix confirms them.
+type LocationRejection struct {
+	Reason string
+	Held   bool
+}
+
+func (e *LocationRejection) Error() string {
+	if e.Held {
+		return "location held: " + e.Reason
+	}
+	return "location rejected: " + e.Reason
+}
+
+// locationFilterConfig is read from the environment once
+type locationFilterConfig struct {
+	Smoothing       string
+	AverageWindow   int
+	KalmanNoise     float64 // expected speed changes, meters per second
+	DefaultAccuracy float64 // meters, for fixes without accuracy
+	MaxAccuracy     float64 // meters; 0 accepts any accuracy
+	MaxSpeed        float64 // meters per second; 0 disables the check
+	SpeedAction     string  // hold, flag or reject
+	MaxClockSkew    time.Duration
+	StateTTL        time.Duration
+}
+
+var (
+	locationFilterSettings locationFilterConfig
+	locationFilterOnce     sync.Once
+)
+
+func currentLocationFilter() locationFilterConfig {
+	locationFilterOnce.Do(func() {
+		locationFilterSettings = locationFilterConfig{
+			Smoothing:       strings.ToLower(config.GetEnv("LOCATION_SMOOTHING", SmoothingOff)),
+			AverageWindow:   max(config.GetEnvInt("LOCATION_AVERAGE_WINDOW", 5), 1),
+			KalmanNoise:     config.GetEnvFloat("LOCATION_KALMAN_NOISE", 3),
+			DefaultAccuracy: config.GetEnvFloat("LOCATION_DEFAULT_ACCURACY", 20),
+			MaxAccuracy:     config.GetEnvFloat("LOCATION_MAX_ACCURACY", 1000),
+			MaxSpeed:        config.GetEnvFloat("LOCATION_MAX_SPEED", 340),
+			SpeedAction:     strings.ToLower(config.GetEnv("LOCATION_SPEED_ACTION", "hold")),
+			MaxClockSkew:    config.GetEnvDuration("LOCATION_MAX_CLOCK_SKEW", 30*time.Second),
+			StateTTL:        config.GetEnvDuration("LOCATION_STATE_TTL", 10*time.Minute),
+		}
+	})
+	return locationFilterSettings
+}
+
+// locationFix is a raw position with its accuracy and time
+type locationFix struct {
+	Latitude  float64 `json:"lat"`
+	Longitude float64 `json:"lon"`
+	Accuracy  float64 `json:"acc"`
+	Timestamp int64   `json:"ts"` // Unix milliseconds
+}
+
+// locationFilterState is kept per user in location_filter:{id}
+type locationFilterState struct {
+	Last locationFix  `json:"last"`           // last applied raw fix
+	Held *locationFix `json:"held,omitempty"` // implausible fix awaiting confirmation
+
+	// Kalman estimate and its variance in square meters
+	Latitude  float64 `json:"k_lat,omitempty"`
+	Longitude float64 `json:"k_lon,omitempty"`
+	Variance  float64 `json:"k_var,omitempty"`
+
+	// Recent raw positions for the moving average
+	Window [][2]float64 `json:"window,omitempty"`
+}
+
+func locationFilterKey(userID string) string {
+	return "location_filter:" + userID
+}
+
+// maxLocationFilterAttempts bounds retries when another instance changes a
+// user's filter state between reading and writing it
+const maxLocationFilterAttempts = 5
+
+// locationFilterLocks serialize a user's updates on this instance, striped by
+// user ID, so WATCH only has to settle races between instances
+var locationFilterLocks [64]sync.Mutex
+
+func locationFilterLock(userID string) *sync.Mutex {
+	h := fnv.New32a()
+	h.Write([]byte(userID))
+	return &locationFilterLocks[h.Sum32()%uint32(len(locationFilterLocks))]
+}
+
+// locationVerdict is the filter's decision on a fix given the user's state
+type locationVerdict struct {
+	Latitude, Longitude float64
+	Flag                string
+	Rejection           *LocationRejection
+	State               *locationFilterState // to save, nil to leave as is
+}
+
+// filterLocation checks an update against the user's previous fix, smooths
+// its position in place, and returns a flag reason for suspicious updates
+// that are still applied. Updates it does not apply return *LocationRejection.
+// A user's fixes are judged one at a time: the state is read and written
+// under a per-user lock, in a WATCH transaction retried if another instance
+// commits first.
+func filterLocation(ctx context.Context, location *models.LocationData) (string, error) {
+	cfg := currentLocationFilter()
+	if cfg.Smoothing == SmoothingOff && cfg.MaxAccuracy <= 0 && cfg.MaxSpeed <= 0 {
+		return "", nil
+	}
+
+	fix := locationFix{
+		Latitude:  location.Latitude,
+		Longitude: location.Longitude,
+		Accuracy:  cfg.DefaultAccuracy,
+		Timestamp: *location.Timestamp,
+	}
+	if location.Accuracy != nil {
+		fix.Accuracy = *location.Accuracy
+		if cfg.MaxAccuracy > 0 && fix.Accuracy > cfg.MaxAccuracy {
+			return "", rejectLocation(ReasonLowAccuracy, false)
+		}
+	}
+
+	lock := locationFilterLock(location.ID)
+	lock.Lock()
+	defer lock.Unlock()
+
+	logger := logging.FromContext(ctx)
+	key := locationFilterKey(location.ID)
+	var verdict *locationVerdict
+	update := func(tx *redis.Tx) error {
+		state, err := loadLocationFilterState(ctx, tx, key)
+		if err != nil {
+			// Without history, apply the fix rather than lose it
+			logger.Warn("Could not load location filter state", "user_id", location.ID, "error", err)
+		}
+		verdict = judgeLocation(cfg, state, fix)
+		if verdict.State == nil {
+			return nil
+		}
+		data, err := json.Marshal(verdict.State)
+		if err != nil {
+			return err
+		}
+		_, err = tx.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+			pipe.Set(ctx, key, data, cfg.StateTTL)
+			return nil
+		})
+		return err
+	}
+	for attempt := 1; ; attempt++ {
+		err := config.Rdb.Watch(ctx, update, key)
+		if err == redis.TxFailedErr && attempt < maxLocationFilterAttempts {
+			continue
+		}
+		if err != nil {
+			logger.Warn("Could not save location filter state", "user_id", location.ID, "error", err)
+		}
+		break
+	}
+	if verdict == nil {
+		// Redis failed before the state could be read
+		verdict = judgeLocation(cfg, nil, fix)
+	}
+
+	if verdict.Rejection != nil {
+		return "", rejectLocation(verdict.Rejection.Reason, verdict.Rejection.Held)
+	}
+	location.Latitude, location.Longitude = verdict.Latitude, verdict.Longitude
+	if verdict.Flag != "" {
+		metrics.LocationUpdate(LocationFlagged, verdict.Flag)
+	} else {
+		metrics.LocationUpdate(LocationAccepted, "")
+	}
+	return verdict.Flag, nil
+}
+
+// judgeLocation decides on a fix given the user's filter state, nil when
+// there is none, updating the state it returns
+func judgeLocation(cfg locationFilterConfig, state *locationFilterState, fix locationFix) *locationVerdict {
+	flag := ""
+	reset := state == nil
+	if state != nil {
+		if fix.Timestamp < state.Last.Timestamp {
+			return &locationVerdict{Rejection: &LocationRejection{Reason: ReasonOutOfOrder}}
+		}
+		if cfg.MaxSpeed > 0 && impliedSpeed(state.Last, fix) > cfg.MaxSpeed {
+			switch cfg.SpeedAction {
+			case "flag":
+				flag, reset = ReasonImplausibleSpeed, true
+			case "reject":
+				return &locationVerdict{Rejection: &LocationRejection{Reason: ReasonImplausibleSpeed}}
+			default:
+				// A second fix consistent with the held one confirms the jump
+				if state.Held == nil || impliedSpeed(*state.Held, fix) > cfg.MaxSpeed {
+					state.Held = &fix
+					return &locationVerdict{
+						Rejection: &LocationRejection{Reason: ReasonImplausibleSpeed, Held: true},
+						State:     state,
+					}
+				}
+				reset = true
+			}
+		}
+	}
+	if reset {
+		state = &locationFilterState{}
+	}
+	verdict := &locationVerdict{Flag: flag, State: state}
+	verdict.Latitude, verdict.Longitude = smoothLocation(cfg, state, fix, reset)
+	state.Last, state.Held = fix, nil
+	return verdict
+}
+
+func rejectLocation(reason string, held bool) error {
+	result := LocationRejected
+	if held {
+		result = LocationHeld
+	}
+	metrics.LocationUpdate(result, reason)
+	return &LocationRejection{Reason: reason, Held: held}
+}
+
+// impliedSpeed is the speed needed to get between two fixes, allowing for
+// both fixes' accuracy. Fixes with the same timestamp never fail the check.
+func impliedSpeed(from, to locationFix) float64 {
+	elapsed := float64(to.Timestamp-from.Timestamp) / 1000
+	if elapsed <= 0 {
+		return 0
+	}
+	distance := HaversineMeters(from.Latitude, from.Longitude, to.Latitude, to.Longitude) - from.Accuracy - to.Accuracy
+	return math.Max(distance, 0) / elapsed
+}
+
+// smoothLocation feeds a fix to the configured filter and returns the
+// smoothed position. A reset starts the filter from this fix.
+func smoothLocation(cfg locationFilterConfig, state *locationFilterState, fix locationFix, reset bool) (float64, float64) {
+	switch cfg.Smoothing {
+	case SmoothingKalman:
+		if reset || state.Variance <= 0 {
+			state.Latitude, state.Longitude, state.Variance = fix.Latitude, fix.Longitude, fix.Accuracy*fix.Accuracy
+			return fix.Latitude, fix.Longitude
+		}
+		// The estimate grows less certain as time passes, then moves toward
+		// the fix in proportion to how the two uncertainties compare
+		elapsed := float64(fix.Timestamp-state.Last.Timestamp) / 1000
+		state.Variance += math.Max(elapsed, 0) * cfg.KalmanNoise * cfg.KalmanNoise
+		gain := state.Variance / (state.Variance + fix.Accuracy*fix.Accuracy)
+		state.Latitude += gain * (fix.Latitude - state.Latitude)
+		state.Longitude = normalizeLon(state.Longitude + gain*normalizeLon(fix.Longitude-state.Longitude))
+		state.Variance *= 1 - gain
+		return state.Latitude, state.Longitude
+
+	case SmoothingAverage:
+		if reset {
+			state.Window = nil
+		}
+		state.Window = append(state.Window, [2]float64{fix.Latitude, fix.Longitude})
+		if len(state.Window) > cfg.AverageWindow {
+			state.Window = state.Window[len(state.Window)-cfg.AverageWindow:]
+		}
+		var lat, lon float64
+		for _, point := range state.Window {
+			lat += point[0]
+			// Average longitudes relative to the newest so the antimeridian
+			// does not pull the mean to the other side of the globe
+			lon += fix.Longitude + normalizeLon(point[1]-fix.Longitude)
+		}
+		n := float64(len(state.Window))
+		return lat / n, normalizeLon(lon / n)
+	}
+	return fix.Latitude, fix.Longitude
+}
+
+func loadLocationFilterState(ctx context.Context, rdb redis.Cmdable, key string) (*locationFilterState, error) {
+	data, err := rdb.Get(ctx, key).Bytes()
+	if err == redis.Nil {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var state locationFilterState
+	if err := json.Unmarshal(data, &state); err != nil {
+		return nil, fmt.Errorf("decode filter state: %w", err)
+	}
+	return &state, nil
+}
@@ -0,0 +1,54 @@
+package services
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/tthogho1/redisconnect/go/config"
+	"github.com/tthogho1/redisconnect/go/models"
+)
+
+// useLocationFilter replaces the environment's filter settings for the test
+func useLocationFilter(t *testing.T, cfg locationFilterConfig) {
+	t.Helper()
+	previous := currentLocationFilter()
+	locationFilterSettings = cfg
+	t.Cleanup(func() { locationFilterSettings = previous })
+}
+
+func TestFilterLocationConcurrentUpdates(t *testing.T) {
+	useTestRedis(t)
+	useLocationFilter(t, locationFilterConfig{
+		Smoothing:       SmoothingAverage,
+		AverageWindow:   50,
+		DefaultAccuracy: 20,
+		StateTTL:        time.Minute,
+	})
+
+	// Every fix lands in the window; none is lost to another's write
+	const fixes = 20
+	timestamp := time.Now().Add(-time.Minute).UnixMilli()
+	var wg sync.WaitGroup
+	for i := 0; i < fixes; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			location := models.LocationData{ID: "u1", Latitude: 10 + float64(i)/1000, Longitude: 20}
+			location.Timestamp = &timestamp
+			if _, err := filterLocation(context.Background(), &location); err != nil {
+				t.Errorf("fix %d: %v", i, err)
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	state, err := loadLocationFilterState(context.Background(), config.Rdb, locationFilterKey("u1"))
+	if err != nil || state == nil {
+		t.Fatalf("load state = %v, %v", state, err)
+	}
+	if len(state.Window) != fixes {
+		t.Errorf("window holds %d fixes, want %d", len(state.Window), fixes)
+	}
+}
@@ -0,0 +1,392 @@
+package services
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/tthogho1/redisconnect/go/config"
+	"github.com/tthogho1/redisconnect/go/logging"
+	"github.com/tthogho1/redisconnect/go/models"
+)
+
+// ErrNMEAChecksum is returned for sentences with a missing or wrong checksum
+var ErrNMEAChecksum = errors.New("bad NMEA checksum")
+
+// nmeaFix is a position from an RMC or GGA sentence
+type nmeaFix struct {
+	Type      string // RMC or GGA
+	Latitude  float64
+	Longitude float64
+	Speed     *float64 // meters per second, RMC only
+	Heading   *float64 // degrees, RMC only
+	Altitude  *float64 // meters above mean sea level, GGA only
+	Timestamp *int64   // Unix milliseconds, RMC only
+}
+
+// parseNMEA validates a sentence's checksum and returns its fix. ok is false
+// for other sentence types and for sentences without a valid fix.
+func parseNMEA(sentence string) (fix nmeaFix, ok bool, err error) {
+	sentence = strings.TrimSpace(sentence)
+	if !strings.HasPrefix(sentence, "$") {
+		return nmeaFix{}, false, nil
+	}
+	body, checksum, found := strings.Cut(sentence[1:], "*")
+	if !found {
+		return nmeaFix{}, false, ErrNMEAChecksum
+	}
+	want, err := strconv.ParseUint(checksum, 16, 8)
+	if err != nil {
+		return nmeaFix{}, false, ErrNMEAChecksum
+	}
+	var sum byte
+	for i := 0; i < len(body); i++ {
+		sum ^= body[i]
+	}
+	if sum != byte(want) {
+		return nmeaFix{}, false, ErrNMEAChecksum
+	}
+
+	fields := strings.Split(body, ",")
+	if len(fields[0]) != 5 {
+		return nmeaFix{}, false, nil
+	}
+	// Any talker (GP, GN, GL, GA, BD) is accepted
+	switch fix.Type = fields[0][2:]; fix.Type {
+	case "RMC":
+		// $--RMC,time,status,lat,N/S,lon,E/W,speed(kn),course,date,...
+		if len(fields) < 9 || fields[2] != "A" {
+			return nmeaFix{}, false, nil
+		}
+		if fix.Latitude, fix.Longitude, ok = nmeaPosition(fields[3:7]); !ok {
+			return nmeaFix{}, false, nil
+		}
+		if speed := parseOptionalFloat(fields[7]); speed != nil {
+			*speed *= knotsToMetersPerSecond
+			fix.Speed = speed
+		}
+		fix.Heading = parseOptionalFloat(fields[8])
+		if len(fields) > 9 {
+			if t, err := time.Parse("020106 150405", fields[9]+" "+fields[1]); err == nil {
+				// Parse also accepts fractional seconds after hhmmss
+				ms := t.UnixMilli()
+				fix.Timestamp = &ms
+			}
+		}
+		return fix, true, nil
+
+	case "GGA":
+		// $--GGA,time,lat,N/S,lon,E/W,quality,satellites,hdop,altitude,M,...
+		if len(fields) < 7 || fields[6] == "" || fields[6] == "0" {
+			return nmeaFix{}, false, nil
+		}
+		if fix.Latitude, fix.Longitude, ok = nmeaPosition(fields[2:6]); !ok {
+			return nmeaFix{}, false, nil
+		}
+		if len(fields) > 9 {
+			fix.Altitude = parseOptionalFloat(fields[9])
+		}
+		return fix, true, nil
+	}
+	return nmeaFix{}, false, nil
+}
+
+// nmeaPosition converts lat, N/S, lon, E/W fields in (d)ddmm.mmmm form
+func nmeaPosition(fields []string) (float64, float64, bool) {
+	lat, latOK := nmeaDegrees(fields[0], 2)
+	lon, lonOK := nmeaDegrees(fields[2], 3)
+	if !latOK || !lonOK {
+		return 0, 0, false
+	}
+	switch {
+	case fields[1] == "S":
+		lat = -lat
+	case fields[1] != "N":
+		return 0, 0, false
+	}
+	switch {
+	case fields[3] == "W":
+		lon = -lon
+	case fields[3] != "E":
+		return 0, 0, false
+	}
+	return lat, lon, true
+}
+
+func nmeaDegrees(value string, degreeDigits int) (float64, bool) {
+	if len(value) < degreeDigits+2 {
+		return 0, false
+	}
+	degrees, err := strconv.Atoi(value[:degreeDigits])
+	if err != nil || degrees < 0 {
+		return 0, false
+	}
+	// Written so that NaN minutes fail the range check
+	minutes, err := strconv.ParseFloat(value[degreeDigits:], 64)
+	if err != nil || !(minutes >= 0 && minutes < 60) {
+		return 0, false
+	}
+	return float64(degrees) + minutes/60, true
+}
+
+// nmeaUser is the user a source's fixes are saved as
+type nmeaUser struct {
+	ID   string
+	Name string
+}
+
+// parseNMEAUsers parses NMEA_USERS, e.g. "10.0.0.5=u1:Truck 1,10.0.0.6:4001=u2".
+// Sources are an IP, or an IP and port.
+func parseNMEAUsers(value string) map[string]nmeaUser {
+	users := make(map[string]nmeaUser)
+	for _, entry := range strings.Split(value, ",") {
+		source, user, ok := strings.Cut(strings.TrimSpace(entry), "=")
+		if !ok || source == "" || user == "" {
+			continue
+		}
+		id, name, _ := strings.Cut(user, ":")
+		if name == "" {
+			name = id
+		}
+		users[source] = nmeaUser{ID: id, Name: name}
+	}
+	return users
+}
+
+// nmeaReceiver turns sentences from sources into location updates
+type nmeaReceiver struct {
+	users map[string]nmeaUser
+
+	logMu sync.Mutex
+	log   io.Writer // raw sentences for replay, or nil
+
+	mu      sync.Mutex
+	sources map[string]*nmeaSource
+}
+
+// nmeaSource remembers what a source sends
+type nmeaSource struct {
+	sawRMC   bool     // GGA fixes are skipped from sources sending RMC
+	altitude *float64 // from the latest GGA, added to RMC fixes
+}
+
+// userFor maps "ip:port" or "ip" to a user
+func (r *nmeaReceiver) userFor(source string) (nmeaUser, bool) {
+	if user, ok := r.users[source]; ok {
+		return user, true
+	}
+	host, _, err := net.SplitHostPort(source)
+	if err != nil {
+		return nmeaUser{}, false
+	}
+	user, ok := r.users[host]
+	return user, ok
+}
+
+// handle processes one sentence from a source
+func (r *nmeaReceiver) handle(source, sentence string, received time.Time) {
+	sentence = strings.TrimSpace(sentence)
+	if sentence == "" {
+		return
+	}
+	if r.log != nil {
+		r.logMu.Lock()
+		fmt.Fprintf(r.log, "%s %s %s\n", received.UTC().Format(time.RFC3339Nano), source, sentence)
+		r.logMu.Unlock()
+	}
+
+	fix, ok, err := parseNMEA(sentence)
+	if err != nil {
+		slog.Debug("Invalid NMEA sentence", "source", source, "error", err)
+		return
+	}
+	if !ok {
+		return
+	}
+	user, ok := r.userFor(source)
+	if !ok {
+		slog.Debug("Ignoring NMEA from unmapped source", "source", source)
+		return
+	}
+
+	// Receivers usually send RMC and GGA for every fix; RMC carries speed,
+	// course and date, so GGA only adds altitude for sources that send RMC
+	r.mu.Lock()
+	state, ok := r.sources[source]
+	if !ok {
+		state = &nmeaSource{}
+		r.sources[source] = state
+	}
+	switch fix.Type {
+	case "RMC":
+		state.sawRMC = true
+		fix.Altitude = state.altitude
+	case "GGA":
+		state.altitude = fix.Altitude
+	}
+	skip := fix.Type == "GGA" && state.sawRMC
+	r.mu.Unlock()
+	if skip {
+		return
+	}
+
+	ctx := logging.WithCorrelationID(context.Background(), logging.NewCorrelationID())
+	if _, err := ProcessLocation(ctx, models.LocationData{
+		ID:        user.ID,
+		Name:      user.Name,
+		Latitude:  fix.Latitude,
+		Longitude: fix.Longitude,
+		Telemetry: models.Telemetry{Speed: fix.Speed, Heading: fix.Heading, Altitude: fix.Altitude, Timestamp: fix.Timestamp},
+	}); err != nil {
+		logging.FromContext(ctx).Warn("NMEA location failed", "source", source, "user_id", user.ID, "error", err)
+	}
+}
+
+// StartNMEAListener receives NMEA 0183 sentences from GPS devices until ctx is
+// cancelled. NMEA_LISTEN is tcp://host:port or udp://host:port; each source
+// address is mapped to a user by NMEA_USERS. NMEA_LOG appends every sentence
+// with its arrival time and source, and NMEA_REPLAY_FILE replays such a log
+// instead of listening, at NMEA_REPLAY_SPEED (default 1, 0 for as fast as
+// possible).
+func StartNMEAListener(ctx context.Context) {
+	listen, replay := os.Getenv("NMEA_LISTEN"), os.Getenv("NMEA_REPLAY_FILE")
+	if listen == "" && replay == "" {
+		return
+	}
+	receiver := &nmeaReceiver{
+		users:   parseNMEAUsers(os.Getenv("NMEA_USERS")),
+		sources: make(map[string]*nmeaSource),
+	}
+	if path := os.Getenv("NMEA_LOG"); path != "" && replay == "" {
+		file, err := os.OpenFile(path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0o644)
+		if err != nil {
+			slog.Error("Could not open NMEA log", "path", path, "error", err)
+		} else {
+			receiver.log = file
+			context.AfterFunc(ctx, func() { file.Close() })
+		}
+	}
+
+	if replay != "" {
+		speed := config.GetEnvFloat("NMEA_REPLAY_SPEED", 1)
+		go func() {
+			if err := receiver.replay(ctx, replay, speed); err != nil && ctx.Err() == nil {
+				slog.Error("NMEA replay failed", "path", replay, "error", err)
+			}
+		}()
+		return
+	}
+
+	network, addr, ok := strings.Cut(listen, "://")
+	if !ok {
+		slog.Error("NMEA_LISTEN must be tcp://host:port or udp://host:port", "value", listen)
+		return
+	}
+	switch network {
+	case "tcp":
+		listener, err := net.Listen("tcp", addr)
+		if err != nil {
+			slog.Error("Could not listen for NMEA", "addr", listen, "error", err)
+			return
+		}
+		context.AfterFunc(ctx, func() { listener.Close() })
+		go receiver.serveTCP(ctx, listener)
+	case "udp":
+		conn, err := net.ListenPacket("udp", addr)
+		if err != nil {
+			slog.Error("Could not listen for NMEA", "addr", listen, "error", err)
+			return
+		}
+		context.AfterFunc(ctx, func() { conn.Close() })
+		go receiver.serveUDP(conn)
+	default:
+		slog.Error("Unsupported NMEA_LISTEN network", "value", listen)
+		return
+	}
+	slog.Info("Listening for NMEA", "addr", listen, "sources", len(receiver.users))
+}
+
+// serveTCP reads sentences from each connection until it closes
+func (r *nmeaReceiver) serveTCP(ctx context.Context, listener net.Listener) {
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			if ctx.Err() == nil {
+				slog.Error("NMEA listener stopped", "error", err)
+			}
+			return
+		}
+		go func() {
+			defer conn.Close()
+			stop := context.AfterFunc(ctx, func() { conn.Close() })
+			defer stop()
+
+			source := conn.RemoteAddr().String()
+			slog.Info("NMEA source connected", "source", source)
+			scanner := bufio.NewScanner(conn)
+			for scanner.Scan() {
+				r.handle(source, scanner.Text(), time.Now())
+			}
+			slog.Info("NMEA source disconnected", "source", source)
+		}()
+	}
+}
+
+// serveUDP handles datagrams of one or more sentences until conn closes
+func (r *nmeaReceiver) serveUDP(conn net.PacketConn) {
+	buf := make([]byte, 64*1024)
+	for {
+		n, addr, err := conn.ReadFrom(buf)
+		if err != nil {
+			return
+		}
+		received := time.Now()
+		for _, line := range strings.Split(string(buf[:n]), "\n") {
+			r.handle(addr.String(), line, received)
+		}
+	}
+}
+
+// replay feeds an NMEA_LOG file through handle, sleeping between sentences
+// as recorded, divided by speed
+func (r *nmeaReceiver) replay(ctx context.Context, path string, speed float64) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	slog.Info("Replaying NMEA log", "path", path, "speed", speed)
+
+	scanner := bufio.NewScanner(file)
+	var last time.Time
+	for scanner.Scan() {
+		// <RFC 3339 time> <source> <sentence>
+		parts := strings.SplitN(scanner.Text(), " ", 3)
+		if len(parts) != 3 {
+			continue
+		}
+		received, err := time.Parse(time.RFC3339Nano, parts[0])
+		if err != nil {
+			continue
+		}
+		if speed > 0 && !last.IsZero() && received.After(last) {
+			select {
+			case <-ctx.Done():
+				return ctx.Err()
+			case <-time.After(time.Duration(float64(received.Sub(last)) / speed)):
+			}
+		}
+		last = received
+		r.handle(parts[1], parts[2], received)
+	}
+	return scanner.Err()
+}
@@ -0,0 +1,165 @@
+package services
+
+import (
+	"context"
+	"encoding/json"
+	"math"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/tthogho1/redisconnect/go/config"
+)
+
+func TestParseNMEAChecksum(t *testing.T) {
+	const rmc = "$GPRMC,031245.00,A,5325.2780,N,00616.2060,W,10.0,87.3,201124,,,A*4D"
+	if _, ok, err := parseNMEA(rmc); !ok || err != nil {
+		t.Fatalf("valid sentence = %v, %v", ok, err)
+	}
+	if _, ok, err := parseNMEA(strings.ToLower(rmc[:len(rmc)-2]) + "4d"); ok || err != ErrNMEAChecksum {
+		t.Errorf("altered sentence = %v, %v; want ErrNMEAChecksum", ok, err)
+	}
+	for _, sentence := range []string{
+		strings.TrimSuffix(rmc, "*4D"),
+		strings.TrimSuffix(rmc, "4D") + "00",
+		strings.TrimSuffix(rmc, "4D") + "ZZ",
+	} {
+		if _, _, err := parseNMEA(sentence); err != ErrNMEAChecksum {
+			t.Errorf("parseNMEA(%q) error %v, want ErrNMEAChecksum", sentence, err)
+		}
+	}
+	// Lines that are not sentences are skipped without an error
+	if _, ok, err := parseNMEA("!AIVDM,1,1,,A,13aEOK?P00PD2wVMdLDRhgvL289?,0*26"); ok || err != nil {
+		t.Errorf("AIS line = %v, %v; want skipped", ok, err)
+	}
+}
+
+func TestParseNMEARMC(t *testing.T) {
+	fix, ok, err := parseNMEA("$GPRMC,031245.00,A,5325.2780,N,00616.2060,W,10.0,87.3,201124,,,A*4D")
+	if !ok || err != nil {
+		t.Fatalf("parseNMEA = %v, %v", ok, err)
+	}
+	if fix.Type != "RMC" || math.Abs(fix.Latitude-53.42130) > 1e-9 || math.Abs(fix.Longitude+6.27010) > 1e-9 {
+		t.Errorf("fix %s at %v,%v, want RMC at 53.4213,-6.2701", fix.Type, fix.Latitude, fix.Longitude)
+	}
+	if fix.Speed == nil || math.Abs(*fix.Speed-10*knotsToMetersPerSecond) > 1e-9 {
+		t.Errorf("speed %v, want 10 kn in m/s", fix.Speed)
+	}
+	if fix.Heading == nil || *fix.Heading != 87.3 {
+		t.Errorf("heading %v, want 87.3", fix.Heading)
+	}
+	if want := time.Date(2024, 11, 20, 3, 12, 45, 0, time.UTC).UnixMilli(); fix.Timestamp == nil || *fix.Timestamp != want {
+		t.Errorf("timestamp %v, want %d", fix.Timestamp, want)
+	}
+	if fix.Altitude != nil {
+		t.Errorf("altitude %v, want none from RMC", *fix.Altitude)
+	}
+
+	// A void fix (status V) carries no position
+	if _, ok, err := parseNMEA("$GPRMC,031246.00,V,,,,,,,201124,,,N*7B"); ok || err != nil {
+		t.Errorf("void RMC = %v, %v; want skipped", ok, err)
+	}
+}
+
+func TestParseNMEAGGA(t *testing.T) {
+	fix, ok, err := parseNMEA("$GPGGA,031245.00,5325.2780,N,00616.2060,W,1,09,0.9,74.5,M,55.0,M,,*40")
+	if !ok || err != nil {
+		t.Fatalf("parseNMEA = %v, %v", ok, err)
+	}
+	if fix.Type != "GGA" || math.Abs(fix.Latitude-53.42130) > 1e-9 || math.Abs(fix.Longitude+6.27010) > 1e-9 {
+		t.Errorf("fix %s at %v,%v, want GGA at 53.4213,-6.2701", fix.Type, fix.Latitude, fix.Longitude)
+	}
+	if fix.Altitude == nil || *fix.Altitude != 74.5 {
+		t.Errorf("altitude %v, want 74.5", fix.Altitude)
+	}
+	if fix.Speed != nil || fix.Heading != nil || fix.Timestamp != nil {
+		t.Error("GGA fix has RMC-only fields")
+	}
+
+	// Quality 0 means no fix
+	if _, ok, _ := parseNMEA("$GPGGA,031245.00,5325.2780,N,00616.2060,W,0,00,,,M,,M,,*69"); ok {
+		t.Error("GGA without a fix accepted")
+	}
+}
+
+func TestNMEADegrees(t *testing.T) {
+	for _, tc := range []struct {
+		value  string
+		digits int
+		want   float64
+		ok     bool
+	}{
+		{"5325.2780", 2, 53 + 25.278/60, true},
+		{"00616.2060", 3, 6 + 16.206/60, true},
+		{"5360.0000", 2, 0, false}, // minutes out of range
+		{"53-5.0000", 2, 0, false}, // negative minutes
+		{"53NaN", 2, 0, false},     // NaN minutes
+		{"-125.2780", 2, 0, false}, // negative degrees
+		{"532", 2, 0, false},       // too short
+		{"ab25.2780", 2, 0, false}, // not a number
+	} {
+		got, ok := nmeaDegrees(tc.value, tc.digits)
+		if ok != tc.ok || math.Abs(got-tc.want) > 1e-9 {
+			t.Errorf("nmeaDegrees(%q, %d) = %v, %v; want %v, %v", tc.value, tc.digits, got, ok, tc.want, tc.ok)
+		}
+	}
+}
+
+func TestNMEAReplay(t *testing.T) {
+	useTestRedis(t)
+	ctx := context.Background()
+	sub := config.Rdb.Subscribe(ctx, UserLocationChannel)
+	defer sub.Close()
+	if _, err := sub.Receive(ctx); err != nil {
+		t.Fatalf("subscribe: %v", err)
+	}
+
+	receiver := &nmeaReceiver{
+		users:   parseNMEAUsers("10.0.0.5=u1:Truck 1"),
+		sources: make(map[string]*nmeaSource),
+	}
+	if err := receiver.replay(ctx, filepath.Join("testdata", "nmea_replay.nmea"), 0); err != nil {
+		t.Fatalf("replay: %v", err)
+	}
+
+	// The unmapped source, the void and corrupt RMCs, the GSV and the GGAs
+	// from a source sending RMC publish nothing; the later RMC carries the
+	// altitude from the GGA before it
+	var locations []map[string]interface{}
+	timeout := time.After(2 * time.Second)
+	for len(locations) < 2 {
+		select {
+		case msg := <-sub.Channel():
+			var location map[string]interface{}
+			if err := json.Unmarshal([]byte(msg.Payload), &location); err != nil {
+				t.Fatalf("decode %q: %v", msg.Payload, err)
+			}
+			locations = append(locations, location)
+		case <-timeout:
+			t.Fatalf("got %d locations, want 2", len(locations))
+		}
+	}
+	select {
+	case msg := <-sub.Channel():
+		t.Errorf("unexpected location %s", msg.Payload)
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	for i, want := range []struct {
+		timestamp float64
+		altitude  interface{}
+	}{
+		{float64(time.Date(2024, 11, 20, 3, 12, 45, 0, time.UTC).UnixMilli()), nil},
+		{float64(time.Date(2024, 11, 20, 3, 12, 47, 0, time.UTC).UnixMilli()), 74.5},
+	} {
+		location := locations[i]
+		if location["id"] != "u1" || location["name"] != "Truck 1" {
+			t.Errorf("location %d for %v (%v), want u1 (Truck 1)", i, location["id"], location["name"])
+		}
+		if location["timestamp"] != want.timestamp || location["altitude"] != want.altitude {
+			t.Errorf("location %d at %v, altitude %v; want %v, %v",
+				i, location["timestamp"], location["altitude"], want.timestamp, want.altitude)
+		}
+	}
+}
@@ -0,0 +1,127 @@
+package services
+
+import (
+	"crypto/subtle"
+	"errors"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/tthogho1/redisconnect/go/models"
+)
+
+// knotsToMetersPerSecond converts OsmAnd protocol speeds, which are in knots
+const knotsToMetersPerSecond = 0.514444
+
+// Errors returned for OsmAnd requests
+var (
+	ErrUnknownDevice = errors.New("unknown device or wrong key")
+	ErrInvalidOsmAnd = errors.New("invalid OsmAnd fix")
+)
+
+var (
+	osmandDevices     map[string]OsmAndDevice
+	osmandDevicesOnce sync.Once
+)
+
+// OsmAndDevice is a tracker allowed to report over the OsmAnd protocol
+type OsmAndDevice struct {
+	Key    string
+	UserID string
+	Name   string
+}
+
+// parseOsmAndDevices parses OSMAND_DEVICES, e.g.
+// "tracker1=secret1:u1:Alice,tracker2=secret2". The user ID defaults to the
+// device ID and the name to the user ID.
+func parseOsmAndDevices(value string) map[string]OsmAndDevice {
+	devices := make(map[string]OsmAndDevice)
+	for _, entry := range strings.Split(value, ",") {
+		id, rest, ok := strings.Cut(strings.TrimSpace(entry), "=")
+		if !ok || id == "" {
+			continue
+		}
+		parts := strings.SplitN(rest, ":", 3)
+		if parts[0] == "" {
+			// Devices without a key are never accepted
+			continue
+		}
+		device := OsmAndDevice{Key: parts[0], UserID: id}
+		if len(parts) > 1 && parts[1] != "" {
+			device.UserID = parts[1]
+		}
+		device.Name = device.UserID
+		if len(parts) > 2 && parts[2] != "" {
+			device.Name = parts[2]
+		}
+		devices[id] = device
+	}
+	return devices
+}
+
+// AuthenticateOsmAndDevice returns the device registered in OSMAND_DEVICES
+// under id if key matches its API key
+func AuthenticateOsmAndDevice(id, key string) (OsmAndDevice, error) {
+	osmandDevicesOnce.Do(func() {
+		osmandDevices = parseOsmAndDevices(os.Getenv("OSMAND_DEVICES"))
+	})
+	device, ok := osmandDevices[id]
+	if !ok || subtle.ConstantTimeCompare([]byte(device.Key), []byte(key)) != 1 {
+		return OsmAndDevice{}, ErrUnknownDevice
+	}
+	return device, nil
+}
+
+// ParseOsmAndFix reads a position from OsmAnd protocol parameters: lat and
+// lon (or location=lat,lon), and the optional speed (knots), bearing
+// (degrees), accuracy and altitude (meters), batt (percent) and timestamp
+func ParseOsmAndFix(params url.Values, device OsmAndDevice) (models.LocationData, error) {
+	latValue, lonValue := params.Get("lat"), params.Get("lon")
+	if latValue == "" && lonValue == "" {
+		latValue, lonValue, _ = strings.Cut(params.Get("location"), ",")
+	}
+	lat, latErr := strconv.ParseFloat(latValue, 64)
+	lon, lonErr := strconv.ParseFloat(lonValue, 64)
+	if latErr != nil || lonErr != nil {
+		return models.LocationData{}, ErrInvalidOsmAnd
+	}
+
+	location := models.LocationData{
+		ID:        device.UserID,
+		Name:      device.Name,
+		Latitude:  lat,
+		Longitude: lon,
+	}
+	if speed := parseOptionalFloat(params.Get("speed")); speed != nil {
+		*speed *= knotsToMetersPerSecond
+		location.Speed = speed
+	}
+	location.Heading = parseOptionalFloat(params.Get("bearing"))
+	location.Accuracy = parseOptionalFloat(params.Get("accuracy"))
+	location.Battery = parseOptionalFloat(params.Get("batt"))
+	location.Altitude = parseOptionalFloat(params.Get("altitude"))
+	location.Timestamp = parseOsmAndTimestamp(params.Get("timestamp"))
+	return location, nil
+}
+
+// parseOsmAndTimestamp reads Unix seconds, Unix milliseconds or RFC 3339
+func parseOsmAndTimestamp(value string) *int64 {
+	if value == "" {
+		return nil
+	}
+	var ms int64
+	if n, err := strconv.ParseInt(value, 10, 64); err == nil {
+		ms = n * 1000
+		if n > 1e12 {
+			ms = n
+		}
+	} else if t, err := time.Parse(time.RFC3339, value); err == nil {
+		ms = t.UnixMilli()
+	} else {
+		return nil
+	}
+	return &ms
+}
@@ -0,0 +1,194 @@
+package services
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/tthogho1/redisconnect/go/models"
+)
+
+// defaultOverpassURL is the main public Overpass API instance
+const defaultOverpassURL = "https://overpass-api.de/api/interpreter"
+
+// overpassMaxResults caps elements per cell; Overpass has no paging
+const overpassMaxResults = 100
+
+// overpassCellQuery selects named tourist attractions, historic features and
+// notable (Wikidata-linked) places of worship in a box (south, west, north, east), with centers for ways and relations.
+const overpassCellQuery = `[out:json][timeout:25];
+(
+  nwr["tourism"~"^(attraction|museum|gallery|viewpoint|zoo|theme_park|artwork)$"]["name"](%[1]f,%[2]f,%[3]f,%[4]f);
+  nwr["historic"]["name"](%[1]f,%[2]f,%[3]f,%[4]f);
+  nwr["amenity"="place_of_worship"]["name"]["wikidata"](%[1]f,%[2]f,%[3]f,%[4]f);
+);
+out center tags %[5]d;`
+
+// OverpassProvider finds landmarks in OpenStreetMap through the Overpass API
+type OverpassProvider struct {
+	BaseURL string       // interpreter endpoint
+	Client  *http.Client // nil uses http.DefaultClient
+}
+
+// Name implements LandmarkProvider
+func (p *OverpassProvider) Name() string { return ProviderOverpass }
+
+type overpassElement struct {
+	Type   string            `json:"type"`
+	ID     int64             `json:"id"`
+	Lat    float64           `json:"lat"`
+	Lon    float64           `json:"lon"`
+	Center *wmCoordinate     `json:"center"`
+	Tags   map[string]string `json:"tags"`
+}
+
+type overpassResponse struct {
+	Elements []overpassElement `json:"elements"`
+}
+
+// SearchCell queries the cell's bounds. Overpass results are not paged, so
+// only page 0 returns anything. Wiki categories cannot be matched; keywords
+// are matched against names and descriptions.
+func (p *OverpassProvider) SearchCell(ctx context.Context, query LandmarkCellQuery) ([]models.Landmark, bool, error) {
+	filter := query.filter()
+	if query.Page > 0 || len(filter.Categories) > 0 {
+		return nil, false, nil
+	}
+
+	centerLat, centerLon, latErr, lonErr := DecodeGeohash(query.Cell)
+	ql := fmt.Sprintf(overpassCellQuery,
+		centerLat-latErr, centerLon-lonErr, centerLat+latErr, centerLon+lonErr, overpassMaxResults)
+
+	form := url.Values{}
+	form.Set("data", ql)
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, p.BaseURL, strings.NewReader(form.Encode()))
+	if err != nil {
+		return nil, false, fmt.Errorf("build request: %w", err)
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Accept", "application/json")
+	req.Header.Set("User-Agent", wikimediaUserAgent)
+
+	resp, err := DoUpstream(UpstreamOverpass, providerClient(p.Client), req)
+	if err != nil {
+		return nil, false, fmt.Errorf("http request: %w", err)
+	}
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, false, fmt.Errorf("read response body: %w", err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, false, fmt.Errorf("http %d: %s", resp.StatusCode, truncateBody(body))
+	}
+
+	var result overpassResponse
+	if err := json.Unmarshal(body, &result); err != nil {
+		return nil, false, fmt.Errorf("decode response: %w; body=%s", err, truncateBody(body))
+	}
+
+	landmarks := make([]models.Landmark, 0, len(result.Elements))
+	for _, element := range result.Elements {
+		landmark, ok := landmarkFromOSM(element, query.Lang)
+		description := ""
+		if landmark.Description != nil {
+			description = *landmark.Description
+		}
+		if ok && filter.matchesText(landmark.Title, element.Tags["name"], description) {
+			landmarks = append(landmarks, landmark)
+		}
+	}
+	return landmarks, false, nil
+}
+
+// landmarkFromOSM converts an element, preferring the name in lang
+func landmarkFromOSM(element overpassElement, lang string) (models.Landmark, bool) {
+	lat, lon := element.Lat, element.Lon
+	if element.Center != nil {
+		lat, lon = element.Center.Lat, element.Center.Lon
+	}
+
+	title := element.Tags["name:"+lang]
+	if title == "" {
+		title = element.Tags["name"]
+	}
+	if title == "" || (lat == 0 && lon == 0) {
+		return models.Landmark{}, false
+	}
+
+	osmID := fmt.Sprintf("%s/%d", element.Type, element.ID)
+	landmark := models.Landmark{
+		Title:   title,
+		Lat:     lat,
+		Lon:     lon,
+		Lang:    lang,
+		Sources: []string{ProviderOverpass},
+		OSMID:   &osmID,
+		Class:   classifyOSM(element.Tags),
+	}
+	if item := element.Tags["wikidata"]; item != "" {
+		landmark.WikidataID = &item
+	}
+	if description := element.Tags["description"]; description != "" {
+		landmark.Description = &description
+	}
+	// "wikipedia" tags look like "ja:東京タワー"
+	if wikiLang, wikiTitle, ok := strings.Cut(element.Tags["wikipedia"], ":"); ok && wikiLang == lang {
+		article := fmt.Sprintf("https://%s.wikipedia.org/wiki/%s", lang, url.PathEscape(strings.ReplaceAll(wikiTitle, " ", "_")))
+		landmark.URL = &article
+	}
+	return landmark, true
+}
+
+// osmTagClasses maps tourism, historic and other tag values to classes
+var osmTagClasses = map[string]string{
+	"tourism=museum":               ClassMuseum,
+	"tourism=gallery":              ClassMuseum,
+	"tourism=zoo":                  ClassZoo,
+	"tourism=aquarium":             ClassZoo,
+	"tourism=artwork":              ClassMonument,
+	"historic=castle":              ClassCastle,
+	"historic=monument":            ClassMonument,
+	"historic=memorial":            ClassMonument,
+	"historic=ruins":               ClassHistoric,
+	"historic=archaeological_site": ClassHistoric,
+	"man_made=tower":               ClassTower,
+	"man_made=bridge":              ClassBridge,
+	"leisure=park":                 ClassPark,
+	"leisure=garden":               ClassPark,
+	"leisure=stadium":              ClassStadium,
+	"natural=peak":                 ClassMountain,
+	"natural=volcano":              ClassMountain,
+	"natural=water":                ClassWater,
+	"waterway=waterfall":           ClassWater,
+	"railway=station":              ClassStation,
+}
+
+// classifyOSM picks a class from an element's tags. Places of worship are
+// classed by religion: Shinto shrines, Buddhist temples, Christian churches.
+func classifyOSM(tags map[string]string) string {
+	if tags["amenity"] == "place_of_worship" || tags["building"] == "shrine" || tags["building"] == "temple" {
+		switch tags["religion"] {
+		case "shinto":
+			return ClassShrine
+		case "buddhist", "hindu":
+			return ClassTemple
+		case "christian", "muslim":
+			return ClassChurch
+		}
+	}
+	for _, key := range []string{"tourism", "historic", "man_made", "leisure", "natural", "waterway", "railway"} {
+		if class, ok := osmTagClasses[key+"="+tags[key]]; ok {
+			return class
+		}
+	}
+	if tags["historic"] != "" {
+		return ClassHistoric
+	}
+	return classifyLandmark(nil, tags["description"], tags["name"])
+}
@@ -0,0 +1,230 @@
+package services
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"os"
+	"strings"
+	"time"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+	"github.com/tthogho1/redisconnect/go/config"
+	"github.com/tthogho1/redisconnect/go/logging"
+	"github.com/tthogho1/redisconnect/go/models"
+	"github.com/tthogho1/redisconnect/go/tracing"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// defaultOwnTracksTopics covers locations and the event and waypoint
+// subtopics OwnTracks publishes transitions and regions to
+const defaultOwnTracksTopics = "owntracks/+/+,owntracks/+/+/event,owntracks/+/+/waypoint"
+
+// ownTracksMessage holds the fields of the OwnTracks payload types we use
+type ownTracksMessage struct {
+	Type  string   `json:"_type"` // location, transition or waypoint
+	Lat   *float64 `json:"lat"`
+	Lon   *float64 `json:"lon"`
+	Tst   int64    `json:"tst"`   // fix time, unix seconds
+	Tid   string   `json:"tid"`   // tracker ID shown on the device
+	Acc   *float64 `json:"acc"`   // accuracy in meters
+	Vel   *float64 `json:"vel"`   // speed in km/h
+	Cog   *float64 `json:"cog"`   // course over ground in degrees
+	Batt  *float64 `json:"batt"`  // battery percent
+	Alt   *float64 `json:"alt"`   // altitude in meters
+	Event string   `json:"event"` // transition: enter or leave
+	Desc  string   `json:"desc"`  // transition and waypoint: region name
+	Rad   int      `json:"rad"`   // waypoint: region radius in meters
+}
+
+// ownTracksUser is the user a device's updates are saved as
+type ownTracksUser struct {
+	ID   string
+	Name string
+}
+
+// parseOwnTracksUsers parses OWNTRACKS_USERS, e.g. "alice/phone=u1:Alice,bob/car=u2"
+func parseOwnTracksUsers(value string) map[string]ownTracksUser {
+	users := make(map[string]ownTracksUser)
+	for _, entry := range strings.Split(value, ",") {
+		device, user, ok := strings.Cut(strings.TrimSpace(entry), "=")
+		if !ok || device == "" || user == "" {
+			continue
+		}
+		id, name, _ := strings.Cut(user, ":")
+		users[strings.ToLower(device)] = ownTracksUser{ID: id, Name: name}
+	}
+	return users
+}
+
+// ownTracksDevice returns the user and device from a topic, ignoring a
+// trailing event or waypoint subtopic
+func ownTracksDevice(topic string) (string, string, bool) {
+	parts := strings.Split(topic, "/")
+	if last := parts[len(parts)-1]; last == "event" || last == "waypoint" {
+		parts = parts[:len(parts)-1]
+	}
+	if len(parts) < 3 {
+		return "", "", false
+	}
+	return parts[len(parts)-2], parts[len(parts)-1], true
+}
+
+// ownTracksIngester maps OwnTracks messages onto user locations
+type ownTracksIngester struct {
+	users map[string]ownTracksUser // "user/device", lower-case -> user
+	// strict drops devices missing from users instead of using the topic's
+	// user segment as the user ID
+	strict bool
+}
+
+// StartOwnTracksIngestion subscribes to OwnTracks topics on MQTT_BROKER (e.g.
+// tcp://localhost:1883), if set, until ctx is cancelled. Devices are mapped
+// to users by OWNTRACKS_USERS ("user/device=user_id[:name]", comma-separated);
+// other devices use their topic's user segment unless OWNTRACKS_STRICT=true.
+// OWNTRACKS_TOPICS overrides the subscriptions, e.g. with a $share/ group so
+// several instances split the messages.
+func StartOwnTracksIngestion(ctx context.Context) {
+	broker := os.Getenv("MQTT_BROKER")
+	if broker == "" {
+		return
+	}
+	ingester := &ownTracksIngester{
+		users:  parseOwnTracksUsers(os.Getenv("OWNTRACKS_USERS")),
+		strict: config.GetEnv("OWNTRACKS_STRICT", "false") == "true",
+	}
+	topics := map[string]byte{}
+	for _, topic := range strings.Split(config.GetEnv("OWNTRACKS_TOPICS", defaultOwnTracksTopics), ",") {
+		if topic = strings.TrimSpace(topic); topic != "" {
+			topics[topic] = 1
+		}
+	}
+
+	hostname, _ := os.Hostname()
+	opts := mqtt.NewClientOptions().
+		AddBroker(broker).
+		SetClientID(config.GetEnv("MQTT_CLIENT_ID", "redisconnect-"+hostname)).
+		SetUsername(os.Getenv("MQTT_USERNAME")).
+		SetPassword(os.Getenv("MQTT_PASSWORD")).
+		SetAutoReconnect(true).
+		SetConnectRetry(true).
+		SetMaxReconnectInterval(subscribeMaxBackoff).
+		SetOnConnectHandler(func(client mqtt.Client) {
+			// Subscribe on every connect, since clean sessions drop subscriptions
+			token := client.SubscribeMultiple(topics, func(_ mqtt.Client, msg mqtt.Message) {
+				ingester.handle(msg.Topic(), msg.Payload())
+			})
+			if token.Wait() && token.Error() != nil {
+				slog.Error("MQTT subscribe failed", "broker", broker, "error", token.Error())
+				return
+			}
+			slog.Info("Subscribed to OwnTracks topics", "broker", broker, "topics", len(topics))
+		}).
+		SetConnectionLostHandler(func(_ mqtt.Client, err error) {
+			slog.Warn("MQTT connection lost", "broker", broker, "error", err)
+		})
+
+	client := mqtt.NewClient(opts)
+	client.Connect()
+	go func() {
+		<-ctx.Done()
+		client.Disconnect(250)
+	}()
+}
+
+// handle processes one OwnTracks message. Locations and transitions update
+// the user's position; waypoints are stored per user.
+func (t *ownTracksIngester) handle(topic string, payload []byte) {
+	ctx := logging.WithCorrelationID(context.Background(), logging.NewCorrelationID())
+	ctx, span := tracing.Start(ctx, "mqtt "+topic,
+		trace.WithSpanKind(trace.SpanKindConsumer),
+		trace.WithAttributes(
+			attribute.String("messaging.system", "mqtt"),
+			attribute.String("messaging.destination.name", topic),
+		))
+	defer span.End()
+	defer trackInFlight()()
+	logger := logging.FromContext(ctx).With("topic", topic)
+
+	owner, device, ok := ownTracksDevice(topic)
+	if !ok {
+		logger.Warn("Unexpected OwnTracks topic")
+		return
+	}
+	user, ok := t.users[strings.ToLower(owner+"/"+device)]
+	if !ok {
+		if t.strict {
+			logger.Debug("Ignoring unmapped OwnTracks device")
+			return
+		}
+		user = ownTracksUser{ID: owner}
+	}
+	if user.Name == "" {
+		user.Name = owner
+	}
+
+	var msg ownTracksMessage
+	if err := json.Unmarshal(payload, &msg); err != nil {
+		logger.Warn("Invalid OwnTracks payload", "error", err)
+		return
+	}
+
+	switch msg.Type {
+	case "location", "transition":
+		if msg.Lat == nil || msg.Lon == nil {
+			logger.Warn("OwnTracks message without position", "type", msg.Type)
+			return
+		}
+		if msg.Type == "transition" {
+			logger.Info("OwnTracks region transition", "user_id", user.ID, "event", msg.Event, "region", msg.Desc)
+		}
+		location := models.LocationData{
+			ID:        user.ID,
+			Name:      user.Name,
+			Latitude:  *msg.Lat,
+			Longitude: *msg.Lon,
+			Telemetry: models.Telemetry{Heading: msg.Cog, Accuracy: msg.Acc, Battery: msg.Batt, Altitude: msg.Alt},
+		}
+		if msg.Tst > 0 {
+			timestamp := msg.Tst * 1000
+			location.Timestamp = &timestamp
+		}
+		if msg.Vel != nil {
+			speed := *msg.Vel / 3.6
+			location.Speed = &speed
+		}
+		if _, err := ProcessLocation(ctx, location); err != nil {
+			logger.Warn("OwnTracks location failed", "user_id", user.ID, "error", err)
+		}
+
+	case "waypoint":
+		if err := saveOwnTracksWaypoint(ctx, user.ID, msg); err != nil {
+			logger.Warn("OwnTracks waypoint failed", "user_id", user.ID, "error", err)
+		}
+
+	default:
+		// lwt, card, cmd and other types carry no position
+		logger.Debug("Ignoring OwnTracks message", "type", msg.Type)
+	}
+}
+
+// saveOwnTracksWaypoint stores a region a device monitors in the user's
+// owntracks_waypoints:{id} hash, keyed by region name
+func saveOwnTracksWaypoint(ctx context.Context, userID string, msg ownTracksMessage) error {
+	if msg.Desc == "" || msg.Lat == nil || msg.Lon == nil {
+		return fmt.Errorf("waypoint needs desc, lat and lon")
+	}
+	waypoint, err := json.Marshal(map[string]interface{}{
+		"desc":       msg.Desc,
+		"latitude":   *msg.Lat,
+		"longitude":  *msg.Lon,
+		"radius":     msg.Rad,
+		"created_at": time.Unix(msg.Tst, 0).UTC(),
+	})
+	if err != nil {
+		return err
+	}
+	return config.Rdb.HSet(ctx, "owntracks_waypoints:"+userID, msg.Desc, waypoint).Err()
+}
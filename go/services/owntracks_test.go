@@ -0,0 +1,299 @@
+package services
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+	"github.com/tthogho1/redisconnect/go/config"
+)
+
+// testBroker is a minimal MQTT 3.1.1 broker: it accepts one client at a
+// time, grants subscriptions and publishes at QoS 0
+type testBroker struct {
+	t        *testing.T
+	listener net.Listener
+
+	mu         sync.Mutex
+	conn       net.Conn
+	subscribed chan []string // topics of each SUBSCRIBE received
+}
+
+func startTestBroker(t *testing.T) *testBroker {
+	t.Helper()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	b := &testBroker{t: t, listener: listener, subscribed: make(chan []string, 8)}
+	t.Cleanup(func() {
+		listener.Close()
+		b.drop()
+	})
+	go b.accept()
+	return b
+}
+
+func (b *testBroker) url() string {
+	return "tcp://" + b.listener.Addr().String()
+}
+
+func (b *testBroker) accept() {
+	for {
+		conn, err := b.listener.Accept()
+		if err != nil {
+			return
+		}
+		b.mu.Lock()
+		b.conn = conn
+		b.mu.Unlock()
+		go b.serve(conn)
+	}
+}
+
+func (b *testBroker) serve(conn net.Conn) {
+	defer conn.Close()
+	reader := bufio.NewReader(conn)
+	for {
+		header, body, err := readMQTTPacket(reader)
+		if err != nil {
+			return
+		}
+		switch header >> 4 {
+		case 1: // CONNECT
+			b.write(conn, 0x20, []byte{0, 0})
+		case 8: // SUBSCRIBE: packet ID, then (topic, QoS) pairs
+			var topics []string
+			ack := []byte{body[0], body[1]}
+			for i := 2; i+2 <= len(body); {
+				n := int(body[i])<<8 | int(body[i+1])
+				topics = append(topics, string(body[i+2:i+2+n]))
+				i += 2 + n + 1
+				ack = append(ack, 0)
+			}
+			b.write(conn, 0x90, ack)
+			b.subscribed <- topics
+		case 12: // PINGREQ
+			b.write(conn, 0xd0, nil)
+		case 14: // DISCONNECT
+			return
+		}
+	}
+}
+
+// publish sends a QoS 0 message to the connected client
+func (b *testBroker) publish(topic, payload string) {
+	b.mu.Lock()
+	conn := b.conn
+	b.mu.Unlock()
+	body := append([]byte{byte(len(topic) >> 8), byte(len(topic))}, topic...)
+	b.write(conn, 0x30, append(body, payload...))
+}
+
+// drop closes the client's connection without a DISCONNECT, as a broker
+// restart would
+func (b *testBroker) drop() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.conn != nil {
+		b.conn.Close()
+	}
+}
+
+// waitSubscribed returns the topics of the next SUBSCRIBE
+func (b *testBroker) waitSubscribed() []string {
+	b.t.Helper()
+	select {
+	case topics := <-b.subscribed:
+		return topics
+	case <-time.After(5 * time.Second):
+		b.t.Fatal("timed out waiting for SUBSCRIBE")
+		return nil
+	}
+}
+
+func (b *testBroker) write(conn net.Conn, header byte, body []byte) {
+	packet := []byte{header}
+	for n := len(body); ; {
+		digit := byte(n % 128)
+		if n /= 128; n > 0 {
+			digit |= 128
+		}
+		packet = append(packet, digit)
+		if n == 0 {
+			break
+		}
+	}
+	conn.Write(append(packet, body...))
+}
+
+func readMQTTPacket(r *bufio.Reader) (byte, []byte, error) {
+	header, err := r.ReadByte()
+	if err != nil {
+		return 0, nil, err
+	}
+	length, multiplier := 0, 1
+	for {
+		digit, err := r.ReadByte()
+		if err != nil {
+			return 0, nil, err
+		}
+		length += int(digit&127) * multiplier
+		multiplier *= 128
+		if digit&128 == 0 {
+			break
+		}
+	}
+	body := make([]byte, length)
+	_, err = io.ReadFull(r, body)
+	return header, body, err
+}
+
+// nextLocation returns the next payload published on UserLocationChannel
+func nextLocation(t *testing.T, sub *redis.PubSub) map[string]interface{} {
+	t.Helper()
+	select {
+	case msg := <-sub.Channel():
+		var payload map[string]interface{}
+		if err := json.Unmarshal([]byte(msg.Payload), &payload); err != nil {
+			t.Fatalf("decode %q: %v", msg.Payload, err)
+		}
+		return payload
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for a location")
+		return nil
+	}
+}
+
+func TestOwnTracksIngestion(t *testing.T) {
+	useTestRedis(t)
+	broker := startTestBroker(t)
+	t.Setenv("MQTT_BROKER", broker.url())
+	t.Setenv("MQTT_CLIENT_ID", "owntracks-test")
+	t.Setenv("OWNTRACKS_USERS", "alice/phone=u1:Alice")
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	sub := config.Rdb.Subscribe(ctx, UserLocationChannel)
+	defer sub.Close()
+	if _, err := sub.Receive(ctx); err != nil {
+		t.Fatalf("subscribe: %v", err)
+	}
+
+	StartOwnTracksIngestion(ctx)
+	// Let the last message finish before the test Redis goes away, since
+	// ProcessLocation publishes before it tracks trips
+	t.Cleanup(func() {
+		cancel()
+		waitCtx, done := context.WithTimeout(context.Background(), 5*time.Second)
+		defer done()
+		WaitInFlight(waitCtx)
+	})
+	topics := broker.waitSubscribed()
+	sort.Strings(topics)
+	want := strings.Split(defaultOwnTracksTopics, ",")
+	sort.Strings(want)
+	if strings.Join(topics, ",") != strings.Join(want, ",") {
+		t.Fatalf("subscribed to %v, want %v", topics, want)
+	}
+
+	// Dated in the past, so the later fix is not clamped to the receive time
+	tst := time.Now().Add(-2 * time.Minute).Unix()
+	// Non-location types come first, so the location published next is the
+	// first message on the channel only if they were skipped
+	broker.publish("owntracks/alice/phone", `{"_type":"lwt","tst":1}`)
+	broker.publish("owntracks/alice/phone", `{"_type":"card","name":"Alice","lat":1,"lon":2}`)
+	broker.publish("owntracks/bob/car/waypoint",
+		fmt.Sprintf(`{"_type":"waypoint","desc":"Home","lat":35.5,"lon":139.5,"rad":50,"tst":%d}`, tst))
+	broker.publish("owntracks/alice/phone",
+		fmt.Sprintf(`{"_type":"location","lat":35.1,"lon":139.2,"vel":36,"batt":80,"tst":%d}`, tst))
+
+	location := nextLocation(t, sub)
+	if location["id"] != "u1" || location["name"] != "Alice" {
+		t.Errorf("location for %v (%v), want mapped user u1 (Alice)", location["id"], location["name"])
+	}
+	if location["latitude"] != 35.1 || location["longitude"] != 139.2 {
+		t.Errorf("position %v,%v, want 35.1,139.2", location["latitude"], location["longitude"])
+	}
+	if location["speed"] != 10.0 {
+		t.Errorf("speed %v m/s, want 10 from 36 km/h", location["speed"])
+	}
+
+	// Messages are handled in order, so the waypoint is saved by now
+	waypoint := config.Rdb.HGet(ctx, "owntracks_waypoints:bob", "Home").Val()
+	if !strings.Contains(waypoint, `"radius":50`) {
+		t.Errorf("waypoint %q, want Home with radius 50 for the unmapped user bob", waypoint)
+	}
+
+	broker.publish("owntracks/bob/car/event",
+		fmt.Sprintf(`{"_type":"transition","event":"enter","desc":"Home","lat":35.5,"lon":139.5,"tst":%d}`, tst))
+	if location := nextLocation(t, sub); location["id"] != "bob" {
+		t.Errorf("transition for %v, want bob", location["id"])
+	}
+
+	// After the broker drops the connection, the client reconnects and
+	// subscribes again
+	broker.drop()
+	broker.waitSubscribed()
+	broker.publish("owntracks/alice/phone",
+		fmt.Sprintf(`{"_type":"location","lat":35.101,"lon":139.2,"tst":%d}`, tst+60))
+	if location := nextLocation(t, sub); location["id"] != "u1" || location["latitude"] != 35.101 {
+		t.Errorf("location after reconnect %v at %v, want u1 at 35.101", location["id"], location["latitude"])
+	}
+}
+
+func TestOwnTracksIngesterStrict(t *testing.T) {
+	useTestRedis(t)
+	ctx := context.Background()
+	ingester := &ownTracksIngester{users: parseOwnTracksUsers("alice/phone=u1"), strict: true}
+
+	ingester.handle("owntracks/bob/car", []byte(`{"_type":"location","lat":1,"lon":2}`))
+	if n := config.Rdb.Exists(ctx, "user_info:bob").Val(); n != 0 {
+		t.Error("strict mode saved an unmapped device")
+	}
+	ingester.handle("owntracks/Alice/Phone", []byte(`{"_type":"location","lat":1,"lon":2}`))
+	if n := config.Rdb.Exists(ctx, "user_info:u1").Val(); n != 1 {
+		t.Error("strict mode dropped a mapped device")
+	}
+}
+
+func TestOwnTracksDevice(t *testing.T) {
+	for _, tc := range []struct {
+		topic, user, device string
+		ok                  bool
+	}{
+		{"owntracks/alice/phone", "alice", "phone", true},
+		{"owntracks/alice/phone/event", "alice", "phone", true},
+		{"owntracks/alice/phone/waypoint", "alice", "phone", true},
+		{"owntracks/alice", "", "", false},
+		{"owntracks/event", "", "", false},
+	} {
+		user, device, ok := ownTracksDevice(tc.topic)
+		if user != tc.user || device != tc.device || ok != tc.ok {
+			t.Errorf("ownTracksDevice(%q) = %q, %q, %v; want %q, %q, %v",
+				tc.topic, user, device, ok, tc.user, tc.device, tc.ok)
+		}
+	}
+}
+
+func TestParseOwnTracksUsers(t *testing.T) {
+	users := parseOwnTracksUsers(" Alice/Phone=u1:Alice Smith, bob/car=u2,broken,=u3,carol/tab=")
+	if len(users) != 2 {
+		t.Fatalf("parsed %d users, want 2: %v", len(users), users)
+	}
+	if got := users["alice/phone"]; got != (ownTracksUser{ID: "u1", Name: "Alice Smith"}) {
+		t.Errorf("alice/phone = %+v", got)
+	}
+	if got := users["bob/car"]; got != (ownTracksUser{ID: "u2"}) {
+		t.Errorf("bob/car = %+v", got)
+	}
+}
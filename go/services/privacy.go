@@ -0,0 +1,407 @@
+package services
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"slices"
+	"strings"
+	"sync"
+
+	socketio "github.com/doquangtan/socketio/v4"
+	"github.com/go-redis/redis/v8"
+	"github.com/tthogho1/redisconnect/go/config"
+	"github.com/tthogho1/redisconnect/go/logging"
+	"github.com/tthogho1/redisconnect/go/models"
+)
+
+// Privacy visibility settings
+const (
+	VisibilityEveryone = "everyone"
+	VisibilityContacts = "contacts"
+	VisibilityList     = "list"
+)
+
+// maxPrivacyList bounds the allowed list and the contact list
+const maxPrivacyList = 1000
+
+// ErrInvalidPrivacy is returned for privacy settings or contacts that fail
+// validation
+var ErrInvalidPrivacy = errors.New("invalid privacy settings")
+
+// ErrTripsHidden is returned when a user's privacy settings hide their trips
+// from a viewer
+var ErrTripsHidden = errors.New("trips not available")
+
+func privacyKey(userID string) string {
+	return "privacy:" + userID
+}
+
+func contactsKey(userID string) string {
+	return "contacts:" + userID
+}
+
+// GetPrivacySettings returns a user's privacy settings. Users who never set
+// any are visible to everyone at full precision.
+func GetPrivacySettings(ctx context.Context, userID string) (models.PrivacySettings, error) {
+	policies, err := loadPrivacyPolicies(ctx, []string{userID})
+	if err != nil {
+		return models.PrivacySettings{}, err
+	}
+	return policies[userID].settings, nil
+}
+
+// SetPrivacySettings validates and stores a user's privacy settings, then
+// tells every instance to re-check who can see the user
+func SetPrivacySettings(ctx context.Context, userID string, settings models.PrivacySettings) (models.PrivacySettings, error) {
+	settings.Visibility = strings.ToLower(settings.Visibility)
+	if settings.Visibility == "" {
+		settings.Visibility = VisibilityEveryone
+	}
+	switch settings.Visibility {
+	case VisibilityEveryone, VisibilityContacts, VisibilityList:
+	default:
+		return settings, ErrInvalidPrivacy
+	}
+	if settings.Precision < 0 || settings.Precision > maxGeohashPrecision() {
+		return settings, ErrInvalidPrivacy
+	}
+	allowed, err := normalizeUserList(settings.Allowed)
+	if err != nil {
+		return settings, err
+	}
+	settings.Allowed = allowed
+
+	data, err := json.Marshal(settings)
+	if err != nil {
+		return settings, err
+	}
+	if err := config.Rdb.Set(ctx, privacyKey(userID), data, 0).Err(); err != nil {
+		return settings, err
+	}
+	PublishEvent(ctx, UserPrivacyChannel, map[string]string{"id": userID})
+	return settings, nil
+}
+
+// GetContacts returns the users a user counts as contacts, sorted
+func GetContacts(ctx context.Context, userID string) ([]string, error) {
+	contacts, err := config.Rdb.SMembers(ctx, contactsKey(userID)).Result()
+	if err != nil {
+		return nil, err
+	}
+	slices.Sort(contacts)
+	return contacts, nil
+}
+
+// SetContacts replaces a user's contacts, who can see them under the
+// contacts visibility
+func SetContacts(ctx context.Context, userID string, contacts []string) ([]string, error) {
+	contacts, err := normalizeUserList(contacts)
+	if err != nil {
+		return nil, err
+	}
+	key := contactsKey(userID)
+	pipe := config.Rdb.TxPipeline()
+	pipe.Del(ctx, key)
+	if len(contacts) > 0 {
+		members := make([]interface{}, len(contacts))
+		for i, contact := range contacts {
+			members[i] = contact
+		}
+		pipe.SAdd(ctx, key, members...)
+	}
+	if _, err := pipe.Exec(ctx); err != nil {
+		return nil, err
+	}
+	PublishEvent(ctx, UserPrivacyChannel, map[string]string{"id": userID})
+	return contacts, nil
+}
+
+// normalizeUserList trims, de-duplicates and sorts a list of user IDs
+func normalizeUserList(userIDs []string) ([]string, error) {
+	if len(userIDs) > maxPrivacyList {
+		return nil, ErrInvalidPrivacy
+	}
+	list := make([]string, 0, len(userIDs))
+	for _, userID := range userIDs {
+		if userID = strings.TrimSpace(userID); userID != "" {
+			list = append(list, userID)
+		}
+	}
+	slices.Sort(list)
+	return slices.Compact(list), nil
+}
+
+func maxGeohashPrecision() int {
+	return len(geohashCellWidthMeters) - 1
+}
+
+// privacyPolicy is a user's privacy settings with their contacts loaded
+type privacyPolicy struct {
+	userID   string
+	settings models.PrivacySettings
+	contacts map[string]bool
+}
+
+// precisionFor reports whether a viewer may see the user and the geohash
+// length to fuzz their coordinates to, 0 for exact. Users always see
+// themselves exactly; anonymous viewers have an empty ID.
+func (p privacyPolicy) precisionFor(viewerID string) (int, bool) {
+	if viewerID != "" && viewerID == p.userID {
+		return 0, true
+	}
+	if p.settings.Ghost {
+		return 0, false
+	}
+	switch p.settings.Visibility {
+	case VisibilityContacts:
+		if !p.contacts[viewerID] {
+			return 0, false
+		}
+	case VisibilityList:
+		if viewerID == "" || !slices.Contains(p.settings.Allowed, viewerID) {
+			return 0, false
+		}
+	}
+	return p.settings.Precision, true
+}
+
+// loadPrivacyPolicies reads the privacy settings, and contacts where needed,
+// of several users in two round trips
+func loadPrivacyPolicies(ctx context.Context, userIDs []string) (map[string]privacyPolicy, error) {
+	pipe := config.Rdb.Pipeline()
+	gets := make([]*redis.StringCmd, len(userIDs))
+	for i, userID := range userIDs {
+		gets[i] = pipe.Get(ctx, privacyKey(userID))
+	}
+	// Missing settings fail with redis.Nil; each command is checked below
+	pipe.Exec(ctx)
+
+	policies := make(map[string]privacyPolicy, len(userIDs))
+	contactsPipe := config.Rdb.Pipeline()
+	contactCmds := map[string]*redis.StringSliceCmd{}
+	for i, userID := range userIDs {
+		policy := privacyPolicy{userID: userID, settings: models.PrivacySettings{Visibility: VisibilityEveryone}}
+		data, err := gets[i].Bytes()
+		if err != nil && err != redis.Nil {
+			return nil, err
+		}
+		if err == nil {
+			if err := json.Unmarshal(data, &policy.settings); err != nil {
+				// Fail closed: unreadable settings hide the user
+				logging.FromContext(ctx).Warn("Invalid privacy settings", "user_id", userID, "error", err)
+				policy.settings.Ghost = true
+			}
+		}
+		if policy.settings.Visibility == VisibilityContacts {
+			contactCmds[userID] = contactsPipe.SMembers(ctx, contactsKey(userID))
+		}
+		policies[userID] = policy
+	}
+	if len(contactCmds) == 0 {
+		return policies, nil
+	}
+	if _, err := contactsPipe.Exec(ctx); err != nil {
+		return nil, err
+	}
+	for userID, cmd := range contactCmds {
+		policy := policies[userID]
+		policy.contacts = make(map[string]bool)
+		for _, contact := range cmd.Val() {
+			policy.contacts[contact] = true
+		}
+		policies[userID] = policy
+	}
+	return policies, nil
+}
+
+// Coordinate fields of user and trip payloads, as latitude/longitude pairs
+var payloadCoordinates = [][2]string{
+	{"latitude", "longitude"},
+	{"start_latitude", "start_longitude"},
+	{"end_latitude", "end_longitude"},
+}
+
+// precisePayloadFields reveal more than a fuzzed position and are dropped
+var precisePayloadFields = []string{"accuracy", "altitude", "heading", "speed"}
+
+// fuzzPayload returns a copy of a user or trip payload with its coordinates
+// snapped to geohash cells of the given length
+func fuzzPayload(data map[string]interface{}, precision int) map[string]interface{} {
+	fuzzed := make(map[string]interface{}, len(data)+1)
+	for key, value := range data {
+		fuzzed[key] = value
+	}
+	for _, pair := range payloadCoordinates {
+		lat, latOK := fuzzed[pair[0]].(float64)
+		lon, lonOK := fuzzed[pair[1]].(float64)
+		if latOK && lonOK {
+			fuzzed[pair[0]], fuzzed[pair[1]], _ = SnapToGeohash(lat, lon, precision)
+		}
+	}
+	for _, field := range precisePayloadFields {
+		delete(fuzzed, field)
+	}
+	fuzzed["precision"] = precision
+	return fuzzed
+}
+
+// fuzzUser snaps a user's position to a geohash cell of the given length
+func fuzzUser(user models.User, precision int) models.User {
+	user.Latitude, user.Longitude, _ = SnapToGeohash(user.Latitude, user.Longitude, precision)
+	user.Accuracy, user.Altitude, user.Heading, user.Speed = nil, nil, nil, nil
+	user.Precision = precision
+	return user
+}
+
+// fuzzTrip snaps a trip's end points to geohash cells of the given length
+func fuzzTrip(trip models.Trip, precision int) models.Trip {
+	trip.StartLatitude, trip.StartLongitude, _ = SnapToGeohash(trip.StartLatitude, trip.StartLongitude, precision)
+	trip.EndLatitude, trip.EndLongitude, _ = SnapToGeohash(trip.EndLatitude, trip.EndLongitude, precision)
+	trip.Precision = precision
+	return trip
+}
+
+// VisibleTrips returns a user's stored trips as a viewer may see them, with
+// end points fuzzed as the user's privacy settings require. Viewers who may
+// not see the user get ErrTripsHidden.
+func VisibleTrips(ctx context.Context, viewerID, userID string, limit int, before int64) ([]models.Trip, error) {
+	policies, err := loadPrivacyPolicies(ctx, []string{userID})
+	if err != nil {
+		return nil, err
+	}
+	precision, ok := policies[userID].precisionFor(viewerID)
+	if !ok {
+		return nil, ErrTripsHidden
+	}
+	trips, err := UserTrips(ctx, userID, limit, before)
+	if err != nil || precision == 0 {
+		return trips, err
+	}
+	for i := range trips {
+		trips[i] = fuzzTrip(trips[i], precision)
+	}
+	return trips, nil
+}
+
+// visibleUsers filters users down to those a viewer may see, fuzzed as their
+// settings require
+func visibleUsers(users []models.User, policies map[string]privacyPolicy, viewerID string) []models.User {
+	visible := make([]models.User, 0, len(users))
+	for _, user := range users {
+		precision, ok := policies[user.ID].precisionFor(viewerID)
+		if !ok {
+			continue
+		}
+		if precision > 0 {
+			user = fuzzUser(user, precision)
+		}
+		visible = append(visible, user)
+	}
+	return visible
+}
+
+// loadUsersWithPolicies reads every user and their privacy settings
+func loadUsersWithPolicies(ctx context.Context) ([]models.User, map[string]privacyPolicy, error) {
+	users := GetAllUsersFromRedis(ctx)
+	userIDs := make([]string, len(users))
+	for i, user := range users {
+		userIDs[i] = user.ID
+	}
+	policies, err := loadPrivacyPolicies(ctx, userIDs)
+	return users, policies, err
+}
+
+// VisibleUsers returns the users a viewer may see, with coordinates fuzzed as
+// each user's privacy settings require. An empty viewer is anonymous and only
+// sees users visible to everyone.
+func VisibleUsers(ctx context.Context, viewerID string) ([]models.User, error) {
+	users, policies, err := loadUsersWithPolicies(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return visibleUsers(users, policies, viewerID), nil
+}
+
+// localViewer is a socket on this instance and the user registered on it,
+// empty until the socket registers
+type localViewer struct {
+	socket *socketio.Socket
+	userID string
+}
+
+func localViewers(io *socketio.Io, userSIDMap map[string]*socketio.Socket, userSIDLock *sync.RWMutex) []localViewer {
+	socketUsers := make(map[string]string)
+	userSIDLock.RLock()
+	for userID, socket := range userSIDMap {
+		socketUsers[socket.Id] = userID
+	}
+	userSIDLock.RUnlock()
+
+	sockets := io.Sockets()
+	viewers := make([]localViewer, len(sockets))
+	for i, socket := range sockets {
+		viewers[i] = localViewer{socket: socket, userID: socketUsers[socket.Id]}
+	}
+	return viewers
+}
+
+// EmitToViewers emits an event about a user to the local sockets allowed to
+// see them, with coordinates fuzzed as the user's privacy settings require.
+// If the settings cannot be read, nobody but the user is sent the event.
+func EmitToViewers(ctx context.Context, io *socketio.Io, userSIDMap map[string]*socketio.Socket, userSIDLock *sync.RWMutex, userID, event string, data map[string]interface{}) {
+	policies, err := loadPrivacyPolicies(ctx, []string{userID})
+	policy := policies[userID]
+	if err != nil {
+		logging.FromContext(ctx).Warn("Could not load privacy settings", "user_id", userID, "error", err)
+		policy = privacyPolicy{userID: userID, settings: models.PrivacySettings{Ghost: true}}
+	}
+
+	var fuzzed map[string]interface{}
+	for _, viewer := range localViewers(io, userSIDMap, userSIDLock) {
+		precision, ok := policy.precisionFor(viewer.userID)
+		switch {
+		case !ok:
+		case precision == 0:
+			viewer.socket.Emit(event, data)
+		default:
+			if fuzzed == nil {
+				fuzzed = fuzzPayload(data, precision)
+			}
+			viewer.socket.Emit(event, fuzzed)
+		}
+	}
+}
+
+// refreshUserVisibility applies a change to a user's privacy settings or
+// contacts on this instance: sockets that may see the user get user_updated
+// and the rest user_deleted
+func refreshUserVisibility(ctx context.Context, io *socketio.Io, userSIDMap map[string]*socketio.Socket, userSIDLock *sync.RWMutex, userID string) {
+	policies, err := loadPrivacyPolicies(ctx, []string{userID})
+	if err != nil {
+		logging.FromContext(ctx).Warn("Could not load privacy settings", "user_id", userID, "error", err)
+		return
+	}
+	user, err := GetUserFromRedis(ctx, userID)
+	if err != nil {
+		logging.FromContext(ctx).Warn("Could not load user", "user_id", userID, "error", err)
+		return
+	}
+	if user == nil {
+		// No position to show or hide
+		return
+	}
+
+	deleted := map[string]string{"id": userID}
+	for _, viewer := range localViewers(io, userSIDMap, userSIDLock) {
+		precision, ok := policies[userID].precisionFor(viewer.userID)
+		switch {
+		case !ok:
+			viewer.socket.Emit("user_deleted", deleted)
+		case precision == 0:
+			viewer.socket.Emit("user_updated", *user)
+		default:
+			viewer.socket.Emit("user_updated", fuzzUser(*user, precision))
+		}
+	}
+}
@@ -0,0 +1,198 @@
+package services
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"math/rand"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+	"github.com/tthogho1/redisconnect/go/config"
+)
+
+// RateLimitPolicy allows Limit requests per sliding Window
+type RateLimitPolicy struct {
+	Limit  int
+	Window time.Duration
+}
+
+// RateLimitResult is the outcome of a rate limit check
+type RateLimitResult struct {
+	Allowed   bool
+	Limit     int
+	Remaining int
+	Reset     time.Duration // until the oldest request leaves the window
+	Policy    RateLimitPolicy
+}
+
+// defaultRateLimitPolicies are keyed by Socket.IO event name or Gin route path.
+// RATE_LIMITS overrides them, e.g. "chat_broadcast=5/10s,/summarize=3/1m,location=off".
+var defaultRateLimitPolicies = map[string]RateLimitPolicy{
+	"chat_broadcast":           {Limit: 10, Window: 10 * time.Second},
+	"chat_private":             {Limit: 20, Window: 10 * time.Second},
+	"location":                 {Limit: 10, Window: 5 * time.Second},
+	"/summarize":               {Limit: 10, Window: time.Minute},
+	"/fetchlandmarks":          {Limit: 60, Window: time.Minute},
+	"/searchlandmarksnearby":   {Limit: 60, Window: time.Minute},
+	"/fetchlandmarkdetails":    {Limit: 120, Window: time.Minute},
+	"nearest_airports":         {Limit: 30, Window: time.Minute},
+	"/airports/nearest":        {Limit: 60, Window: time.Minute},
+	"/airports/:code":          {Limit: 120, Window: time.Minute},
+	"aircraft_subscribe":       {Limit: 20, Window: 10 * time.Second},
+	"/socket.io":               {Limit: 30, Window: time.Minute},
+	"/osmand":                  {Limit: 600, Window: time.Minute},
+	"/users/:user_id/trips":    {Limit: 60, Window: time.Minute},
+	"/users/:user_id/privacy":  {Limit: 30, Window: time.Minute},
+	"/users/:user_id/contacts": {Limit: 30, Window: time.Minute},
+}
+
+var (
+	rateLimitPolicies     map[string]RateLimitPolicy
+	rateLimitPoliciesOnce sync.Once
+)
+
+// RateLimitPolicyFor returns the policy for a route or event, if any
+func RateLimitPolicyFor(name string) (RateLimitPolicy, bool) {
+	rateLimitPoliciesOnce.Do(func() {
+		rateLimitPolicies = parseRateLimitPolicies(os.Getenv("RATE_LIMITS"))
+	})
+	policy, ok := rateLimitPolicies[name]
+	return policy, ok
+}
+
+// parseRateLimitPolicies merges "name=limit/window" entries over the defaults.
+// A value of "off" or a zero limit disables limiting for that name.
+func parseRateLimitPolicies(spec string) map[string]RateLimitPolicy {
+	policies := make(map[string]RateLimitPolicy, len(defaultRateLimitPolicies))
+	for name, policy := range defaultRateLimitPolicies {
+		policies[name] = policy
+	}
+
+	for _, entry := range strings.Split(spec, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		name, value, ok := strings.Cut(entry, "=")
+		if !ok {
+			slog.Warn("Invalid RATE_LIMITS entry", "entry", entry)
+			continue
+		}
+		name, value = strings.TrimSpace(name), strings.TrimSpace(value)
+		if value == "off" {
+			delete(policies, name)
+			continue
+		}
+
+		limitText, windowText, ok := strings.Cut(value, "/")
+		limit, err := strconv.Atoi(limitText)
+		if !ok || err != nil {
+			slog.Warn("Invalid RATE_LIMITS entry", "entry", entry)
+			continue
+		}
+		window, err := time.ParseDuration(windowText)
+		if err != nil || window <= 0 {
+			slog.Warn("Invalid RATE_LIMITS window", "entry", entry)
+			continue
+		}
+		if limit <= 0 {
+			delete(policies, name)
+			continue
+		}
+		policies[name] = RateLimitPolicy{Limit: limit, Window: window}
+	}
+	return policies
+}
+
+// slidingWindowScript keeps one sorted-set member per request, scored by the
+// Redis server time in milliseconds so instance clocks do not matter.
+// It returns {allowed, count, reset_ms}.
+var slidingWindowScript = redis.NewScript(`
+redis.replicate_commands()
+local key = KEYS[1]
+local window = tonumber(ARGV[1])
+local limit = tonumber(ARGV[2])
+local member = ARGV[3]
+
+local time = redis.call('TIME')
+local now = tonumber(time[1]) * 1000 + math.floor(tonumber(time[2]) / 1000)
+
+redis.call('ZREMRANGEBYSCORE', key, 0, now - window)
+local count = redis.call('ZCARD', key)
+local allowed = 0
+if count < limit then
+  redis.call('ZADD', key, now, member)
+  count = count + 1
+  allowed = 1
+end
+redis.call('PEXPIRE', key, window)
+
+local reset = window
+local oldest = redis.call('ZRANGE', key, 0, 0, 'WITHSCORES')
+if oldest[2] then
+  reset = tonumber(oldest[2]) + window - now
+end
+return {allowed, count, reset}
+`)
+
+// CheckRateLimits checks the named policy for several subjects of one request,
+// e.g. its IP and user, stopping at the first that is exhausted. It returns
+// that rejection, or else the result with the fewest requests remaining.
+func CheckRateLimits(ctx context.Context, name string, subjects ...string) (RateLimitResult, bool) {
+	var strictest RateLimitResult
+	limited := false
+	for _, subject := range subjects {
+		result, ok := CheckRateLimit(ctx, name, subject)
+		if !ok {
+			return result, false
+		}
+		if !result.Allowed {
+			return result, true
+		}
+		if !limited || result.Remaining < strictest.Remaining {
+			strictest = result
+		}
+		limited = true
+	}
+	if !limited {
+		return RateLimitResult{Allowed: true}, false
+	}
+	return strictest, true
+}
+
+// CheckRateLimit records a request by subject (e.g. "user:alice" or
+// "ip:10.0.0.1") against the named policy. The second result is false when no
+// policy applies. If Redis is unavailable the request is allowed (fail open).
+func CheckRateLimit(ctx context.Context, name, subject string) (RateLimitResult, bool) {
+	policy, ok := RateLimitPolicyFor(name)
+	if !ok {
+		return RateLimitResult{Allowed: true}, false
+	}
+
+	key := fmt.Sprintf("ratelimit:%s:%s", name, subject)
+	member := fmt.Sprintf("%d-%d", time.Now().UnixNano(), rand.Int63())
+
+	values, err := slidingWindowScript.Run(ctx, config.Rdb, []string{key},
+		policy.Window.Milliseconds(), policy.Limit, member).Int64Slice()
+	if err != nil || len(values) != 3 {
+		slog.Warn("Rate limit check failed, allowing request", "name", name, "error", err)
+		return RateLimitResult{Allowed: true, Limit: policy.Limit, Remaining: policy.Limit, Policy: policy}, true
+	}
+
+	remaining := policy.Limit - int(values[1])
+	if remaining < 0 {
+		remaining = 0
+	}
+	return RateLimitResult{
+		Allowed:   values[0] == 1,
+		Limit:     policy.Limit,
+		Remaining: remaining,
+		Reset:     time.Duration(values[2]) * time.Millisecond,
+		Policy:    policy,
+	}, true
+}
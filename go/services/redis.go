@@ -1,8 +1,10 @@
 package services
 
 import (
+	"context"
 	"fmt"
-	"log"
+	"log/slog"
+	"strconv"
 	"sync"
 	"time"
 
@@ -16,35 +18,35 @@ const GeoKey = "user_locations"
 
 // InitializeRedisData clears all user data from Redis
 func InitializeRedisData() {
-	log.Println("🔄 Initializing Redis data...")
+	slog.Info("Initializing Redis data")
 
 	keys, _ := config.Rdb.Keys(config.Ctx, "user_info:*").Result()
 	if len(keys) > 0 {
 		deleted, _ := config.Rdb.Del(config.Ctx, keys...).Result()
-		log.Printf("✅ Deleted %d user_info keys", deleted)
+		slog.Info("Deleted user_info keys", "count", deleted)
 	}
 
 	deleted, _ := config.Rdb.Del(config.Ctx, GeoKey).Result()
 	if deleted > 0 {
-		log.Printf("✅ Deleted GEO key: %s", GeoKey)
+		slog.Info("Deleted GEO key", "key", GeoKey)
 	}
 
-	log.Println("✅ Redis data initialized")
+	slog.Info("Redis data initialized")
 }
 
 // GetAllUsersFromRedis retrieves all users from Redis
-func GetAllUsersFromRedis() []models.User {
-	keys, err := config.Rdb.Keys(config.Ctx, "user_info:*").Result()
+func GetAllUsersFromRedis(ctx context.Context) []models.User {
+	keys, err := config.Rdb.Keys(ctx, "user_info:*").Result()
 	if err != nil {
-		log.Printf("❌ Error getting user keys: %v", err)
+		slog.Error("Error getting user keys", "error", err)
 		return []models.User{}
 	}
 
 	users := []models.User{}
 	for _, key := range keys {
-		userData, err := config.Rdb.HGetAll(config.Ctx, key).Result()
+		userData, err := config.Rdb.HGetAll(ctx, key).Result()
 		if err != nil {
-			log.Printf("⚠️ Error getting user data for key %s: %v", key, err)
+			slog.Warn("Error getting user data", "key", key, "error", err)
 			continue
 		}
 
@@ -57,12 +59,13 @@ func GetAllUsersFromRedis() []models.User {
 			Name: userData["name"],
 		}
 
-		if lat, err := config.Rdb.HGet(config.Ctx, key, "latitude").Float64(); err == nil {
+		if lat, err := config.Rdb.HGet(ctx, key, "latitude").Float64(); err == nil {
 			user.Latitude = lat
 		}
-		if lon, err := config.Rdb.HGet(config.Ctx, key, "longitude").Float64(); err == nil {
+		if lon, err := config.Rdb.HGet(ctx, key, "longitude").Float64(); err == nil {
 			user.Longitude = lon
 		}
+		user.Telemetry = telemetryFromHash(userData)
 
 		users = append(users, user)
 	}
@@ -70,14 +73,37 @@ func GetAllUsersFromRedis() []models.User {
 	return users
 }
 
+// GetUserFromRedis returns a user's stored position, or nil when there is none
+func GetUserFromRedis(ctx context.Context, userID string) (*models.User, error) {
+	userData, err := config.Rdb.HGetAll(ctx, "user_info:"+userID).Result()
+	if err != nil {
+		return nil, err
+	}
+	if userData["id"] == "" {
+		return nil, nil
+	}
+	user := models.User{ID: userData["id"], Name: userData["name"]}
+	user.Latitude, _ = strconv.ParseFloat(userData["latitude"], 64)
+	user.Longitude, _ = strconv.ParseFloat(userData["longitude"], 64)
+	user.Telemetry = telemetryFromHash(userData)
+	return &user, nil
+}
+
 // SaveUserToRedis saves user information and location to Redis
-func SaveUserToRedis(userID, name string, latitude, longitude float64) error {
+func SaveUserToRedis(ctx context.Context, userID, name string, latitude, longitude float64) error {
+	return SaveLocationToRedis(ctx, models.LocationData{ID: userID, Name: name, Latitude: latitude, Longitude: longitude})
+}
+
+// SaveLocationToRedis saves a location update, including any telemetry, to
+// Redis. Telemetry fields the update lacks are cleared.
+func SaveLocationToRedis(ctx context.Context, location models.LocationData) error {
+	userID, name, latitude, longitude := location.ID, location.Name, location.Latitude, location.Longitude
 	userKey := fmt.Sprintf("user_info:%s", userID)
 
-	keyType, err := config.Rdb.Type(config.Ctx, userKey).Result()
+	keyType, err := config.Rdb.Type(ctx, userKey).Result()
 	if err == nil && keyType != "hash" && keyType != "none" {
-		log.Printf("⚠️ Key %s has wrong type (%s), deleting...", userKey, keyType)
-		config.Rdb.Del(config.Ctx, userKey)
+		slog.Warn("Key has wrong type, deleting", "key", userKey, "type", keyType)
+		config.Rdb.Del(ctx, userKey)
 	}
 
 	userData := map[string]interface{}{
@@ -87,57 +113,119 @@ func SaveUserToRedis(userID, name string, latitude, longitude float64) error {
 		"longitude": longitude,
 	}
 
-	if err := config.Rdb.HSet(config.Ctx, userKey, userData).Err(); err != nil {
-		log.Printf("❌ Error storing user info: %v", err)
+	var cleared []string
+	telemetry := telemetryFields(location.Telemetry)
+	for _, field := range telemetryHashFields {
+		if value, ok := telemetry[field]; ok {
+			userData[field] = value
+		} else {
+			cleared = append(cleared, field)
+		}
+	}
+
+	if err := config.Rdb.HSet(ctx, userKey, userData).Err(); err != nil {
+		slog.Error("Error storing user info", "user_id", userID, "error", err)
 		return err
 	}
+	if len(cleared) > 0 {
+		config.Rdb.HDel(ctx, userKey, cleared...)
+	}
 
 	if userID != "HIGMA" {
-		if err := config.Rdb.Expire(config.Ctx, userKey, 60*time.Second).Err(); err != nil {
-			log.Printf("⚠️ Error setting TTL for %s: %v", userKey, err)
+		if err := config.Rdb.Expire(ctx, userKey, 60*time.Second).Err(); err != nil {
+			slog.Warn("Error setting TTL", "key", userKey, "error", err)
 		}
 	}
 
-	if err := config.Rdb.GeoAdd(config.Ctx, GeoKey, &redis.GeoLocation{
+	if err := config.Rdb.GeoAdd(ctx, GeoKey, &redis.GeoLocation{
 		Name:      userID,
 		Longitude: longitude,
 		Latitude:  latitude,
 	}).Err(); err != nil {
-		log.Printf("❌ Error storing location: %v", err)
+		slog.Error("Error storing location", "user_id", userID, "error", err)
 		return err
 	}
 
-	log.Printf("✅ Location saved to Redis: %s (%s) at (%f, %f)", name, userID, latitude, longitude)
+	slog.Debug("Location saved to Redis", "user_id", userID, "name", name, "latitude", latitude, "longitude", longitude)
 	return nil
 }
 
+// telemetryHashFields lists the user_info hash fields holding telemetry
+var telemetryHashFields = []string{"speed", "heading", "accuracy", "battery", "altitude", "timestamp"}
+
+// telemetryFields returns the telemetry values present, keyed by hash field
+func telemetryFields(telemetry models.Telemetry) map[string]interface{} {
+	fields := make(map[string]interface{})
+	for field, value := range map[string]*float64{
+		"speed":    telemetry.Speed,
+		"heading":  telemetry.Heading,
+		"accuracy": telemetry.Accuracy,
+		"battery":  telemetry.Battery,
+		"altitude": telemetry.Altitude,
+	} {
+		if value != nil {
+			fields[field] = *value
+		}
+	}
+	if telemetry.Timestamp != nil {
+		fields["timestamp"] = *telemetry.Timestamp
+	}
+	return fields
+}
+
+// telemetryFromHash reads the telemetry fields of a user_info hash
+func telemetryFromHash(userData map[string]string) models.Telemetry {
+	var telemetry models.Telemetry
+	for field, target := range map[string]**float64{
+		"speed":    &telemetry.Speed,
+		"heading":  &telemetry.Heading,
+		"accuracy": &telemetry.Accuracy,
+		"battery":  &telemetry.Battery,
+		"altitude": &telemetry.Altitude,
+	} {
+		if value, err := strconv.ParseFloat(userData[field], 64); err == nil {
+			*target = &value
+		}
+	}
+	if value, err := strconv.ParseInt(userData["timestamp"], 10, 64); err == nil {
+		telemetry.Timestamp = &value
+	}
+	return telemetry
+}
+
 // DeleteUserFromRedis removes a user from Redis
-func DeleteUserFromRedis(userID string) error {
+func DeleteUserFromRedis(ctx context.Context, userID string) error {
 	userKey := fmt.Sprintf("user_info:%s", userID)
 
-	if err := config.Rdb.Del(config.Ctx, userKey).Err(); err != nil {
+	if err := config.Rdb.Del(ctx, userKey).Err(); err != nil {
 		return err
 	}
 
-	if err := config.Rdb.ZRem(config.Ctx, GeoKey, userID).Err(); err != nil {
+	if err := config.Rdb.ZRem(ctx, GeoKey, userID).Err(); err != nil {
 		return err
 	}
 
 	return nil
 }
 
-// CleanupExpiredUsers periodically checks for expired users
-func CleanupExpiredUsers(onUserExpired func(string), userSIDMap map[string]interface{}, userSIDLock *sync.RWMutex) {
+// CleanupExpiredUsers periodically checks for expired users until ctx is cancelled
+func CleanupExpiredUsers(ctx context.Context, onUserExpired func(string), userSIDMap map[string]interface{}, userSIDLock *sync.RWMutex) {
 	ticker := time.NewTicker(10 * time.Second)
 	defer ticker.Stop()
 
 	lastKnownUsers := make(map[string]bool)
 
-	for range ticker.C {
-		log.Println("🔍 Checking for expired users...")
-		currentUsers := GetAllUsersFromRedis()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		slog.Debug("Checking for expired users")
+		currentUsers := GetAllUsersFromRedis(config.Ctx)
 		currentUserMap := make(map[string]bool)
-		log.Printf("📊 Current users in Redis: %d", len(currentUsers))
+		slog.Debug("Current users in Redis", "count", len(currentUsers))
 
 		for _, user := range currentUsers {
 			currentUserMap[user.ID] = true
@@ -145,9 +233,9 @@ func CleanupExpiredUsers(onUserExpired func(string), userSIDMap map[string]inter
 
 		for userID := range lastKnownUsers {
 			if !currentUserMap[userID] {
-				log.Printf("⏰ User %s expired (no update for 60s)", userID)
+				slog.Info("User expired (no update for 60s)", "user_id", userID)
 				config.Rdb.ZRem(config.Ctx, GeoKey, userID)
-				
+
 				// Call the callback function
 				onUserExpired(userID)
 
@@ -0,0 +1,22 @@
+package services
+
+import (
+	"testing"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/go-redis/redis/v8"
+	"github.com/tthogho1/redisconnect/go/config"
+)
+
+// useTestRedis points config.Rdb at an in-memory Redis for the test
+func useTestRedis(t *testing.T) *miniredis.Miniredis {
+	t.Helper()
+	server := miniredis.RunT(t)
+	previous := config.Rdb
+	config.Rdb = redis.NewClient(&redis.Options{Addr: server.Addr()})
+	t.Cleanup(func() {
+		config.Rdb.Close()
+		config.Rdb = previous
+	})
+	return server
+}
@@ -0,0 +1,49 @@
+package services
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+	"github.com/tthogho1/redisconnect/go/config"
+)
+
+// ErrInvalidSession is returned for session tokens that were never issued,
+// were revoked or have expired
+var ErrInvalidSession = errors.New("invalid session")
+
+func sessionKey(token string) string {
+	return "session:" + token
+}
+
+// IssueSession creates a token that identifies a registered user to the REST
+// API, valid for SESSION_TTL (default 24h) or until revoked
+func IssueSession(ctx context.Context, userID string) (string, error) {
+	raw := make([]byte, 32)
+	if _, err := rand.Read(raw); err != nil {
+		return "", err
+	}
+	token := hex.EncodeToString(raw)
+	ttl := config.GetEnvDuration("SESSION_TTL", 24*time.Hour)
+	if err := config.Rdb.Set(ctx, sessionKey(token), userID, ttl).Err(); err != nil {
+		return "", err
+	}
+	return token, nil
+}
+
+// SessionUser returns the user a session token was issued to
+func SessionUser(ctx context.Context, token string) (string, error) {
+	userID, err := config.Rdb.Get(ctx, sessionKey(token)).Result()
+	if err == redis.Nil {
+		return "", ErrInvalidSession
+	}
+	return userID, err
+}
+
+// RevokeSession invalidates a session token
+func RevokeSession(ctx context.Context, token string) error {
+	return config.Rdb.Del(ctx, sessionKey(token)).Err()
+}
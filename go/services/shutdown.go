@@ -0,0 +1,71 @@
+package services
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"sync/atomic"
+	"time"
+
+	"github.com/tthogho1/redisconnect/go/config"
+)
+
+var (
+	shuttingDown atomic.Bool
+	inFlight     atomic.Int64
+)
+
+// BeginShutdown marks the instance as draining. From then on readiness
+// fails and disconnects no longer delete users from the presence registry.
+func BeginShutdown() {
+	shuttingDown.Store(true)
+}
+
+// ShuttingDown reports whether BeginShutdown has been called
+func ShuttingDown() bool {
+	return shuttingDown.Load()
+}
+
+// RunBackground runs fn in a goroutine that shutdown waits for
+func RunBackground(fn func()) {
+	inFlight.Add(1)
+	go func() {
+		defer inFlight.Add(-1)
+		fn()
+	}()
+}
+
+// trackInFlight registers synchronous work (such as a publish) that shutdown
+// waits for. The returned function must be called when the work is done.
+func trackInFlight() func() {
+	inFlight.Add(1)
+	return func() { inFlight.Add(-1) }
+}
+
+// WaitInFlight blocks until background work and pending publishes finish or ctx expires
+func WaitInFlight(ctx context.Context) error {
+	ticker := time.NewTicker(50 * time.Millisecond)
+	defer ticker.Stop()
+
+	for inFlight.Load() > 0 {
+		select {
+		case <-ctx.Done():
+			return fmt.Errorf("%d operations still in flight: %w", inFlight.Load(), ctx.Err())
+		case <-ticker.C:
+		}
+	}
+	return nil
+}
+
+// HandOffUsers keeps this instance's users in the presence registry while
+// their clients reconnect elsewhere. Their TTL is refreshed to ttl, so they
+// only expire (and emit user_deleted) if they do not come back in time.
+func HandOffUsers(ctx context.Context, userIDs []string, ttl time.Duration) {
+	for _, userID := range userIDs {
+		userKey := fmt.Sprintf("user_info:%s", userID)
+		if err := config.Rdb.Expire(ctx, userKey, ttl).Err(); err != nil {
+			slog.Warn("Error handing off user", "user_id", userID, "error", err)
+		}
+	}
+	slog.Info("Handed off users for reconnection", "users", len(userIDs), "ttl", ttl)
+}
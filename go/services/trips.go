@@ -0,0 +1,346 @@
+package services
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+	"github.com/tthogho1/redisconnect/go/config"
+	"github.com/tthogho1/redisconnect/go/logging"
+	"github.com/tthogho1/redisconnect/go/models"
+)
+
+// Trip history page bounds
+const (
+	defaultTripLimit = 20
+	maxTripLimit     = 100
+)
+
+// Trip end reasons
+const (
+	TripEndStay    = "stay"
+	TripEndTimeout = "timeout"
+)
+
+// ErrInvalidTripQuery is returned for bad trip history parameters
+var ErrInvalidTripQuery = errors.New("invalid trip query")
+
+// tripConfig is read from the environment once
+type tripConfig struct {
+	StayRadius   float64       // meters a user stays within during a stay
+	StayDuration time.Duration // time within StayRadius that makes a stay
+	MinDistance  float64       // shorter trips are not stored
+	MaxGap       time.Duration // a trip with no fixes for this long ends
+	StateTTL     time.Duration
+	HistoryMax   int
+	HistoryTTL   time.Duration
+	SweepEvery   time.Duration // how often open trips without fixes are closed
+}
+
+var (
+	tripSettings tripConfig
+	tripOnce     sync.Once
+)
+
+func currentTripConfig() tripConfig {
+	tripOnce.Do(func() {
+		tripSettings = tripConfig{
+			StayRadius:   config.GetEnvFloat("TRIP_STAY_RADIUS", 100),
+			StayDuration: config.GetEnvDuration("TRIP_STAY_DURATION", 5*time.Minute),
+			MinDistance:  config.GetEnvFloat("TRIP_MIN_DISTANCE", 200),
+			MaxGap:       config.GetEnvDuration("TRIP_MAX_GAP", 30*time.Minute),
+			StateTTL:     config.GetEnvDuration("TRIP_STATE_TTL", 24*time.Hour),
+			HistoryMax:   config.GetEnvInt("TRIP_HISTORY_MAX", 100),
+			HistoryTTL:   config.GetEnvDuration("TRIP_HISTORY_TTL", 30*24*time.Hour),
+			SweepEvery:   config.GetEnvDuration("TRIP_SWEEP_INTERVAL", time.Minute),
+		}
+	})
+	return tripSettings
+}
+
+// Segmentation modes
+const (
+	tripModeUnknown = ""
+	tripModeStay    = "stay"
+	tripModeTrip    = "trip"
+)
+
+// tripState is kept per user in trip_state:{id}
+type tripState struct {
+	Mode string `json:"mode"`
+
+	// Candidate stay: where the user has been since AnchorSince
+	Anchor      locationFix `json:"anchor"`
+	AnchorSince int64       `json:"anchor_since"`
+
+	Last locationFix  `json:"last"`
+	Trip *models.Trip `json:"trip,omitempty"`
+
+	// UpdatedAt is when the server last received a fix, in Unix milliseconds
+	UpdatedAt int64 `json:"updated_at"`
+}
+
+// openTripsKey indexes users with an open trip by UpdatedAt, for the sweeper
+const openTripsKey = "trips_open"
+
+func tripStateKey(userID string) string {
+	return "trip_state:" + userID
+}
+
+func tripsKey(userID string) string {
+	return "trips:" + userID
+}
+
+// trackTrips segments a user's fixes into stays and trips. A trip starts when
+// the user leaves the stay radius and ends once they stay within it for the
+// stay duration, or when fixes stop for longer than the max gap.
+func trackTrips(ctx context.Context, location models.LocationData) {
+	cfg := currentTripConfig()
+	logger := logging.FromContext(ctx)
+	fix := locationFix{Latitude: location.Latitude, Longitude: location.Longitude, Timestamp: *location.Timestamp}
+
+	state, err := loadTripState(ctx, location.ID)
+	if err != nil {
+		logger.Warn("Could not load trip state", "user_id", location.ID, "error", err)
+		return
+	}
+	now := time.Now().UnixMilli()
+	if state == nil {
+		state = &tripState{Anchor: fix, AnchorSince: fix.Timestamp, Last: fix, UpdatedAt: now}
+		saveTripState(ctx, location.ID, state, cfg.StateTTL)
+		return
+	}
+	if fix.Timestamp < state.Last.Timestamp {
+		return
+	}
+	wasOpen := state.Mode == tripModeTrip
+
+	if state.Mode == tripModeTrip && time.Duration(fix.Timestamp-state.Last.Timestamp)*time.Millisecond > cfg.MaxGap {
+		endTrip(ctx, state, state.Last, state.Last.Timestamp, TripEndTimeout, cfg)
+		state.Mode, state.Anchor, state.AnchorSince = tripModeUnknown, fix, fix.Timestamp
+	} else if HaversineMeters(state.Anchor.Latitude, state.Anchor.Longitude, fix.Latitude, fix.Longitude) <= cfg.StayRadius {
+		if time.Duration(fix.Timestamp-state.AnchorSince)*time.Millisecond >= cfg.StayDuration {
+			if state.Mode == tripModeTrip {
+				addTripDistance(state, fix)
+				endTrip(ctx, state, state.Anchor, state.AnchorSince, TripEndStay, cfg)
+			}
+			state.Mode = tripModeStay
+		}
+	} else {
+		if state.Mode != tripModeTrip {
+			startTrip(ctx, location.ID, state)
+		}
+		state.Anchor, state.AnchorSince = fix, fix.Timestamp
+	}
+
+	if state.Mode == tripModeTrip {
+		addTripDistance(state, fix)
+	}
+	state.Last, state.UpdatedAt = fix, now
+	saveTripState(ctx, location.ID, state, cfg.StateTTL)
+
+	var indexErr error
+	switch {
+	case state.Mode == tripModeTrip:
+		indexErr = config.Rdb.ZAdd(ctx, openTripsKey, &redis.Z{Score: float64(now), Member: location.ID}).Err()
+	case wasOpen:
+		indexErr = config.Rdb.ZRem(ctx, openTripsKey, location.ID).Err()
+	}
+	if indexErr != nil {
+		logger.Warn("Could not index open trip", "user_id", location.ID, "error", indexErr)
+	}
+}
+
+// RunTripSweeper closes open trips whose fixes stopped arriving, such as a
+// device going offline mid-trip, until ctx is cancelled. They end at their
+// last fix with end reason timeout.
+func RunTripSweeper(ctx context.Context) {
+	cfg := currentTripConfig()
+	ticker := time.NewTicker(cfg.SweepEvery)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			sweepStaleTrips(ctx, cfg)
+		}
+	}
+}
+
+func sweepStaleTrips(ctx context.Context, cfg tripConfig) {
+	cutoff := time.Now().Add(-cfg.MaxGap).UnixMilli()
+	userIDs, err := config.Rdb.ZRangeByScore(ctx, openTripsKey, &redis.ZRangeBy{
+		Min: "-inf",
+		Max: strconv.FormatInt(cutoff, 10),
+	}).Result()
+	if err != nil {
+		slog.Warn("Could not list open trips", "error", err)
+		return
+	}
+	for _, userID := range userIDs {
+		// Removing the entry claims it, so only one instance closes the trip
+		if removed, err := config.Rdb.ZRem(ctx, openTripsKey, userID).Result(); err != nil || removed == 0 {
+			continue
+		}
+		state, err := loadTripState(ctx, userID)
+		if err != nil || state == nil || state.Mode != tripModeTrip {
+			continue
+		}
+		if state.UpdatedAt > cutoff {
+			// A fix arrived since the scan
+			config.Rdb.ZAdd(ctx, openTripsKey, &redis.Z{Score: float64(state.UpdatedAt), Member: userID})
+			continue
+		}
+		endTrip(ctx, state, state.Last, state.Last.Timestamp, TripEndTimeout, cfg)
+		state.Mode, state.Anchor, state.AnchorSince = tripModeUnknown, state.Last, state.Last.Timestamp
+		saveTripState(ctx, userID, state, cfg.StateTTL)
+		slog.Info("Closed trip without recent fixes", "user_id", userID)
+	}
+}
+
+// startTrip opens a trip from the stay the user just left
+func startTrip(ctx context.Context, userID string, state *tripState) {
+	startedAt := time.UnixMilli(state.Last.Timestamp).UTC()
+	state.Mode = tripModeTrip
+	state.Trip = &models.Trip{
+		ID:             fmt.Sprintf("%s-%d", userID, state.Last.Timestamp),
+		UserID:         userID,
+		StartedAt:      startedAt,
+		StartLatitude:  state.Anchor.Latitude,
+		StartLongitude: state.Anchor.Longitude,
+	}
+	// Distance is counted from the last fix at the stay
+	state.Trip.EndLatitude, state.Trip.EndLongitude = state.Last.Latitude, state.Last.Longitude
+
+	PublishEvent(ctx, TripStartedChannel, map[string]interface{}{
+		"user_id":    userID,
+		"trip_id":    state.Trip.ID,
+		"started_at": startedAt,
+		"latitude":   state.Anchor.Latitude,
+		"longitude":  state.Anchor.Longitude,
+	})
+}
+
+// addTripDistance extends the open trip to a fix
+func addTripDistance(state *tripState, fix locationFix) {
+	trip := state.Trip
+	if trip == nil {
+		return
+	}
+	trip.DistanceMeters += HaversineMeters(trip.EndLatitude, trip.EndLongitude, fix.Latitude, fix.Longitude)
+	trip.EndLatitude, trip.EndLongitude = fix.Latitude, fix.Longitude
+}
+
+// endTrip closes the open trip at a point and time and, if it was long
+// enough, stores it and publishes trip_ended
+func endTrip(ctx context.Context, state *tripState, end locationFix, endedAtMs int64, reason string, cfg tripConfig) {
+	trip := state.Trip
+	state.Trip = nil
+	if trip == nil {
+		return
+	}
+	endedAt := time.UnixMilli(endedAtMs).UTC()
+	trip.EndedAt = &endedAt
+	trip.EndLatitude, trip.EndLongitude = end.Latitude, end.Longitude
+	trip.EndReason = reason
+	trip.DurationSeconds = endedAt.Sub(trip.StartedAt).Seconds()
+	if trip.DurationSeconds > 0 {
+		trip.AverageSpeed = trip.DistanceMeters / trip.DurationSeconds
+	}
+
+	// Trips too short to keep are dropped, and only stored trips are
+	// announced, so every trip_ended can be found in the history
+	if trip.DistanceMeters < cfg.MinDistance {
+		return
+	}
+	if err := saveTrip(ctx, *trip, cfg); err != nil {
+		logging.FromContext(ctx).Warn("Could not store trip", "user_id", trip.UserID, "trip_id", trip.ID, "error", err)
+		return
+	}
+	PublishEvent(ctx, TripEndedChannel, trip)
+}
+
+// saveTrip adds a trip summary to the user's trips:{id} sorted set, scored
+// by start time, keeping the newest HistoryMax
+func saveTrip(ctx context.Context, trip models.Trip, cfg tripConfig) error {
+	data, err := json.Marshal(trip)
+	if err != nil {
+		return err
+	}
+	key := tripsKey(trip.UserID)
+	pipe := config.Rdb.TxPipeline()
+	pipe.ZAdd(ctx, key, &redis.Z{Score: float64(trip.StartedAt.UnixMilli()), Member: data})
+	if cfg.HistoryMax > 0 {
+		pipe.ZRemRangeByRank(ctx, key, 0, int64(-cfg.HistoryMax-1))
+	}
+	if cfg.HistoryTTL > 0 {
+		pipe.Expire(ctx, key, cfg.HistoryTTL)
+	}
+	_, err = pipe.Exec(ctx)
+	return err
+}
+
+// UserTrips returns a user's stored trips, newest first. before (Unix
+// milliseconds, 0 for now) pages back through older trips by start time.
+func UserTrips(ctx context.Context, userID string, limit int, before int64) ([]models.Trip, error) {
+	if limit < 0 || before < 0 {
+		return nil, ErrInvalidTripQuery
+	}
+	if limit == 0 {
+		limit = defaultTripLimit
+	}
+	limit = min(limit, maxTripLimit)
+	upper := "+inf"
+	if before > 0 {
+		upper = "(" + strconv.FormatInt(before, 10)
+	}
+
+	members, err := config.Rdb.ZRevRangeByScore(ctx, tripsKey(userID), &redis.ZRangeBy{
+		Min:   "-inf",
+		Max:   upper,
+		Count: int64(limit),
+	}).Result()
+	if err != nil {
+		return nil, err
+	}
+	trips := make([]models.Trip, 0, len(members))
+	for _, member := range members {
+		var trip models.Trip
+		if err := json.Unmarshal([]byte(member), &trip); err == nil {
+			trips = append(trips, trip)
+		}
+	}
+	return trips, nil
+}
+
+func loadTripState(ctx context.Context, userID string) (*tripState, error) {
+	data, err := config.Rdb.Get(ctx, tripStateKey(userID)).Bytes()
+	if err == redis.Nil {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var state tripState
+	if err := json.Unmarshal(data, &state); err != nil {
+		return nil, fmt.Errorf("decode trip state: %w", err)
+	}
+	return &state, nil
+}
+
+func saveTripState(ctx context.Context, userID string, state *tripState, ttl time.Duration) {
+	data, err := json.Marshal(state)
+	if err == nil {
+		err = config.Rdb.Set(ctx, tripStateKey(userID), data, ttl).Err()
+	}
+	if err != nil {
+		logging.FromContext(ctx).Warn("Could not save trip state", "user_id", userID, "error", err)
+	}
+}
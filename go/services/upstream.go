@@ -0,0 +1,224 @@
+package services
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/tthogho1/redisconnect/go/config"
+	"github.com/tthogho1/redisconnect/go/logging"
+	"github.com/tthogho1/redisconnect/go/metrics"
+	"github.com/tthogho1/redisconnect/go/tracing"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// Upstream names used for circuit breakers
+const (
+	UpstreamWikimedia = "wikimedia"
+	UpstreamHasura    = "hasura"
+	UpstreamHIGMA     = "higma"
+	UpstreamSummarize = "summarize"
+	UpstreamWikidata  = "wikidata"
+	UpstreamOverpass  = "overpass"
+)
+
+// Circuit breaker states
+const (
+	CircuitClosed   = "closed"
+	CircuitOpen     = "open"
+	CircuitHalfOpen = "half_open"
+)
+
+// ErrCircuitOpen is returned when an upstream call is rejected by its breaker
+var ErrCircuitOpen = errors.New("upstream circuit breaker is open")
+
+// UpstreamError is an error response from an upstream, with the HTTP status
+// and any messages it reported (e.g. GraphQL errors, which arrive with 200)
+type UpstreamError struct {
+	Upstream   string
+	StatusCode int
+	Messages   []string
+}
+
+func (e *UpstreamError) Error() string {
+	if len(e.Messages) == 0 {
+		return fmt.Sprintf("%s: http %d", e.Upstream, e.StatusCode)
+	}
+	return fmt.Sprintf("%s: http %d: %s", e.Upstream, e.StatusCode, strings.Join(e.Messages, "; "))
+}
+
+// CircuitBreaker stops calling an upstream after consecutive failures and
+// lets a single trial request through once the cooldown has elapsed.
+type CircuitBreaker struct {
+	name      string
+	threshold int
+	cooldown  time.Duration
+
+	mu       sync.Mutex
+	state    string
+	failures int
+	openedAt time.Time
+	trial    bool
+}
+
+// BreakerStatus is a snapshot of a circuit breaker
+type BreakerStatus struct {
+	State    string    `json:"state"`
+	Failures int       `json:"failures"`
+	OpenedAt time.Time `json:"opened_at"`
+}
+
+// NewCircuitBreaker creates a closed circuit breaker
+func NewCircuitBreaker(name string, threshold int, cooldown time.Duration) *CircuitBreaker {
+	return &CircuitBreaker{
+		name:      name,
+		threshold: threshold,
+		cooldown:  cooldown,
+		state:     CircuitClosed,
+	}
+}
+
+// Allow reports whether a call may proceed
+func (b *CircuitBreaker) Allow() error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	switch b.state {
+	case CircuitOpen:
+		if time.Since(b.openedAt) < b.cooldown {
+			return ErrCircuitOpen
+		}
+		b.state = CircuitHalfOpen
+		b.trial = true
+		return nil
+	case CircuitHalfOpen:
+		// Only one trial request at a time
+		if b.trial {
+			return ErrCircuitOpen
+		}
+		b.trial = true
+		return nil
+	}
+	return nil
+}
+
+// Record updates the breaker with the outcome of a call
+func (b *CircuitBreaker) Record(success bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.trial = false
+	if success {
+		if b.state != CircuitClosed {
+			slog.Info("Circuit breaker closed", "upstream", b.name)
+		}
+		b.state = CircuitClosed
+		b.failures = 0
+		return
+	}
+
+	b.failures++
+	if b.state == CircuitHalfOpen || b.failures >= b.threshold {
+		if b.state != CircuitOpen {
+			slog.Warn("Circuit breaker opened", "upstream", b.name, "failures", b.failures)
+		}
+		b.state = CircuitOpen
+		b.openedAt = time.Now()
+	}
+}
+
+// Release abandons a call allowed by Allow without recording an outcome
+func (b *CircuitBreaker) Release() {
+	b.mu.Lock()
+	b.trial = false
+	b.mu.Unlock()
+}
+
+// Status returns a snapshot of the breaker
+func (b *CircuitBreaker) Status() BreakerStatus {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return BreakerStatus{State: b.state, Failures: b.failures, OpenedAt: b.openedAt}
+}
+
+var (
+	upstreamBreakers     = map[string]*CircuitBreaker{}
+	upstreamBreakersLock sync.Mutex
+)
+
+// upstreamBreaker returns the breaker for an upstream, creating it on first use
+func upstreamBreaker(name string) *CircuitBreaker {
+	upstreamBreakersLock.Lock()
+	defer upstreamBreakersLock.Unlock()
+
+	b, ok := upstreamBreakers[name]
+	if !ok {
+		b = NewCircuitBreaker(name,
+			config.GetEnvInt("UPSTREAM_BREAKER_THRESHOLD", 5),
+			config.GetEnvDuration("UPSTREAM_BREAKER_COOLDOWN", 30*time.Second))
+		upstreamBreakers[name] = b
+	}
+	return b
+}
+
+// UpstreamBreakerStates returns the status of every known upstream breaker
+func UpstreamBreakerStates() map[string]BreakerStatus {
+	states := map[string]BreakerStatus{}
+	for _, name := range []string{UpstreamWikimedia, UpstreamHasura, UpstreamHIGMA, UpstreamSummarize, UpstreamWikidata, UpstreamOverpass} {
+		states[name] = upstreamBreaker(name).Status()
+	}
+	return states
+}
+
+// DoUpstream executes an HTTP request against a named upstream through its
+// circuit breaker. Transport errors and 5xx responses count as failures.
+// The request context's correlation ID is forwarded in the X-Request-ID header
+// and its trace context in the W3C traceparent header.
+func DoUpstream(upstream string, client *http.Client, req *http.Request) (resp *http.Response, err error) {
+	ctx, span := tracing.Start(req.Context(), "upstream "+upstream,
+		trace.WithSpanKind(trace.SpanKindClient),
+		trace.WithAttributes(
+			attribute.String("upstream.name", upstream),
+			attribute.String("http.request.method", req.Method),
+			attribute.String("server.address", req.URL.Host),
+		))
+	defer func() { tracing.EndSpan(span, err) }()
+	req = req.WithContext(ctx)
+	logger := logging.FromContext(ctx)
+
+	breaker := upstreamBreaker(upstream)
+	if err := breaker.Allow(); err != nil {
+		logger.Warn("Upstream call rejected", "upstream", upstream, "error", err)
+		return nil, fmt.Errorf("%s: %w", upstream, err)
+	}
+
+	if id := logging.CorrelationID(ctx); id != "" {
+		req.Header.Set(logging.CorrelationHeader, id)
+	}
+	tracing.InjectHTTP(ctx, req.Header)
+
+	start := time.Now()
+	resp, err = client.Do(req)
+	statusCode := 0
+	if resp != nil {
+		statusCode = resp.StatusCode
+		span.SetAttributes(attribute.Int("http.response.status_code", statusCode))
+	}
+	elapsed := time.Since(start)
+	metrics.ObserveUpstream(upstream, statusCode, err, elapsed)
+	logger.Debug("Upstream call", "upstream", upstream, "status", statusCode, "elapsed", elapsed, "error", err)
+
+	if errors.Is(err, context.Canceled) {
+		// The caller gave up; this says nothing about the upstream
+		breaker.Release()
+		return resp, err
+	}
+	breaker.Record(err == nil && resp.StatusCode < http.StatusInternalServerError)
+	return resp, err
+}
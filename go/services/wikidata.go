@@ -0,0 +1,161 @@
+package services
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/tthogho1/redisconnect/go/models"
+)
+
+// defaultWikidataSPARQLURL is the public Wikidata Query Service endpoint
+const defaultWikidataSPARQLURL = "https://query.wikidata.org/sparql"
+
+// wikidataEntityPrefix prefixes item IDs in SPARQL results
+const wikidataEntityPrefix = "http://www.wikidata.org/entity/"
+
+// wikidataCellQuery finds items with coordinates inside a box that have at
+// least one Wikipedia article, most widely covered first. Arguments: west,
+// south, east, north, wiki language (twice), page size, offset.
+const wikidataCellQuery = `SELECT ?item ?itemLabel ?itemDescription ?coord ?image ?article ?sitelinks WHERE {
+  SERVICE wikibase:box {
+    ?item wdt:P625 ?coord .
+    bd:serviceParam wikibase:cornerSouthWest "Point(%f %f)"^^geo:wktLiteral .
+    bd:serviceParam wikibase:cornerNorthEast "Point(%f %f)"^^geo:wktLiteral .
+  }
+  ?item wikibase:sitelinks ?sitelinks .
+  FILTER(?sitelinks > 0)
+  OPTIONAL { ?item wdt:P18 ?image . }
+  OPTIONAL { ?article schema:about ?item ; schema:isPartOf <https://%s.wikipedia.org/> . }
+  SERVICE wikibase:label { bd:serviceParam wikibase:language "%s,en" . }
+}
+ORDER BY DESC(?sitelinks) ?item
+LIMIT %d OFFSET %d`
+
+// WikidataProvider finds landmarks with the Wikidata Query Service
+type WikidataProvider struct {
+	BaseURL string       // SPARQL endpoint
+	Client  *http.Client // nil uses http.DefaultClient
+}
+
+// Name implements LandmarkProvider
+func (p *WikidataProvider) Name() string { return ProviderWikidata }
+
+type sparqlValue struct {
+	Value string `json:"value"`
+}
+
+type sparqlResponse struct {
+	Results struct {
+		Bindings []map[string]sparqlValue `json:"bindings"`
+	} `json:"results"`
+}
+
+// SearchCell queries items inside the cell's bounds, paging with OFFSET.
+// Wiki categories cannot be matched, and keywords are matched against the
+// label and description of each page of items.
+func (p *WikidataProvider) SearchCell(ctx context.Context, query LandmarkCellQuery) ([]models.Landmark, bool, error) {
+	filter := query.filter()
+	if len(filter.Categories) > 0 {
+		return nil, false, nil
+	}
+
+	centerLat, centerLon, latErr, lonErr := DecodeGeohash(query.Cell)
+	sparql := fmt.Sprintf(wikidataCellQuery,
+		centerLon-lonErr, centerLat-latErr,
+		centerLon+lonErr, centerLat+latErr,
+		query.Lang, query.Lang,
+		landmarkTilePageSize, query.Page*landmarkTilePageSize)
+
+	form := url.Values{}
+	form.Set("query", sparql)
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, p.BaseURL, strings.NewReader(form.Encode()))
+	if err != nil {
+		return nil, false, fmt.Errorf("build request: %w", err)
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Accept", "application/sparql-results+json")
+	req.Header.Set("User-Agent", wikimediaUserAgent)
+
+	resp, err := DoUpstream(UpstreamWikidata, providerClient(p.Client), req)
+	if err != nil {
+		return nil, false, fmt.Errorf("http request: %w", err)
+	}
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, false, fmt.Errorf("read response body: %w", err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, false, fmt.Errorf("http %d: %s", resp.StatusCode, truncateBody(body))
+	}
+
+	var result sparqlResponse
+	if err := json.Unmarshal(body, &result); err != nil {
+		return nil, false, fmt.Errorf("decode response: %w; body=%s", err, truncateBody(body))
+	}
+
+	bindings := result.Results.Bindings
+	landmarks := make([]models.Landmark, 0, len(bindings))
+	seen := make(map[string]bool)
+	for _, row := range bindings {
+		id := strings.TrimPrefix(row["item"].Value, wikidataEntityPrefix)
+		lat, lon, ok := parseWKTPoint(row["coord"].Value)
+		label := row["itemLabel"].Value
+		// Items without a label in the language or English come back labelled with their ID
+		if seen[id] || !ok || label == "" || label == id {
+			continue
+		}
+		seen[id] = true
+		description := row["itemDescription"].Value
+		if !filter.matchesText(label, description) {
+			continue
+		}
+
+		landmark := models.Landmark{
+			Title:      label,
+			Lat:        lat,
+			Lon:        lon,
+			Lang:       query.Lang,
+			Sources:    []string{ProviderWikidata},
+			WikidataID: &id,
+			Class:      classifyLandmark(nil, description, label),
+		}
+		if description != "" {
+			landmark.Description = &description
+		}
+		if image := row["image"].Value; image != "" {
+			// Special:FilePath redirects to a thumbnail of the requested width
+			thumbnail := image + "?width=200"
+			width := 200
+			landmark.ThumbnailURL = &thumbnail
+			landmark.ThumbnailWidth = &width
+		}
+		if article := row["article"].Value; article != "" {
+			landmark.URL = &article
+		}
+		landmarks = append(landmarks, landmark)
+	}
+
+	// Rows repeat for items with several coordinates or images, and keyword
+	// filtering drops rows, so a full page of rows means there may be more
+	return landmarks, len(bindings) == landmarkTilePageSize, nil
+}
+
+// parseWKTPoint parses a WKT "Point(lon lat)" literal
+func parseWKTPoint(wkt string) (float64, float64, bool) {
+	inner, ok := strings.CutPrefix(wkt, "Point(")
+	if !ok {
+		return 0, 0, false
+	}
+	var lat, lon float64
+	if _, err := fmt.Sscanf(strings.TrimSuffix(inner, ")"), "%f %f", &lon, &lat); err != nil {
+		return 0, 0, false
+	}
+	return lat, lon, true
+}
@@ -4,16 +4,86 @@ import (
 	"context"
 	"encoding/json"
 	"fmt"
+	"io"
 	"math"
 	"net/http"
 	"net/url"
+	"os"
+	"regexp"
+	"slices"
+	"sort"
 	"strconv"
+	"strings"
+	"sync"
 
+	"github.com/tthogho1/redisconnect/go/config"
+	"github.com/tthogho1/redisconnect/go/logging"
 	"github.com/tthogho1/redisconnect/go/models"
 )
 
-// WikimediaBaseURL is the base API endpoint for Wikipedia.
-const WikimediaBaseURL = "https://en.wikipedia.org/w/api.php"
+// defaultWikimediaURLTemplate is the API endpoint of a Wikipedia, by language code.
+const defaultWikimediaURLTemplate = "https://%s.wikipedia.org/w/api.php"
+
+// wikimediaUserAgent identifies us to Wikimedia as their API policy requires.
+const wikimediaUserAgent = "redisconnect/0.1 (github.com/tthogho1/redisconnect; contact:tthogho1@gmail.com)"
+
+// maxWikimediaContinuations bounds follow-up requests for one query's
+// langlinks and coordinates.
+const maxWikimediaContinuations = 5
+
+// defaultWikiLangs are the wikis that may be queried when WIKIPEDIA_LANGS is not set.
+var defaultWikiLangs = "en,ja,zh,ko,de,fr,es,it,pt,ru"
+
+var wikiLangPattern = regexp.MustCompile(`^[a-z]{2,3}(-[a-z]{2,8})?$|^simple$`)
+
+var (
+	wikiLangs            map[string]bool
+	wikiDefaultLang      string
+	wikimediaURLTemplate string
+	wikiLangSettings     sync.Once
+)
+
+// loadWikiLangs reads WIKIPEDIA_LANGS (comma-separated allowlist),
+// WIKIPEDIA_DEFAULT_LANG (default "en"), which is always allowed, and
+// WIKIPEDIA_API_URL (endpoint template with %s for the language).
+func loadWikiLangs() {
+	wikimediaURLTemplate = config.GetEnv("WIKIPEDIA_API_URL", defaultWikimediaURLTemplate)
+
+	wikiLangs = make(map[string]bool)
+	value := os.Getenv("WIKIPEDIA_LANGS")
+	if value == "" {
+		value = defaultWikiLangs
+	}
+	for _, lang := range strings.Split(value, ",") {
+		lang = strings.ToLower(strings.TrimSpace(lang))
+		if wikiLangPattern.MatchString(lang) {
+			wikiLangs[lang] = true
+		}
+	}
+
+	wikiDefaultLang = strings.ToLower(config.GetEnv("WIKIPEDIA_DEFAULT_LANG", "en"))
+	if !wikiLangPattern.MatchString(wikiDefaultLang) {
+		wikiDefaultLang = "en"
+	}
+	wikiLangs[wikiDefaultLang] = true
+}
+
+// ResolveWikiLang returns the wiki language to query for a requested code,
+// falling back to WIKIPEDIA_DEFAULT_LANG when it is empty or not allowed.
+func ResolveWikiLang(lang string) string {
+	wikiLangSettings.Do(loadWikiLangs)
+	lang = strings.ToLower(strings.TrimSpace(lang))
+	if wikiLangs[lang] {
+		return lang
+	}
+	return wikiDefaultLang
+}
+
+// WikimediaURL returns the API endpoint for a language's Wikipedia.
+func WikimediaURL(lang string) string {
+	lang = ResolveWikiLang(lang)
+	return fmt.Sprintf(wikimediaURLTemplate, lang)
+}
 
 // --- Internal response structs for JSON decoding ---
 
@@ -28,12 +98,50 @@ type wmThumbnail struct {
 	Height int    `json:"height"`
 }
 
+type wmLangLink struct {
+	Lang  string `json:"lang"`
+	URL   string `json:"url"`
+	Title string `json:"*"`
+}
+
 type wmPage struct {
 	PageID      int64          `json:"pageid"`
 	Title       string         `json:"title"`
 	Coordinates []wmCoordinate `json:"coordinates"`
 	Thumbnail   *wmThumbnail   `json:"thumbnail"`
 	Description string         `json:"description"`
+	LangLinks   []wmLangLink   `json:"langlinks"`
+	Index       int            `json:"index"` // rank within generator results
+
+	// Detail props, only present when requested
+	Extract      string        `json:"extract"`
+	Categories   []wmCategory  `json:"categories"`
+	CanonicalURL string        `json:"canonicalurl"`
+	PageProps    *wmPageProps  `json:"pageprops"`
+	Revisions    []wmRevision  `json:"revisions"`
+	PageImage    string        `json:"pageimage"`
+	ImageInfo    []wmImageInfo `json:"imageinfo"`
+}
+
+type wmCategory struct {
+	Title string `json:"title"`
+}
+
+type wmPageProps struct {
+	WikibaseItem string `json:"wikibase_item"`
+}
+
+type wmRevision struct {
+	Timestamp string `json:"timestamp"`
+}
+
+type wmImageInfo struct {
+	URL        string `json:"url"`
+	Width      int    `json:"width"`
+	Height     int    `json:"height"`
+	Mime       string `json:"mime"`
+	ThumbURL   string `json:"thumburl"`
+	ThumbWidth int    `json:"thumbwidth"`
 }
 
 type wmQuery struct {
@@ -41,131 +149,191 @@ type wmQuery struct {
 }
 
 type wmResponse struct {
-	Query *wmQuery `json:"query"`
+	Query    *wmQuery                   `json:"query"`
+	Continue map[string]json.RawMessage `json:"continue"`
 }
 
-// SearchLandmarksNearby calls the Wikimedia API using nearcoord search
-// and returns a slice of Landmark with basic info (no thumbnails).
-func SearchLandmarksNearby(ctx context.Context, params models.LandmarkQueryParams) ([]models.Landmark, error) {
-	radiusMeters := params.Radius
-	if radiusMeters <= 0 {
-		radiusMeters = 10000
-	}
-	km := int(math.Round(float64(radiusMeters) / 1000.0))
-
-	limit := params.Limit
-	if limit <= 0 {
-		limit = 10
-	}
-	if limit > 500 {
-		limit = 500
-	}
+// wikimediaQuery runs an action=query request against a wiki's API endpoint,
+// adding interlanguage links, the Wikidata ID and visible categories (for
+// classification) to the requested props.
+func wikimediaQuery(ctx context.Context, endpoint string, q url.Values) (*wmQuery, int, error) {
+	q.Set("prop", q.Get("prop")+"|langlinks|pageprops|categories")
+	q.Set("clshow", "!hidden")
+	q.Set("cllimit", "max")
+	q.Set("llprop", "url")
+	q.Set("lllimit", "max")
+	q.Set("ppprop", "wikibase_item")
+	return wikimediaQueryPages(ctx, endpoint, q)
+}
 
-	q := url.Values{}
+// wikimediaQueryPages runs an action=query request against a wiki's API endpoint.
+// Property continuations are followed so every page carries its full props;
+// generator continuations (further results) are not, but their gsroffset is
+// returned (0 when there are no more results). If props are still pending
+// after maxWikimediaContinuations, the pages are returned as they are along
+// with the pending gsroffset, so paging is not cut short.
+func wikimediaQueryPages(ctx context.Context, endpoint string, q url.Values) (*wmQuery, int, error) {
 	q.Set("action", "query")
-	q.Set("generator", "search")
-	q.Set("gsrsearch", fmt.Sprintf("nearcoord:%dkm,%f,%f", km, params.Lat, params.Lon))
-	q.Set("gsrlimit", strconv.Itoa(limit))
-	q.Set("prop", "coordinates|description")
-	q.Set("colimit", strconv.Itoa(limit))
 	q.Set("format", "json")
 	q.Set("origin", "*")
 
-	reqURL := WikimediaBaseURL + "?" + q.Encode()
-
-	req, err := http.NewRequestWithContext(ctx, http.MethodGet, reqURL, nil)
-	if err != nil {
-		return nil, fmt.Errorf("wikimedia: build request: %w", err)
-	}
-	req.Header.Set("Accept", "application/json")
-	req.Header.Set("User-Agent", "redisconnect/0.1 (github.com/tthogho1/redisconnect; contact:tthogho1@gmail.com)")
+	// Continue blocks overwrite q, so the request's own offset is kept for
+	// the fallback below
+	searchOffset, _ := strconv.Atoi(q.Get("gsroffset"))
+	searchLimit, _ := strconv.Atoi(q.Get("gsrlimit"))
+
+	merged := &wmQuery{Pages: map[string]wmPage{}}
+	var continued []string
+	nextOffset := 0
+	for i := 0; i <= maxWikimediaContinuations; i++ {
+		result, err := wikimediaGet(ctx, endpoint, q)
+		if err != nil {
+			return nil, 0, err
+		}
+		if result.Query != nil {
+			mergeWikimediaPages(merged.Pages, result.Query.Pages)
+		}
 
-	resp, err := http.DefaultClient.Do(req)
-	if err != nil {
-		return nil, fmt.Errorf("wikimedia: search request: %w", err)
+		// Blocks with props pending carry the generator's next offset too
+		nextOffset = 0
+		if raw, ok := result.Continue["gsroffset"]; ok {
+			_ = json.Unmarshal(raw, &nextOffset)
+		}
+		if !hasPropContinuation(result.Continue) {
+			return merged, nextOffset, nil
+		}
+		// Each continue block is complete, so drop the previous one first
+		for _, key := range continued {
+			q.Del(key)
+		}
+		continued = continued[:0]
+		for key, raw := range result.Continue {
+			var value interface{}
+			if err := json.Unmarshal(raw, &value); err == nil {
+				q.Set(key, fmt.Sprint(value))
+				continued = append(continued, key)
+			}
+		}
 	}
-	defer resp.Body.Close()
-
-	var result wmResponse
-	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
-		return nil, fmt.Errorf("wikimedia: decode search response: %w", err)
+	logging.FromContext(ctx).Warn("Wikimedia props still pending after continuation limit", "endpoint", endpoint, "continuations", maxWikimediaContinuations)
+	if nextOffset == 0 && q.Get("generator") == "search" {
+		// Assume a full batch so the caller asks for the next one; past the
+		// last result that comes back empty and paging ends there
+		nextOffset = searchOffset + searchLimit
 	}
+	return merged, nextOffset, nil
+}
 
-	if result.Query == nil {
-		return []models.Landmark{}, nil
+// hasPropContinuation reports whether a continue block still has page
+// properties pending rather than only the next page of generator results
+// (generator parameters are prefixed with "g").
+func hasPropContinuation(cont map[string]json.RawMessage) bool {
+	for key := range cont {
+		if key != "continue" && !strings.HasPrefix(key, "g") {
+			return true
+		}
 	}
+	return false
+}
 
-	landmarks := make([]models.Landmark, 0, len(result.Query.Pages))
-	for _, page := range result.Query.Pages {
-		lm := models.Landmark{
-			PageID: page.PageID,
-			Title:  page.Title,
+// mergeWikimediaPages folds a continuation batch into the pages seen so far
+func mergeWikimediaPages(into, batch map[string]wmPage) {
+	for id, page := range batch {
+		existing, ok := into[id]
+		if !ok {
+			into[id] = page
+			continue
 		}
-		if len(page.Coordinates) > 0 {
-			lm.Lat = page.Coordinates[0].Lat
-			lm.Lon = page.Coordinates[0].Lon
+		if len(existing.Coordinates) == 0 {
+			existing.Coordinates = page.Coordinates
+		}
+		if existing.Thumbnail == nil {
+			existing.Thumbnail = page.Thumbnail
+		}
+		if existing.Description == "" {
+			existing.Description = page.Description
+		}
+		if existing.Extract == "" {
+			existing.Extract = page.Extract
 		}
-		if page.Description != "" {
-			desc := page.Description
-			lm.Description = &desc
+		if existing.CanonicalURL == "" {
+			existing.CanonicalURL = page.CanonicalURL
 		}
-		landmarks = append(landmarks, lm)
+		if existing.PageProps == nil {
+			existing.PageProps = page.PageProps
+		}
+		if existing.PageImage == "" {
+			existing.PageImage = page.PageImage
+		}
+		if len(existing.Revisions) == 0 {
+			existing.Revisions = page.Revisions
+		}
+		if len(existing.ImageInfo) == 0 {
+			existing.ImageInfo = page.ImageInfo
+		}
+		existing.LangLinks = append(existing.LangLinks, page.LangLinks...)
+		existing.Categories = append(existing.Categories, page.Categories...)
+		into[id] = existing
 	}
-
-	return landmarks, nil
 }
 
-// FetchLandmarkDetails fetches details for a single page ID,
-// including thumbnail and description. May return nil if not found.
-func FetchLandmarkDetails(ctx context.Context, pageID int64) (*models.Landmark, error) {
-	q := url.Values{}
-	q.Set("action", "query")
-	q.Set("pageids", strconv.FormatInt(pageID, 10))
-	q.Set("prop", "pageimages|coordinates|description")
-	q.Set("piprop", "thumbnail")
-	q.Set("pithumbsize", "200")
-	q.Set("format", "json")
-	q.Set("origin", "*")
+// sortedPages returns pages in generator result order
+func sortedPages(pages map[string]wmPage) []wmPage {
+	sorted := make([]wmPage, 0, len(pages))
+	for _, page := range pages {
+		sorted = append(sorted, page)
+	}
+	sort.Slice(sorted, func(i, j int) bool {
+		if sorted[i].Index != sorted[j].Index {
+			return sorted[i].Index < sorted[j].Index
+		}
+		return sorted[i].PageID < sorted[j].PageID
+	})
+	return sorted
+}
 
-	reqURL := WikimediaBaseURL + "?" + q.Encode()
+func wikimediaGet(ctx context.Context, endpoint string, q url.Values) (*wmResponse, error) {
+	reqURL := endpoint + "?" + q.Encode()
 
 	req, err := http.NewRequestWithContext(ctx, http.MethodGet, reqURL, nil)
 	if err != nil {
 		return nil, fmt.Errorf("wikimedia: build request: %w", err)
 	}
 	req.Header.Set("Accept", "application/json")
-	req.Header.Set("User-Agent", "redisconnect/0.1 (github.com/tthogho1/redisconnect; contact:tthogho1@gmail.com)")
+	req.Header.Set("User-Agent", wikimediaUserAgent)
 
-	resp, err := http.DefaultClient.Do(req)
+	resp, err := DoUpstream(UpstreamWikimedia, http.DefaultClient, req)
 	if err != nil {
-		return nil, fmt.Errorf("wikimedia: details request: %w", err)
+		return nil, fmt.Errorf("wikimedia: http request: %w", err)
 	}
 	defer resp.Body.Close()
 
-	var result wmResponse
-	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
-		return nil, fmt.Errorf("wikimedia: decode details response: %w", err)
+	// Read response body for logging and robust decode errors.
+	bodyBytes, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, fmt.Errorf("wikimedia: read response body: %w", err)
 	}
 
-	if result.Query == nil || len(result.Query.Pages) == 0 {
-		return nil, nil
-	}
+	logging.FromContext(ctx).Debug("Wikimedia upstream response", "endpoint", endpoint, "status", resp.StatusCode, "bytes", len(bodyBytes))
 
-	// The API returns a single page keyed by its page ID string.
-	var page wmPage
-	for _, p := range result.Query.Pages {
-		page = p
-		break
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("wikimedia: http %d: %s", resp.StatusCode, truncateBody(bodyBytes))
 	}
 
-	// PageID of -1 means the page was not found.
-	if page.PageID <= 0 {
-		return nil, nil
+	var result wmResponse
+	if err := json.Unmarshal(bodyBytes, &result); err != nil {
+		return nil, fmt.Errorf("wikimedia: decode response: %w; body=%s", err, truncateBody(bodyBytes))
 	}
+	return &result, nil
+}
 
-	lm := &models.Landmark{
-		PageID: page.PageID,
-		Title:  page.Title,
+// landmarkFromPage converts a decoded page into a Landmark from the lang wiki
+func landmarkFromPage(page wmPage, lang string) models.Landmark {
+	lm := models.Landmark{
+		PageID:  page.PageID,
+		Title:   page.Title,
+		Lang:    lang,
+		Sources: []string{ProviderWikipedia},
 	}
 
 	if len(page.Coordinates) > 0 {
@@ -187,5 +355,185 @@ func FetchLandmarkDetails(ctx context.Context, pageID int64) (*models.Landmark,
 		lm.ThumbnailHeight = &h
 	}
 
-	return lm, nil
+	if page.PageProps != nil && page.PageProps.WikibaseItem != "" {
+		item := page.PageProps.WikibaseItem
+		lm.WikidataID = &item
+	}
+
+	for _, link := range page.LangLinks {
+		lm.LangLinks = append(lm.LangLinks, models.LangLink{Lang: link.Lang, Title: link.Title, URL: link.URL})
+	}
+
+	categories := make([]string, len(page.Categories))
+	for i, category := range page.Categories {
+		categories[i] = stripNamespace(category.Title)
+	}
+	lm.Class = classifyLandmark(categories, page.Description, page.Title)
+
+	return lm
+}
+
+// WikipediaProvider finds landmarks with Wikipedia's nearcoord search
+type WikipediaProvider struct {
+	// URLTemplate is the API endpoint with %s for the language; empty uses
+	// WIKIPEDIA_API_URL
+	URLTemplate string
+}
+
+// Name implements LandmarkProvider
+func (p *WikipediaProvider) Name() string { return ProviderWikipedia }
+
+// SearchCell searches the circle around a geohash cell, paging with gsroffset
+func (p *WikipediaProvider) SearchCell(ctx context.Context, query LandmarkCellQuery) ([]models.Landmark, bool, error) {
+	centerLat, centerLon, latErr, lonErr := DecodeGeohash(query.Cell)
+	radiusKm := int(math.Ceil(HaversineMeters(centerLat, centerLon, centerLat+latErr, centerLon+lonErr) / 1000.0))
+	if radiusKm < 1 {
+		radiusKm = 1
+	}
+
+	gsrsearch := fmt.Sprintf(
+		"nearcoord:%dkm,%f,%f hastemplate:\"Coord\"",
+		radiusKm,
+		centerLat,
+		centerLon,
+	)
+	if clauses := query.filter().cirrusClauses(); clauses != "" {
+		gsrsearch += " " + clauses
+	}
+
+	q := url.Values{}
+	q.Set("generator", "search")
+	q.Set("gsrsearch", gsrsearch)
+	q.Set("gsrlimit", strconv.Itoa(landmarkTilePageSize))
+	q.Set("gsroffset", strconv.Itoa(query.Page*landmarkTilePageSize))
+	q.Set("prop", "coordinates|description|pageimages")
+	q.Set("colimit", strconv.Itoa(landmarkTilePageSize))
+	q.Set("piprop", "thumbnail")
+	q.Set("pithumbsize", "200")
+	q.Set("pilimit", strconv.Itoa(landmarkTilePageSize))
+
+	endpoint := WikimediaURL(query.Lang)
+	if p.URLTemplate != "" {
+		endpoint = fmt.Sprintf(p.URLTemplate, query.Lang)
+	}
+	result, nextOffset, err := wikimediaQuery(ctx, endpoint, q)
+	if err != nil {
+		return nil, false, err
+	}
+
+	landmarks := make([]models.Landmark, 0, len(result.Pages))
+	for _, page := range sortedPages(result.Pages) {
+		if len(page.Coordinates) > 0 {
+			landmarks = append(landmarks, landmarkFromPage(page, query.Lang))
+		}
+	}
+	return landmarks, nextOffset > 0, nil
+}
+
+// SearchLandmarksNearby calls the Wikimedia API using nearcoord search
+// and returns a slice of Landmark with basic info (no thumbnails).
+func SearchLandmarksNearby(ctx context.Context, params models.LandmarkQueryParams) ([]models.Landmark, error) {
+	filter := newLandmarkFilter(params.Categories, params.Keywords, params.Exclude)
+	landmarks, err := searchLandmarksNearby(ctx, params, filter)
+	if err != nil {
+		return nil, err
+	}
+	kept := landmarks[:0]
+	for _, landmark := range landmarks {
+		if filter.keepClass(landmark) {
+			kept = append(kept, landmark)
+		}
+	}
+	return kept, nil
+}
+
+// searchLandmarksNearby runs the nearcoord search with the filter's
+// CirrusSearch clauses; class filters are left to the caller
+func searchLandmarksNearby(ctx context.Context, params models.LandmarkQueryParams, filter landmarkFilter) ([]models.Landmark, error) {
+	lang := ResolveWikiLang(params.Lang)
+
+	radiusMeters := params.Radius
+	if radiusMeters <= 0 {
+		radiusMeters = 10000
+	}
+	km := int(math.Round(float64(radiusMeters) / 1000.0))
+
+	limit := params.Limit
+	if limit <= 0 {
+		limit = 10
+	}
+	if limit > 500 {
+		limit = 500
+	}
+
+	q := url.Values{}
+	q.Set("generator", "search")
+	gsrsearch := fmt.Sprintf("nearcoord:%dkm,%f,%f", km, params.Lat, params.Lon)
+	if clauses := filter.cirrusClauses(); clauses != "" {
+		gsrsearch += " " + clauses
+	}
+	q.Set("gsrsearch", gsrsearch)
+	q.Set("gsrlimit", strconv.Itoa(limit))
+	q.Set("prop", "coordinates|description")
+	q.Set("colimit", strconv.Itoa(limit))
+
+	result, _, err := wikimediaQuery(ctx, WikimediaURL(lang), q)
+	if err != nil {
+		return nil, err
+	}
+
+	landmarks := make([]models.Landmark, 0, len(result.Pages))
+	for _, page := range sortedPages(result.Pages) {
+		landmarks = append(landmarks, landmarkFromPage(page, lang))
+	}
+
+	return landmarks, nil
+}
+
+// FetchLandmarkDetails fetches details for a single page, by ID or title,
+// including thumbnail and description plus the optional fields in
+// params.Fields. May return nil if not found.
+func FetchLandmarkDetails(ctx context.Context, params models.LandmarkDetailsParams) (*models.Landmark, error) {
+	params, err := normalizeDetailsParams(params)
+	if err != nil {
+		return nil, err
+	}
+	lang := params.Lang
+
+	q := url.Values{}
+	if params.PageID > 0 {
+		q.Set("pageids", strconv.FormatInt(params.PageID, 10))
+	} else {
+		q.Set("titles", params.Title)
+		q.Set("redirects", "1")
+	}
+	q.Set("prop", "pageimages|coordinates|description")
+	q.Set("piprop", "thumbnail")
+	q.Set("pithumbsize", "200")
+	addDetailProps(q, params.Fields)
+
+	result, _, err := wikimediaQuery(ctx, WikimediaURL(lang), q)
+	if err != nil {
+		return nil, err
+	}
+
+	// The API returns a single page keyed by its page ID string.
+	for _, page := range result.Pages {
+		// Missing pages have no (or a negative) page ID.
+		if page.PageID <= 0 {
+			return nil, nil
+		}
+		lm := landmarkFromPage(page, lang)
+		applyDetails(&lm, page, params.Fields)
+
+		if slices.Contains(params.Fields, FieldImages) {
+			images, err := fetchLandmarkImages(ctx, WikimediaURL(lang), page.Title, page.PageImage, params.ImageSizes, params.ImageLimit)
+			if err != nil {
+				return nil, err
+			}
+			lm.Images = images
+		}
+		return &lm, nil
+	}
+	return nil, nil
 }
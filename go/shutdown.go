@@ -0,0 +1,75 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"math/rand"
+	"net/http"
+	"time"
+
+	"github.com/tthogho1/redisconnect/go/config"
+	"github.com/tthogho1/redisconnect/go/services"
+)
+
+// gracefulShutdown drains this instance within SHUTDOWN_TIMEOUT (default 25s):
+// it fails readiness, stops accepting connections, hands local users off in the
+// presence registry, tells clients to reconnect elsewhere, and waits for
+// pending publishes and background upstream calls before stopping.
+func gracefulShutdown(server *http.Server, stopBackground context.CancelFunc, shutdownTracing func(context.Context) error) {
+	timeout := config.GetEnvDuration("SHUTDOWN_TIMEOUT", 25*time.Second)
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	slog.Info("Shutdown signal received, draining", "timeout", timeout)
+
+	// Readiness now fails and disconnects no longer delete users
+	services.BeginShutdown()
+
+	// Stop accepting new connections; hijacked WebSockets are drained below
+	serverDone := make(chan error, 1)
+	go func() {
+		serverDone <- server.Shutdown(ctx)
+	}()
+
+	// Keep local users alive in Redis while their clients move to another instance
+	userSIDLock.RLock()
+	userIDs := make([]string, 0, len(userSIDMap))
+	for userID := range userSIDMap {
+		userIDs = append(userIDs, userID)
+	}
+	userSIDLock.RUnlock()
+	services.HandOffUsers(ctx, userIDs, config.GetEnvDuration("SHUTDOWN_HANDOFF_TTL", 60*time.Second))
+
+	// Ask clients to reconnect elsewhere, spreading reconnects over [retry, 2*retry)
+	retryAfter := config.GetEnvDuration("SHUTDOWN_RETRY_AFTER", 2*time.Second)
+	sockets := io.Sockets()
+	for _, socket := range sockets {
+		jitter := time.Duration(rand.Int63n(int64(retryAfter) + 1))
+		socket.Emit("server_shutdown", map[string]interface{}{
+			"reason":         "server_shutdown",
+			"retry_after_ms": (retryAfter + jitter).Milliseconds(),
+		})
+		socket.Disconnect()
+	}
+	slog.Info("Notified and disconnected clients", "sockets", len(sockets))
+
+	// Flush pending publishes and background upstream calls (e.g. HIGMA replies)
+	if err := services.WaitInFlight(ctx); err != nil {
+		slog.Warn("Shutdown deadline reached with work in flight", "error", err)
+	}
+
+	// Stop the subscription and cleanup goroutines
+	stopBackground()
+
+	if err := <-serverDone; err != nil {
+		slog.Warn("HTTP server shutdown incomplete", "error", err)
+	}
+	if err := shutdownTracing(ctx); err != nil {
+		slog.Warn("Tracing shutdown incomplete", "error", err)
+	}
+	if err := config.Rdb.Close(); err != nil {
+		slog.Warn("Error closing Redis client", "error", err)
+	}
+
+	slog.Info("Shutdown complete")
+}
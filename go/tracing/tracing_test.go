@@ -0,0 +1,166 @@
+package tracing
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/gin-gonic/gin"
+	"github.com/go-redis/redis/v8"
+	"go.opentelemetry.io/contrib/instrumentation/github.com/gin-gonic/gin/otelgin"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/codes"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// recordSpans installs a tracer provider that keeps ended spans in memory,
+// with the propagators Init sets up
+func recordSpans(t *testing.T) *tracetest.SpanRecorder {
+	t.Helper()
+	t.Setenv("OTEL_TRACES_EXPORTER", "none")
+	if _, err := Init(context.Background()); err != nil {
+		t.Fatalf("Init: %v", err)
+	}
+	recorder := tracetest.NewSpanRecorder()
+	provider := sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recorder))
+	previous := otel.GetTracerProvider()
+	otel.SetTracerProvider(provider)
+	t.Cleanup(func() {
+		otel.SetTracerProvider(previous)
+		provider.Shutdown(context.Background())
+	})
+	return recorder
+}
+
+func spansByName(spans []sdktrace.ReadOnlySpan) map[string]sdktrace.ReadOnlySpan {
+	byName := make(map[string]sdktrace.ReadOnlySpan, len(spans))
+	for _, span := range spans {
+		byName[span.Name()] = span
+	}
+	return byName
+}
+
+func TestRequestSpans(t *testing.T) {
+	recorder := recordSpans(t)
+	gin.SetMode(gin.TestMode)
+
+	server := miniredis.RunT(t)
+	rdb := redis.NewClient(&redis.Options{Addr: server.Addr()})
+	defer rdb.Close()
+	rdb.AddHook(RedisHook{})
+	server.HSet("user_info:u1", "name", "Alice")
+
+	// The upstream sees the request's trace in its headers
+	var upstreamTrace trace.SpanContext
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		upstreamTrace = trace.SpanContextFromContext(Extract(context.Background(), map[string]string{
+			"traceparent": r.Header.Get("traceparent"),
+		}))
+	}))
+	defer upstream.Close()
+
+	router := gin.New()
+	router.Use(otelgin.Middleware(ServiceName))
+	router.GET("/users/:user_id", func(c *gin.Context) {
+		ctx := c.Request.Context()
+		name, err := rdb.HGet(ctx, "user_info:"+c.Param("user_id"), "name").Result()
+		if err != nil {
+			c.Status(http.StatusInternalServerError)
+			return
+		}
+		// A missing key is not an error
+		rdb.Get(ctx, "user_location:"+c.Param("user_id"))
+
+		ctx, span := Start(ctx, "upstream test", trace.WithSpanKind(trace.SpanKindClient))
+		req, _ := http.NewRequestWithContext(ctx, http.MethodGet, upstream.URL, nil)
+		InjectHTTP(ctx, req.Header)
+		resp, err := http.DefaultClient.Do(req)
+		if err == nil {
+			resp.Body.Close()
+		}
+		EndSpan(span, err)
+		c.String(http.StatusOK, name)
+	})
+
+	// The request continues the caller's trace
+	const callerTrace = "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01"
+	w := httptest.NewRecorder()
+	req := httptest.NewRequest(http.MethodGet, "/users/u1", nil)
+	req.Header.Set("traceparent", callerTrace)
+	router.ServeHTTP(w, req)
+	if w.Code != http.StatusOK || w.Body.String() != "Alice" {
+		t.Fatalf("response %d %q", w.Code, w.Body.String())
+	}
+
+	spans := spansByName(recorder.Ended())
+	if len(spans) != 4 {
+		names := make([]string, 0, len(spans))
+		for name := range spans {
+			names = append(names, name)
+		}
+		t.Fatalf("recorded spans %v, want the request, two Redis commands and the upstream call", names)
+	}
+	request, ok := spans["/users/:user_id"]
+	if !ok || request.SpanKind() != trace.SpanKindServer {
+		t.Fatalf("no server span named after the route")
+	}
+	if got := request.SpanContext().TraceID().String(); got != "4bf92f3577b34da6a3ce929d0e0e4736" {
+		t.Errorf("request trace %s, want the caller's", got)
+	}
+	if got := request.Parent().SpanID().String(); got != "00f067aa0ba902b7" {
+		t.Errorf("request parent %s, want the caller's span", got)
+	}
+
+	for _, name := range []string{"redis hget", "redis get", "upstream test"} {
+		span, ok := spans[name]
+		if !ok {
+			t.Errorf("no %q span", name)
+			continue
+		}
+		if span.Parent().SpanID() != request.SpanContext().SpanID() || span.SpanKind() != trace.SpanKindClient {
+			t.Errorf("%q is a %v span under %s, want a client span under the request", name, span.SpanKind(), span.Parent().SpanID())
+		}
+		if span.Status().Code == codes.Error {
+			t.Errorf("%q has error status %q", name, span.Status().Description)
+		}
+	}
+	if got := upstreamTrace.SpanID(); got != spans["upstream test"].SpanContext().SpanID() {
+		t.Errorf("upstream saw parent span %s, want the upstream call's", got)
+	}
+}
+
+func TestEndSpanRecordsError(t *testing.T) {
+	recorder := recordSpans(t)
+
+	_, span := Start(context.Background(), "failing")
+	EndSpan(span, errors.New("boom"))
+	_, span = Start(context.Background(), "succeeding")
+	EndSpan(span, nil)
+
+	spans := spansByName(recorder.Ended())
+	if failing := spans["failing"]; failing.Status().Code != codes.Error || len(failing.Events()) != 1 {
+		t.Errorf("failing span status %v with %d events, want an error and its event", failing.Status(), len(failing.Events()))
+	}
+	if succeeding := spans["succeeding"]; succeeding.Status().Code != codes.Unset || len(succeeding.Events()) != 0 {
+		t.Errorf("succeeding span status %v with %d events, want neither", succeeding.Status(), len(succeeding.Events()))
+	}
+}
+
+func TestInjectExtract(t *testing.T) {
+	recordSpans(t)
+
+	ctx, span := Start(context.Background(), "publish")
+	defer span.End()
+	carrier := map[string]string{}
+	Inject(ctx, carrier)
+
+	remote := trace.SpanContextFromContext(Extract(context.Background(), carrier))
+	if !remote.IsRemote() || remote.TraceID() != span.SpanContext().TraceID() || remote.SpanID() != span.SpanContext().SpanID() {
+		t.Errorf("extracted %v from %v, want the publishing span", remote, carrier)
+	}
+}